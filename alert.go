@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	tele "gopkg.in/telebot.v3"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 告警模块自身的组件名，发送告警失败的日志不再转发，避免循环
+const alertComponent = "alert"
+
+// 日志中未指定 component 字段时使用的组件名
+const defaultComponent = "bot"
+
+// 单条告警消息最多包含的错误数，单条错误最多显示的字符数
+const (
+	alertMaxGroups  = 20
+	alertMaxMessage = 300
+)
+
+type alertEvent struct {
+	Component string
+	Message   string
+	Time      time.Time
+}
+
+// alertGroup 同一组件的同一条错误，在去重窗口内累计次数
+type alertGroup struct {
+	Component string
+	Message   string
+	First     time.Time
+	Last      time.Time
+	Count     int
+	// 已经通知过的次数
+	Reported int
+}
+
+// AlertHook 将 Error 及以上级别的日志转发给管理员。每个 Interval 内的告警合并为一条消息，
+// 相同的错误在 Window 内只通知一次，窗口结束时再汇总期间的重复次数
+type AlertHook struct {
+	window   time.Duration
+	interval time.Duration
+	send     func(message string) error
+
+	events chan alertEvent
+	stop   chan struct{}
+	done   chan struct{}
+
+	// 只在 run 中访问
+	groups map[string]*alertGroup
+}
+
+func NewAlertHook(config AlertConfig, send func(message string) error) *AlertHook {
+	return &AlertHook{
+		window:   config.Window,
+		interval: config.Interval,
+		send:     send,
+		events:   make(chan alertEvent, 256),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		groups:   map[string]*alertGroup{},
+	}
+}
+
+// 接收告警的会话，重新加载配置时更新，为 0 时只记录日志
+var alertChat atomic.Int64
+
+// InitAlert 将内部错误转发到 alert.chat，未配置时使用 telegram.owner，都为空时只记录日志
+func InitAlert(lifecycle *Lifecycle, config AlertConfig, owner int64) {
+	alertChat.Store(alertChatOf(config, owner))
+	hook := NewAlertHook(config, func(message string) error {
+		chat := alertChat.Load()
+		if chat == 0 {
+			return nil
+		}
+		_, err := bot.Send(&tele.Chat{ID: chat}, message)
+		return err
+	})
+	log.AddHook(hook)
+	go hook.run()
+	// 在其他组件停止之后再停止，退出过程中的错误也能发出
+	lifecycle.OnStop("告警通知", hook.Close)
+	logAlertChat(alertChat.Load())
+	log.Infof("内部错误告警去重窗口 %s，汇总间隔 %s", config.Window, config.Interval)
+}
+
+// SetAlertChat 重新加载配置时更新接收告警的会话，alert.chat 和 telegram.owner 的修改都会生效
+func SetAlertChat(config AlertConfig, owner int64) {
+	chat := alertChatOf(config, owner)
+	if previous := alertChat.Swap(chat); previous != chat {
+		logAlertChat(chat)
+	}
+}
+
+func alertChatOf(config AlertConfig, owner int64) int64 {
+	if config.Chat != 0 {
+		return config.Chat
+	}
+	return owner
+}
+
+func logAlertChat(chat int64) {
+	if chat == 0 {
+		log.Info("未配置告警会话，内部错误只记录日志")
+	} else {
+		log.Infof("内部错误将发送到 %d", chat)
+	}
+}
+
+func (h *AlertHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+}
+
+// Fire 只将事件放入队列，不阻塞写日志的协程，队列满时丢弃
+func (h *AlertHook) Fire(entry *log.Entry) error {
+	component, _ := entry.Data["component"].(string)
+	if component == alertComponent {
+		return nil
+	}
+	if len(component) == 0 {
+		component = defaultComponent
+	}
+	select {
+	case h.events <- alertEvent{Component: component, Message: entry.Message, Time: entry.Time}:
+	default:
+	}
+	return nil
+}
+
+// Close 发出剩余的告警后停止
+func (h *AlertHook) Close(ctx context.Context) error {
+	close(h.stop)
+	return waitDone(ctx, h.done)
+}
+
+func (h *AlertHook) run() {
+	defer close(h.done)
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-h.events:
+			h.add(event)
+		case <-ticker.C:
+			h.notify(h.collect(time.Now(), false))
+		case <-h.stop:
+			for len(h.events) > 0 {
+				h.add(<-h.events)
+			}
+			h.notify(h.collect(time.Now(), true))
+			return
+		}
+	}
+}
+
+func (h *AlertHook) add(event alertEvent) {
+	key := event.Component + "\x00" + event.Message
+	group, ok := h.groups[key]
+	if !ok {
+		group = &alertGroup{Component: event.Component, Message: event.Message, First: event.Time}
+		h.groups[key] = group
+	}
+	group.Last = event.Time
+	group.Count++
+}
+
+// collect 返回需要通知的错误：新出现的错误，以及窗口结束时还有未通知次数的错误。final 为 true 时结束所有窗口
+func (h *AlertHook) collect(now time.Time, final bool) []alertGroup {
+	groups := make([]alertGroup, 0)
+	for key, group := range h.groups {
+		expired := final || now.Sub(group.First) >= h.window
+		if group.Reported == 0 || (expired && group.Count > group.Reported) {
+			groups = append(groups, *group)
+			group.Reported = group.Count
+		}
+		if expired {
+			delete(h.groups, key)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].First.Before(groups[j].First) })
+	return groups
+}
+
+func (h *AlertHook) notify(groups []alertGroup) {
+	if len(groups) == 0 {
+		return
+	}
+	if err := h.send(buildAlertMessage(groups)); err != nil {
+		log.WithField("component", alertComponent).Error("发送告警失败: ", err)
+	}
+}
+
+func buildAlertMessage(groups []alertGroup) string {
+	msgSlice := []string{"*内部错误告警*"}
+	for i, group := range groups {
+		if i == alertMaxGroups {
+			msgSlice = append(msgSlice, ReplaceForMarkdownV2(fmt.Sprintf("另有 %d 条错误未显示，请查看日志", len(groups)-i)))
+			break
+		}
+
+		line := fmt.Sprintf("❗ `%s` %s", group.Component, ReplaceForMarkdownV2(truncateRunes(group.Message, alertMaxMessage)))
+		if group.Count == 1 {
+			line += "\n    时间：" + ReplaceForMarkdownV2(group.First.Format(DateTimeFormat))
+		} else {
+			line += "\n    " + ReplaceForMarkdownV2(fmt.Sprintf("%d 次，首次：%s，最后：%s", group.Count,
+				group.First.Format(DateTimeFormat), group.Last.Format(DateTimeFormat)))
+		}
+		msgSlice = append(msgSlice, line)
+	}
+	return strings.Join(msgSlice, "\n")
+}
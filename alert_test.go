@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlertHookCollect(t *testing.T) {
+	hook := NewAlertHook(AlertConfig{Window: 10 * time.Minute, Interval: 30 * time.Second}, nil)
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.Local)
+
+	// 同一时间段内的多条错误合并为一次通知，相同的错误只出现一次
+	hook.add(alertEvent{Component: "xray_stats", Message: "获取 Xray 流量异常", Time: start})
+	hook.add(alertEvent{Component: "xray_stats", Message: "获取 Xray 流量异常", Time: start.Add(time.Second)})
+	hook.add(alertEvent{Component: "cf_d1", Message: "CF D1 请求失败", Time: start.Add(2 * time.Second)})
+	groups := hook.collect(start.Add(30*time.Second), false)
+	if len(groups) != 2 || groups[0].Component != "xray_stats" || groups[0].Count != 2 || groups[1].Component != "cf_d1" {
+		t.Fatalf("首次通知 = %+v", groups)
+	}
+
+	// 窗口内重复出现的错误不再通知
+	hook.add(alertEvent{Component: "xray_stats", Message: "获取 Xray 流量异常", Time: start.Add(5 * time.Minute)})
+	if groups := hook.collect(start.Add(5*time.Minute+30*time.Second), false); len(groups) != 0 {
+		t.Fatalf("窗口内重复通知 = %+v", groups)
+	}
+
+	// 窗口结束时汇总重复次数，没有新增的错误直接丢弃
+	groups = hook.collect(start.Add(10*time.Minute+2*time.Second), false)
+	if len(groups) != 1 || groups[0].Count != 3 || !groups[0].Last.Equal(start.Add(5*time.Minute)) {
+		t.Fatalf("窗口结束汇总 = %+v", groups)
+	}
+	if len(hook.groups) != 0 {
+		t.Errorf("窗口结束后仍有 %d 条记录", len(hook.groups))
+	}
+
+	// 窗口结束后再次出现视为新的错误
+	hook.add(alertEvent{Component: "xray_stats", Message: "获取 Xray 流量异常", Time: start.Add(11 * time.Minute)})
+	if groups := hook.collect(start.Add(11*time.Minute+30*time.Second), false); len(groups) != 1 || groups[0].Count != 1 {
+		t.Fatalf("窗口结束后的新错误 = %+v", groups)
+	}
+}
+
+func TestBuildAlertMessage(t *testing.T) {
+	first := time.Date(2024, 5, 1, 10, 0, 0, 0, time.Local)
+	message := buildAlertMessage([]alertGroup{
+		{Component: "cf_d1", Message: "CF D1 请求失败: timeout", First: first, Last: first, Count: 1},
+		{Component: "xray_stats", Message: "获取 Xray 流量异常", First: first, Last: first.Add(5 * time.Minute), Count: 3},
+	})
+	for _, expected := range []string{"`cf_d1`", "时间：2024\\-05\\-01 10:00:00", "3 次，首次：2024\\-05\\-01 10:00:00，最后：2024\\-05\\-01 10:05:00"} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("告警消息缺少 %q:\n%s", expected, message)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	tele "gopkg.in/telebot.v3"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AnomalyDetector 以近 N 天同一时段的中位数和 MAD 作为基线，识别异常的小时流量。
+// 基线都是完整的小时，只检测已经结束的小时，避免用不完整的流量与之比较
+type AnomalyDetector struct {
+	Days     int
+	Factor   float64
+	MinBytes int64
+
+	mu        sync.Mutex
+	lastAlert map[string]time.Time
+	// 最近检测过的小时，每个小时只检测一次
+	lastChecked string
+}
+
+type TrafficAnomaly struct {
+	User     string
+	Date     string
+	Time     string
+	Total    int64
+	Median   int64
+	MAD      int64
+	Baseline int64
+}
+
+var anomalyDetector atomic.Pointer[AnomalyDetector]
+
+// InitAnomalyDetector 创建新的检测器，重新加载配置时保留已有的告警时间，避免重复告警
+func InitAnomalyDetector(config XrayAnomalyConfig) {
+	lastAlert := map[string]time.Time{}
+	lastChecked := ""
+	if previous := anomalyDetector.Load(); previous != nil {
+		previous.mu.Lock()
+		maps.Copy(lastAlert, previous.lastAlert)
+		lastChecked = previous.lastChecked
+		previous.mu.Unlock()
+	}
+
+	anomalyDetector.Store(&AnomalyDetector{
+		Days:        config.Days,
+		Factor:      config.Factor,
+		MinBytes:    config.MinMB << 20,
+		lastAlert:   lastAlert,
+		lastChecked: lastChecked,
+	})
+}
+
+// Threshold 计算告警阈值：中位数 + Factor × MAD（换算为标准差），MAD 为 0 时退化为中位数 × Factor
+func (d *AnomalyDetector) Threshold(samples []int64) (median int64, mad int64, threshold int64) {
+	median = medianOf(samples)
+	deviations := make([]int64, 0, len(samples))
+	for _, sample := range samples {
+		deviation := sample - median
+		if deviation < 0 {
+			deviation = -deviation
+		}
+		deviations = append(deviations, deviation)
+	}
+	mad = medianOf(deviations)
+
+	if mad == 0 {
+		threshold = int64(float64(median) * d.Factor)
+	} else {
+		threshold = median + int64(d.Factor*1.4826*float64(mad))
+	}
+	if threshold < d.MinBytes {
+		threshold = d.MinBytes
+	}
+	return median, mad, threshold
+}
+
+// Detect 检查 date time 时段各用户的流量是否超出基线
+func (d *AnomalyDetector) Detect(date string, hour string) ([]*TrafficAnomaly, error) {
+	current, err := store.XrayStats.SelectByDate(date)
+	if err != nil {
+		return nil, err
+	}
+
+	day, err := time.ParseInLocation(DateFormat, date, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	from := day.AddDate(0, 0, -d.Days).Format(DateFormat)
+	to := day.AddDate(0, 0, -1).Format(DateFormat)
+	history, err := store.XrayStats.SelectByTimeAndDateRange(hour, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// 用户 -> 日期 -> 流量，没有记录的日期视为 0
+	historyMap := map[string]map[string]int64{}
+	for _, stats := range *history {
+		if _, ok := historyMap[stats.User]; !ok {
+			historyMap[stats.User] = map[string]int64{}
+		}
+		historyMap[stats.User][stats.Date] += stats.Down + stats.Up
+	}
+
+	anomalies := make([]*TrafficAnomaly, 0)
+	for _, stats := range *current {
+		if stats.Time != hour {
+			continue
+		}
+		total := stats.Down + stats.Up
+
+		samples := make([]int64, 0, d.Days)
+		for i := 1; i <= d.Days; i++ {
+			samples = append(samples, historyMap[stats.User][day.AddDate(0, 0, -i).Format(DateFormat)])
+		}
+		median, mad, threshold := d.Threshold(samples)
+		if total <= threshold {
+			continue
+		}
+		anomalies = append(anomalies, &TrafficAnomaly{
+			User:     stats.User,
+			Date:     date,
+			Time:     hour,
+			Total:    total,
+			Median:   median,
+			MAD:      mad,
+			Baseline: threshold,
+		})
+	}
+	return anomalies, nil
+}
+
+// markChecked 记录 date hour 已经检测过，已检测过时返回 false
+func (d *AnomalyDetector) markChecked(date string, hour string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.lastChecked == date+" "+hour {
+		return false
+	}
+	d.lastChecked = date + " " + hour
+	return true
+}
+
+// allow 同一用户每小时最多告警一次
+func (d *AnomalyDetector) allow(user string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if last, ok := d.lastAlert[user]; ok && now.Sub(last) < time.Hour {
+		return false
+	}
+	d.lastAlert[user] = now
+	return true
+}
+
+// CheckXrayTrafficAnomaly 在每次流量收集后调用，传入已经结束的小时，异常时通知所有管理员
+func CheckXrayTrafficAnomaly(date string, hour string) {
+	detector := anomalyDetector.Load()
+	if detector == nil {
+		return
+	}
+
+	anomalies, err := detector.Detect(date, hour)
+	if err != nil {
+		log.WithField("component", "anomaly").Error("流量异常检测失败", err)
+		return
+	}
+	// 检测失败时下次收集后重试，成功后同一小时不再告警
+	if !detector.markChecked(date, hour) {
+		return
+	}
+
+	now := time.Now()
+	for _, anomaly := range anomalies {
+		if !detector.allow(anomaly.User, now) {
+			continue
+		}
+		log.Warnf("用户 %s 在 %s %s 流量异常: %d", anomaly.User, anomaly.Date, anomaly.Time, anomaly.Total)
+
+		message := buildTrafficAnomalyMessage(anomaly, detector.Days)
+		for _, admin := range XrayStatsAdmins() {
+			if _, err := bot.Send(&tele.User{ID: admin}, message); err != nil {
+				log.WithField("component", "anomaly").Error("发送流量异常告警失败", err)
+			}
+		}
+	}
+}
+
+func buildTrafficAnomalyMessage(anomaly *TrafficAnomaly, days int) string {
+	msgSlice := []string{
+		"*流量异常告警*",
+		fmt.Sprintf("*用户*：%s", ReplaceForMarkdownV2(anomaly.User)),
+		fmt.Sprintf("*时段*：%s", ReplaceForMarkdownV2(anomaly.Date+" "+anomaly.Time)),
+		fmt.Sprintf("*流量*：%s", ReplaceForMarkdownV2(calculateTraffic(anomaly.Total))),
+		fmt.Sprintf("*基线*：%s", ReplaceForMarkdownV2(fmt.Sprintf("%s（近 %d 天同时段中位数，MAD %s）", calculateTraffic(anomaly.Median), days, calculateTraffic(anomaly.MAD)))),
+		fmt.Sprintf("*告警阈值*：%s", ReplaceForMarkdownV2(calculateTraffic(anomaly.Baseline))),
+	}
+	return strings.Join(msgSlice, "\n")
+}
+
+func medianOf(values []int64) int64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := make([]int64, len(values))
+	copy(sorted, values)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
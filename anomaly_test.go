@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnomalyDetectorThreshold(t *testing.T) {
+	d := &AnomalyDetector{Days: 7, Factor: 5, MinBytes: 0}
+
+	median, mad, threshold := d.Threshold([]int64{100, 120, 80, 100, 90, 110, 1000})
+	if median != 100 || mad != 10 {
+		t.Fatalf("median = %d, mad = %d", median, mad)
+	}
+	if threshold != 174 {
+		t.Fatalf("threshold = %d", threshold)
+	}
+
+	// MAD 为 0 时按中位数倍数计算
+	_, _, threshold = d.Threshold([]int64{0, 0, 0, 100})
+	if threshold != 0 {
+		t.Fatalf("threshold = %d", threshold)
+	}
+
+	d.MinBytes = 1 << 30
+	_, _, threshold = d.Threshold([]int64{100, 100, 100})
+	if threshold != 1<<30 {
+		t.Fatalf("threshold = %d", threshold)
+	}
+}
+
+func TestAnomalyDetectorDetect(t *testing.T) {
+	initTestStore(t)
+	d := &AnomalyDetector{Days: 3, Factor: 5, MinBytes: 1000, lastAlert: map[string]time.Time{}}
+	insert := func(user string, date string, hour string, total int64) {
+		_ = store.XrayStats.Insert(&XrayUserStats{User: user, Date: date, Time: hour, Down: total, Up: 0})
+	}
+	for _, date := range []string{"2024-04-28", "2024-04-29", "2024-04-30"} {
+		insert("clamped", date, "10:00", 100)
+		insert("steady", date, "10:00", 1000)
+		insert("normal", date, "10:00", 1000)
+		// 其他时段和基线之前的日期不计入
+		insert("steady", date, "11:00", 100000)
+	}
+	insert("steady", "2024-04-27", "10:00", 100000)
+	// MAD 为 0，5 × 100 = 500 低于 MinBytes，按 1000 计算
+	insert("clamped", "2024-05-01", "10:00", 900)
+	// MAD 为 0，阈值为 5 × 1000
+	insert("steady", "2024-05-01", "10:00", 5001)
+	insert("normal", "2024-05-01", "10:00", 5000)
+	// 没有历史记录时基线为 0，只要超过 MinBytes 就告警
+	insert("new", "2024-05-01", "10:00", 1001)
+	insert("new", "2024-05-01", "11:00", 100000)
+
+	anomalies, err := d.Detect("2024-05-01", "10:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]*TrafficAnomaly{}
+	for _, anomaly := range anomalies {
+		found[anomaly.User] = anomaly
+	}
+	if len(found) != 2 || found["steady"] == nil || found["new"] == nil {
+		t.Fatalf("异常用户 = %v", found)
+	}
+	if steady := found["steady"]; steady.Total != 5001 || steady.Median != 1000 || steady.MAD != 0 || steady.Baseline != 5000 {
+		t.Errorf("steady = %+v", steady)
+	}
+	if baseline := found["new"].Baseline; baseline != 1000 {
+		t.Errorf("没有历史记录时的阈值 = %d", baseline)
+	}
+}
+
+func TestAnomalyDetectorSuppression(t *testing.T) {
+	d := &AnomalyDetector{lastAlert: map[string]time.Time{}}
+	now := time.Date(2024, 5, 1, 10, 5, 0, 0, time.Local)
+	if !d.allow("alice", now) || d.allow("alice", now.Add(59*time.Minute)) {
+		t.Fatal("同一用户一小时内只告警一次")
+	}
+	if !d.allow("bob", now.Add(time.Minute)) {
+		t.Fatal("其他用户不受影响")
+	}
+	if !d.allow("alice", now.Add(time.Hour)) {
+		t.Fatal("一小时后可以再次告警")
+	}
+
+	// 每个已经结束的小时只检测一次
+	if !d.markChecked("2024-05-01", "09:00") || d.markChecked("2024-05-01", "09:00") || !d.markChecked("2024-05-01", "10:00") {
+		t.Fatal("同一小时应当只检测一次")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	tele "gopkg.in/telebot.v3"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AuditOutcomeOk        = "ok"
+	AuditOutcomeError     = "error"
+	AuditOutcomeUnknown   = "unknown"
+	AuditOutcomeThrottled = "throttled"
+)
+
+const (
+	// 记录的参数最多保留的字符数
+	auditMaxArgs = 256
+	// /audit 单次最多显示的记录数和默认查询的时间范围
+	auditQueryLimit = 30
+	auditQuerySince = 7 * 24 * time.Hour
+)
+
+const redacted = "[REDACTED]"
+
+// 参数中包含密钥的命令，记录前替换对应的参数
+var auditRedactors = map[Command]func(args []string){
+	BwgBind: func(args []string) {
+		// 旧用法 `/bwg_bind VEID API_KEY [别名]`
+		if len(args) >= 2 {
+			args[0], args[1] = redacted, redacted
+		}
+	},
+}
+
+// 看起来像密钥的长字符串，未知命令或输错的命令中也不记录
+var auditSecretRegex = regexp.MustCompile(`^(private_\S+|[A-Za-z0-9_\-]{24,})$`)
+
+// 处理函数回复失败信息后仍返回 nil，失败原因通过上下文传给 auditCommand
+const auditFailureKey = "audit_failure"
+
+// replyFailure 回复失败信息，并将本次命令记录为失败
+func replyFailure(c tele.Context, what string, opts ...interface{}) error {
+	markAuditFailure(c, what)
+	return c.Send(what, opts...)
+}
+
+// respondFailure 以按钮提示回复失败信息，并将本次回调记录为失败
+func respondFailure(c tele.Context, text string) error {
+	markAuditFailure(c, text)
+	return c.Respond(&tele.CallbackResponse{Text: text})
+}
+
+// markAuditFailure 将本次命令记录为失败，reason 去掉 MarkdownV2 转义后作为错误信息
+func markAuditFailure(c tele.Context, reason string) {
+	c.Set(auditFailureKey, strings.ReplaceAll(reason, "\\", ""))
+}
+
+// auditCommand 记录命令的调用者、参数、结果和耗时
+func auditCommand(command Command, handler tele.HandlerFunc) tele.HandlerFunc {
+	return func(c tele.Context) error {
+		start := time.Now()
+		err := handler(c)
+
+		outcome := AuditOutcomeOk
+		recorded := err
+		if errors.Is(err, errRateLimited) {
+			// 已经回复过用户，不再作为错误处理
+			outcome = AuditOutcomeThrottled
+			err, recorded = nil, nil
+		} else if err != nil {
+			outcome = AuditOutcomeError
+		} else if reason, ok := c.Get(auditFailureKey).(string); ok {
+			outcome = AuditOutcomeError
+			recorded = errors.New(reason)
+		}
+		args := ""
+		if c.Callback() == nil {
+			args = redactAuditArgs(command, c.Args())
+		}
+		recordCommandAudit(c, command, args, outcome, recorded, time.Since(start))
+		return err
+	}
+}
+
+func recordCommandAudit(c tele.Context, command Command, args string, outcome string, err error, latency time.Duration) {
+	commandAudit := &CommandAudit{
+		Command:    command,
+		Args:       args,
+		Outcome:    outcome,
+		LatencyMs:  latency.Milliseconds(),
+		CreateTime: time.Now(),
+	}
+	if sender := c.Sender(); sender != nil {
+		commandAudit.UserId = sender.ID
+		commandAudit.Username = sender.Username
+	}
+	if chat := c.Chat(); chat != nil {
+		commandAudit.ChatId = chat.ID
+	}
+	if err != nil {
+		commandAudit.Error = err.Error()
+	}
+	_ = store.Audits.InsertCommand(commandAudit)
+}
+
+// redactAuditArgs 隐藏参数中的密钥，并限制记录的长度
+func redactAuditArgs(command Command, args []string) string {
+	args = append([]string(nil), args...)
+	if redactor, ok := auditRedactors[command]; ok {
+		redactor(args)
+	}
+	for i, arg := range args {
+		if auditSecretRegex.MatchString(arg) {
+			args[i] = redacted
+		}
+	}
+	return truncateRunes(strings.Join(args, " "), auditMaxArgs)
+}
+
+// parseAuditArgs 解析 /audit 的参数，数字为用户 ID，其余为起始时间，支持 24h、7d 和 2006-01-02
+func parseAuditArgs(args []string, now time.Time) (int64, time.Time, error) {
+	userId := int64(0)
+	since := now.Add(-auditQuerySince)
+	for _, arg := range args {
+		if id, err := strconv.ParseInt(arg, 10, 64); err == nil && id > 0 {
+			userId = id
+			continue
+		}
+		if days, ok := strings.CutSuffix(arg, "d"); ok {
+			if n, err := strconv.Atoi(days); err == nil && n > 0 {
+				since = now.AddDate(0, 0, -n)
+				continue
+			}
+		}
+		if duration, err := time.ParseDuration(arg); err == nil && duration > 0 {
+			since = now.Add(-duration)
+			continue
+		}
+		if date, err := time.ParseInLocation(DateFormat, arg, time.Local); err == nil {
+			since = date
+			continue
+		}
+		return 0, time.Time{}, fmt.Errorf("无法识别的参数：%s", arg)
+	}
+	return userId, since, nil
+}
+
+func AuditHandler(c tele.Context) error {
+	if !IsOwner(c.Sender().ID) {
+		return replyFailure(c, "无操作权限")
+	}
+
+	userId, since, err := parseAuditArgs(c.Args(), time.Now())
+	if err != nil {
+		return replyFailure(c, ReplaceForMarkdownV2(err.Error()+"\n用法：/audit [用户 ID] [起始时间，如 24h、7d 或 2024-05-01]"))
+	}
+	commandAudits, err := store.Audits.SelectCommands(userId, since, auditQueryLimit)
+	if err != nil {
+		log.Error("查询命令记录失败: ", err)
+		return replyFailure(c, "查询命令记录失败")
+	}
+	return c.Send(buildAuditMessage(*commandAudits, userId, since))
+}
+
+func buildAuditMessage(commandAudits []CommandAudit, userId int64, since time.Time) string {
+	scope := "全部用户"
+	if userId != 0 {
+		scope = fmt.Sprintf("用户 %d", userId)
+	}
+	msgSlice := []string{fmt.Sprintf("*命令记录*：%s", ReplaceForMarkdownV2(fmt.Sprintf("%s，%s 之后", scope, since.Format(DateTimeFormat))))}
+	if len(commandAudits) == 0 {
+		return strings.Join(append(msgSlice, "暂无记录"), "\n")
+	}
+	if len(commandAudits) == auditQueryLimit {
+		msgSlice = append(msgSlice, ReplaceForMarkdownV2(fmt.Sprintf("仅显示最近 %d 条", auditQueryLimit)))
+	}
+
+	for _, commandAudit := range commandAudits {
+		icon := "✅"
+		switch commandAudit.Outcome {
+		case AuditOutcomeError:
+			icon = "❌"
+		case AuditOutcomeUnknown:
+			icon = "❔"
+		case AuditOutcomeThrottled:
+			icon = "⏳"
+		}
+		user := strconv.FormatInt(commandAudit.UserId, 10)
+		if len(commandAudit.Username) > 0 {
+			user += " @" + commandAudit.Username
+		}
+		line := fmt.Sprintf("%s `%s` %s %s", icon, commandAudit.CreateTime.Format(DateTimeFormat), ReplaceForMarkdownV2(user), ReplaceForMarkdownV2(commandAudit.Command))
+		if len(commandAudit.Args) > 0 {
+			line += " " + ReplaceForMarkdownV2(truncateRunes(commandAudit.Args, 40))
+		}
+		line += " " + ReplaceForMarkdownV2(fmt.Sprintf("%dms", commandAudit.LatencyMs))
+		if len(commandAudit.Error) > 0 {
+			line += "\n    " + ReplaceForMarkdownV2(truncateRunes(commandAudit.Error, 80))
+		}
+		msgSlice = append(msgSlice, line)
+	}
+	return strings.Join(msgSlice, "\n")
+}
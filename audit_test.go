@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	tele "gopkg.in/telebot.v3"
+	"testing"
+	"time"
+)
+
+func TestRedactAuditArgs(t *testing.T) {
+	cases := []struct {
+		command  Command
+		args     []string
+		expected string
+	}{
+		{BwgBind, []string{"main"}, "main"},
+		{BwgBind, []string{"123456", "private_abcdef", "main"}, "[REDACTED] [REDACTED] main"},
+		{"/bwg_bnd", []string{"123456", "private_abcdef"}, "123456 [REDACTED]"},
+		{QueryXrayStats, []string{"2024-05-01"}, "2024-05-01"},
+		{"/unknown", []string{"abcdefghijklmnopqrstuvwxyz012345"}, "[REDACTED]"},
+	}
+	for _, c := range cases {
+		if actual := redactAuditArgs(c.command, c.args); actual != c.expected {
+			t.Errorf("redactAuditArgs(%s, %v) = %q，期望 %q", c.command, c.args, actual, c.expected)
+		}
+	}
+}
+
+func TestParseAuditArgs(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.Local)
+	cases := []struct {
+		args   []string
+		userId int64
+		since  time.Time
+	}{
+		{nil, 0, now.Add(-auditQuerySince)},
+		{[]string{"123456"}, 123456, now.Add(-auditQuerySince)},
+		{[]string{"123456", "24h"}, 123456, now.Add(-24 * time.Hour)},
+		{[]string{"3d"}, 0, now.AddDate(0, 0, -3)},
+		{[]string{"2024-05-01", "42"}, 42, time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)},
+	}
+	for _, c := range cases {
+		userId, since, err := parseAuditArgs(c.args, now)
+		if err != nil || userId != c.userId || !since.Equal(c.since) {
+			t.Errorf("parseAuditArgs(%v) = %d, %s, %v", c.args, userId, since, err)
+		}
+	}
+	if _, _, err := parseAuditArgs([]string{"yesterday"}, now); err == nil {
+		t.Error("无法识别的参数应当返回错误")
+	}
+}
+
+func TestSelectCommandAudits(t *testing.T) {
+	initTestStore(t)
+
+	now := time.Now()
+	for _, commandAudit := range []CommandAudit{
+		{UserId: 1, Command: BwgRestart, Outcome: AuditOutcomeOk, CreateTime: now.Add(-48 * time.Hour)},
+		{UserId: 1, Command: QueryXrayStats, Outcome: AuditOutcomeOk, CreateTime: now.Add(-time.Hour)},
+		{UserId: 2, Command: BwgStatus, Outcome: AuditOutcomeError, Error: "timeout", CreateTime: now},
+	} {
+		if err := store.Audits.InsertCommand(&commandAudit); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	commandAudits, err := store.Audits.SelectCommands(0, now.Add(-24*time.Hour), auditQueryLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*commandAudits) != 2 || (*commandAudits)[0].Command != BwgStatus || (*commandAudits)[1].Command != QueryXrayStats {
+		t.Errorf("全部用户的记录 = %+v", *commandAudits)
+	}
+
+	commandAudits, err = store.Audits.SelectCommands(1, now.Add(-72*time.Hour), auditQueryLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*commandAudits) != 2 || (*commandAudits)[1].Command != BwgRestart {
+		t.Errorf("用户 1 的记录 = %+v", *commandAudits)
+	}
+}
+
+func TestAuditCommandOutcome(t *testing.T) {
+	initTestStore(t)
+
+	handlers := map[string]tele.HandlerFunc{
+		"/audit_ok": func(c tele.Context) error {
+			return c.Send("完成")
+		},
+		"/audit_failure": func(c tele.Context) error {
+			return replyFailure(c, "获取服务器信息失败\n请使用 /bwg\\_bind 命令更新信息")
+		},
+		"/audit_error": func(c tele.Context) error {
+			return errors.New("timeout")
+		},
+		// 处理函数回复了失败信息但仍返回 nil
+		BwgUnbind: BwgUnbindHandler,
+	}
+	for command, handler := range handlers {
+		_ = auditCommand(command, handler)(newFakeContext(1, 1, command))
+	}
+
+	commandAudits, err := store.Audits.SelectCommands(1, time.Now().Add(-time.Hour), auditQueryLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outcomes := map[string]CommandAudit{}
+	for _, commandAudit := range *commandAudits {
+		outcomes[commandAudit.Command] = commandAudit
+	}
+	expected := map[string][2]string{
+		"/audit_ok":      {AuditOutcomeOk, ""},
+		"/audit_failure": {AuditOutcomeError, "获取服务器信息失败\n请使用 /bwg_bind 命令更新信息"},
+		"/audit_error":   {AuditOutcomeError, "timeout"},
+		BwgUnbind:        {AuditOutcomeError, "请在命令后指定要解绑的服务器别名\n如：`/bwg_unbind 别名`"},
+	}
+	for command, outcome := range expected {
+		if actual := outcomes[command]; actual.Outcome != outcome[0] || actual.Error != outcome[1] {
+			t.Errorf("%s 的记录为 %s %q，期望 %s %q", command, actual.Outcome, actual.Error, outcome[0], outcome[1])
+		}
+	}
+}
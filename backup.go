@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/morooi/morooi-telegram-bot-go/secret"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	tele "gopkg.in/telebot.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 备份文件名为 telegram-20060102-150405.db，加密后追加 .enc
+const (
+	backupPrefix       = "telegram-"
+	backupTimeFormat   = "20060102-150405"
+	backupExt          = ".db"
+	backupEncryptedExt = ".db.enc"
+	// 派生备份文件密钥的用途
+	backupKeyInfo = "database-backup"
+)
+
+// 恢复前检查备份中必须存在的表
+var backupRequiredTables = []string{"bwg_api_key", "xray_user_stats", "xray_log", "audit_event"}
+
+// 定时备份和 /backup_now 不同时执行
+var backupMu sync.Mutex
+
+type backupFile struct {
+	Path string
+	Time time.Time
+}
+
+func AddBackupJob(scheduler *cron.Cron, config BackupConfig) error {
+	// PostgreSQL 由数据库自身的备份方案负责
+	if len(config.Cron) == 0 || store.Driver() != DatabaseDriverSqlite {
+		return nil
+	}
+	_, err := scheduler.AddFunc(config.Cron, func() {
+		if _, err := CreateBackup(config, time.Now()); err != nil {
+			log.WithField("component", "backup").Error("数据库备份失败: ", err)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("添加数据库备份定时任务失败: %w", err)
+	}
+	return nil
+}
+
+// CreateBackup 使用 VACUUM INTO 在线生成一致的快照，写入完成后再重命名为正式文件，之后清理过期的备份
+func CreateBackup(config BackupConfig, now time.Time) (string, error) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return "", err
+	}
+	name := backupPrefix + now.Format(backupTimeFormat) + backupExt
+	if config.Encrypt {
+		name = backupPrefix + now.Format(backupTimeFormat) + backupEncryptedExt
+	}
+	path := filepath.Join(config.Dir, name)
+
+	// VACUUM INTO 要求目标文件不存在
+	snapshot := path + ".tmp"
+	_ = os.Remove(snapshot)
+	defer os.Remove(snapshot)
+	if err := store.Backup(snapshot); err != nil {
+		return "", fmt.Errorf("生成数据库快照失败: %w", err)
+	}
+
+	if config.Encrypt {
+		encrypted := path + ".part"
+		defer os.Remove(encrypted)
+		if err := encryptBackup(snapshot, encrypted); err != nil {
+			return "", fmt.Errorf("加密备份失败: %w", err)
+		}
+		snapshot = encrypted
+	}
+	if err := os.Chmod(snapshot, 0o600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(snapshot, path); err != nil {
+		return "", err
+	}
+	log.Info("数据库已备份到 ", path)
+
+	if err := RotateBackups(config); err != nil {
+		log.WithField("component", "backup").Error("清理过期备份失败: ", err)
+	}
+	return path, nil
+}
+
+func encryptBackup(source string, target string) error {
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	output, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(output)
+	err = keyring.EncryptStream(writer, bufio.NewReader(input), backupKeyInfo)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// RotateBackups 删除不需要保留的备份
+func RotateBackups(config BackupConfig) error {
+	backups, err := listBackups(config.Dir)
+	if err != nil {
+		return err
+	}
+	errs := make([]error, 0)
+	for _, backup := range selectExpiredBackups(backups, config.KeepDaily, config.KeepWeekly) {
+		if err := os.Remove(backup.Path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Info("已删除过期备份 ", backup.Path)
+	}
+	return errors.Join(errs...)
+}
+
+// listBackups 返回目录中的备份文件，忽略文件名不符合格式的文件和未写完的临时文件
+func listBackups(dir string) ([]backupFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]backupFile, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if backupTime, ok := parseBackupName(entry.Name()); ok {
+			backups = append(backups, backupFile{Path: filepath.Join(dir, entry.Name()), Time: backupTime})
+		}
+	}
+	return backups, nil
+}
+
+func parseBackupName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, backupPrefix) {
+		return time.Time{}, false
+	}
+	name = strings.TrimPrefix(name, backupPrefix)
+	if len(name) <= len(backupTimeFormat) {
+		return time.Time{}, false
+	}
+	if ext := name[len(backupTimeFormat):]; ext != backupExt && ext != backupEncryptedExt {
+		return time.Time{}, false
+	}
+	backupTime, err := time.ParseInLocation(backupTimeFormat, name[:len(backupTimeFormat)], time.Local)
+	return backupTime, err == nil
+}
+
+// selectExpiredBackups 保留最近 keepDaily 天每天最后一份和最近 keepWeekly 周每周最后一份，其余的返回
+func selectExpiredBackups(backups []backupFile, keepDaily int, keepWeekly int) []backupFile {
+	sorted := slices.Clone(backups)
+	slices.SortFunc(sorted, func(a, b backupFile) int {
+		return b.Time.Compare(a.Time)
+	})
+
+	days := map[string]struct{}{}
+	weeks := map[[2]int]struct{}{}
+	expired := make([]backupFile, 0)
+	for _, backup := range sorted {
+		keep := false
+		day := backup.Time.Format(DateFormat)
+		if _, ok := days[day]; !ok {
+			days[day] = struct{}{}
+			keep = len(days) <= keepDaily
+		}
+		year, week := backup.Time.ISOWeek()
+		if _, ok := weeks[[2]int{year, week}]; !ok {
+			weeks[[2]int{year, week}] = struct{}{}
+			keep = keep || len(weeks) <= keepWeekly
+		}
+		if !keep {
+			expired = append(expired, backup)
+		}
+	}
+	return expired
+}
+
+func BackupNowHandler(c tele.Context) error {
+	if !IsOwner(c.Sender().ID) {
+		return replyFailure(c, "无操作权限")
+	}
+	_ = c.Notify(tele.UploadingDocument)
+
+	config := currentConfig.Load().Backup
+	now := time.Now()
+	path, err := CreateBackup(config, now)
+	if errors.Is(err, errBackupUnsupported) {
+		return replyFailure(c, ReplaceForMarkdownV2(errBackupUnsupported.Error()))
+	}
+	if err != nil {
+		log.WithField("component", "backup").Error("数据库备份失败: ", err)
+		return replyFailure(c, "备份失败")
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if stat.Size() > telegramMaxUploadSize {
+		return replyFailure(c, ReplaceForMarkdownV2(fmt.Sprintf("备份已保存到 %s，文件大小 %s，超过 Telegram 的 50MB 限制，无法发送", path, calculateTraffic(stat.Size()))))
+	}
+	caption := "数据库备份 " + now.Format(DateTimeFormat)
+	if config.Encrypt {
+		caption += "，已加密"
+	}
+	// 备份包含所有用户的数据，只发送到与所有者的私聊
+	_, err = c.Bot().Send(c.Sender(), &tele.Document{
+		File:     tele.FromDisk(path),
+		FileName: filepath.Base(path),
+		Caption:  ReplaceForMarkdownV2(caption),
+	})
+	if err != nil {
+		return err
+	}
+	if c.Chat().Type != tele.ChatPrivate {
+		return c.Send("备份已私聊发送")
+	}
+	return nil
+}
+
+// RestoreCommand 校验备份文件后替换当前数据库，执行前需要先停止机器人
+func RestoreCommand(path string) {
+	config, err := LoadConfig(ConfigFile())
+	if err != nil {
+		log.Fatal("配置校验失败:\n", err)
+	}
+	if err := RestoreBackup(config, path, time.Now()); err != nil {
+		log.Fatal("恢复备份失败: ", err)
+	}
+}
+
+// RestoreBackup 将备份解密并校验后重命名为数据库文件，原数据库保留为 <path>.before-restore-<时间>
+func RestoreBackup(config *Config, path string, now time.Time) error {
+	if config.Database.Driver != DatabaseDriverSqlite {
+		return errBackupUnsupported
+	}
+	target := config.Database.Path
+	staging := target + ".restore"
+	_ = os.Remove(staging)
+	defer os.Remove(staging)
+
+	if err := copyBackup(path, staging, config.Key); err != nil {
+		return err
+	}
+	if err := validateBackup(staging); err != nil {
+		return fmt.Errorf("备份文件校验失败: %w", err)
+	}
+
+	if _, err := os.Stat(target); err == nil {
+		previous := fmt.Sprintf("%s.before-restore-%s", target, now.Format(backupTimeFormat))
+		if err := copyFile(target, previous); err != nil {
+			return err
+		}
+		// 原数据库的 WAL 等文件一起移走，避免被应用到恢复后的数据库上
+		for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+			if err := os.Rename(target+suffix, previous+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		log.Info("原数据库已保存为 ", previous)
+	}
+	if err := os.Rename(staging, target); err != nil {
+		// 数据库文件单独挂载到容器中时无法重命名，改为覆盖写入
+		log.Warn("替换数据库文件失败，改为覆盖写入: ", err)
+		if err := copyFile(staging, target); err != nil {
+			return err
+		}
+	}
+	log.Infof("已从 %s 恢复数据库 %s", path, target)
+	return nil
+}
+
+// copyBackup 复制备份文件，加密的备份使用 key.passphrase 或 key.previous 解密
+func copyBackup(source string, target string, config KeyConfig) error {
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	output, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(input)
+	writer := bufio.NewWriter(output)
+	// 文件不足 64 字节时返回已读到的部分
+	header, _ := reader.Peek(64)
+	if secret.IsEncryptedStream(header) {
+		// 恢复时不打开数据库，使用备份文件头中的盐派生密钥
+		var salt []byte
+		var backupKeyring *secret.Keyring
+		salt, err = secret.StreamSalt(header)
+		if err == nil {
+			backupKeyring, err = secret.NewKeyring(salt, config.Passphrase, config.Previous...)
+		}
+		if err == nil {
+			err = backupKeyring.DecryptStream(writer, reader, backupKeyInfo)
+		}
+		if errors.Is(err, secret.ErrUnknownKey) {
+			err = fmt.Errorf("备份使用的密钥不在 key.passphrase 和 key.previous 中: %w", err)
+		}
+	} else {
+		_, err = io.Copy(writer, reader)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// validateBackup 检查备份的完整性和必需的表
+func validateBackup(path string) error {
+	backup, err := sqlx.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+
+	results := make([]string, 0)
+	if err := backup.Select(&results, "PRAGMA integrity_check"); err != nil {
+		return err
+	}
+	if len(results) != 1 || results[0] != "ok" {
+		return fmt.Errorf("完整性检查未通过: %s", strings.Join(results, "; "))
+	}
+	for _, table := range backupRequiredTables {
+		var count int
+		if err := backup.Get(&count, "SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table); err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("缺少数据表 %s", table)
+		}
+	}
+	return nil
+}
+
+func copyFile(source string, target string) error {
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	output, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(output, input)
+	if err == nil {
+		err = output.Sync()
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
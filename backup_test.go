@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/morooi/morooi-telegram-bot-go/secret"
+)
+
+func TestParseBackupName(t *testing.T) {
+	cases := map[string]bool{
+		"telegram-20240501-040000.db":      true,
+		"telegram-20240501-040000.db.enc":  true,
+		"telegram-20240501-040000.db.tmp":  false,
+		"telegram-20240501-040000.db.part": false,
+		"telegram-2024.db":                 false,
+		"other-20240501-040000.db":         false,
+	}
+	for name, expected := range cases {
+		if _, ok := parseBackupName(name); ok != expected {
+			t.Errorf("parseBackupName(%q) = %v，期望 %v", name, ok, expected)
+		}
+	}
+}
+
+func TestSelectExpiredBackups(t *testing.T) {
+	// 2024-05-01 至 2024-05-31 每天 04:00 和 16:00 各一份，5 月 31 日为周五
+	backups := make([]backupFile, 0)
+	for day := 1; day <= 31; day++ {
+		for _, hour := range []int{4, 16} {
+			backupTime := time.Date(2024, 5, day, hour, 0, 0, 0, time.Local)
+			backups = append(backups, backupFile{Path: backupTime.Format(backupTimeFormat), Time: backupTime})
+		}
+	}
+
+	expired := selectExpiredBackups(backups, 3, 2)
+	kept := make([]string, 0)
+	for _, backup := range backups {
+		if !slices.Contains(expired, backup) {
+			kept = append(kept, backup.Path)
+		}
+	}
+	// 最近 3 天每天最后一份，加上上一周（5 月 20 日至 26 日）的最后一份
+	expected := []string{"20240526-160000", "20240529-160000", "20240530-160000", "20240531-160000"}
+	if !slices.Equal(kept, expected) {
+		t.Errorf("保留的备份 = %v，期望 %v", kept, expected)
+	}
+}
+
+func TestCreateAndRestoreBackup(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{
+		Database: DatabaseConfig{Driver: DatabaseDriverSqlite, Path: filepath.Join(dir, "telegram.db")},
+		Key:      KeyConfig{Passphrase: "backup test passphrase"},
+		Backup:   BackupConfig{Dir: filepath.Join(dir, "backup"), KeepDaily: 1, Encrypt: true},
+	}
+	InitStore(config.Database)
+	t.Cleanup(func() { _ = store.Close() })
+	InitKeyring(config.Key)
+
+	countStats := func() int {
+		var count int
+		if err := store.db.Get(&count, "SELECT count(*) FROM xray_user_stats"); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+	_ = store.XrayStats.Insert(&XrayUserStats{User: "alice", Date: "2024-05-01", Time: "10:00", Down: 100, Up: 10})
+
+	now := time.Date(2024, 5, 1, 4, 0, 0, 0, time.Local)
+	path, err := CreateBackup(config.Backup, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := os.ReadFile(path)
+	if !secret.IsEncryptedStream(content) {
+		t.Fatal("开启 backup.encrypt 时备份文件应当加密")
+	}
+	// 同一天的新备份会替换旧备份
+	if _, err := CreateBackup(config.Backup, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("同一天较早的备份应当被删除")
+	}
+	if backups, _ := listBackups(config.Backup.Dir); len(backups) != 1 {
+		t.Fatalf("备份目录中应当只有 1 份备份: %v", backups)
+	}
+
+	_ = store.XrayStats.Insert(&XrayUserStats{User: "bob", Date: "2024-05-01", Time: "11:00", Down: 200, Up: 20})
+	_ = store.Close()
+
+	invalid := filepath.Join(dir, "invalid.db")
+	_ = os.WriteFile(invalid, []byte("not a database"), 0o600)
+	if err := RestoreBackup(config, invalid, now); err == nil {
+		t.Fatal("无效的备份文件应当校验失败")
+	}
+
+	path = filepath.Join(config.Backup.Dir, "telegram-"+now.Add(time.Hour).Format(backupTimeFormat)+backupEncryptedExt)
+	if err := RestoreBackup(config, path, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(config.Database.Path + ".before-restore-" + now.Format(backupTimeFormat)); err != nil {
+		t.Fatal("原数据库应当被保留: ", err)
+	}
+	InitStore(config.Database)
+	if count := countStats(); count != 1 {
+		t.Fatalf("恢复后应当只有备份时的 1 条记录，实际 %d 条", count)
+	}
+}
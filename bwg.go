@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var bwgApiBaseUrl = "https://api.64clouds.com/v1"
+
+// KiwiVM 共用的 HTTP 客户端，查询类接口是幂等的，可以重试
+var bwgHttpClient = newBwgHttpClient()
+
+func newBwgHttpClient() *HttpClient {
+	client := NewHttpClient("KiwiVM", 15*time.Second)
+	client.MaxRetries = 2
+	return client
+}
+
+// BwgClient 搬瓦工 KiwiVM API 客户端
+type BwgClient struct {
+	BaseUrl    string
+	HttpClient *HttpClient
+	Veid       string
+	ApiKey     string
+}
+
+// BwgApiError KiwiVM 返回的业务错误，error 字段非 0 时表示调用失败
+type BwgApiError struct {
+	Code    int
+	Message string
+}
+
+func (e *BwgApiError) Error() string {
+	return fmt.Sprintf("KiwiVM API 错误 %d: %s", e.Code, e.Message)
+}
+
+// bwgFlexInt 兼容 KiwiVM 部分字段以字符串形式返回数字的情况
+type bwgFlexInt int64
+
+func (i *bwgFlexInt) UnmarshalJSON(data []byte) error {
+	value := strings.Trim(string(data), `"`)
+	if len(value) == 0 || value == "null" {
+		*i = 0
+		return nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = bwgFlexInt(parsed)
+	return nil
+}
+
+type BwgServerInfo struct {
+	HostName        string   `json:"hostname"`
+	NodeDataCenter  string   `json:"node_datacenter"`
+	IpAddresses     []string `json:"ip_addresses"`
+	Plan            string   `json:"plan"`
+	Os              string   `json:"os"`
+	PlanRam         int64    `json:"plan_ram"`
+	PlanSwap        int64    `json:"plan_swap"`
+	PlanDisk        int64    `json:"plan_disk"`
+	PlanMonthlyData int64    `json:"plan_monthly_data"`
+	DataCounter     int64    `json:"data_counter"`
+	DataNextReset   int64    `json:"data_next_reset"`
+	Suspended       bool     `json:"suspended"`
+	Error           int      `json:"error"`
+}
+
+type BwgLiveServiceInfo struct {
+	BwgServerInfo
+	VeStatus         string     `json:"ve_status"`
+	VeUsedDiskSpaceB bwgFlexInt `json:"ve_used_disk_space_b"`
+	VeDiskQuotaGb    bwgFlexInt `json:"ve_disk_quota_gb"`
+	IsCpuThrottled   bwgFlexInt `json:"is_cpu_throttled"`
+	LoadAverage      string     `json:"load_average"`
+	MemAvailableKb   bwgFlexInt `json:"mem_available_kb"`
+	SwapTotalKb      bwgFlexInt `json:"swap_total_kb"`
+	SwapAvailableKb  bwgFlexInt `json:"swap_available_kb"`
+	SshPort          bwgFlexInt `json:"ssh_port"`
+	LiveHostName     string     `json:"live_hostname"`
+}
+
+type BwgUsageStat struct {
+	Timestamp       int64 `json:"timestamp"`
+	NetworkInBytes  int64 `json:"network_in_bytes"`
+	NetworkOutBytes int64 `json:"network_out_bytes"`
+	DiskReadBytes   int64 `json:"disk_read_bytes"`
+	DiskWriteBytes  int64 `json:"disk_write_bytes"`
+	CpuUsage        int64 `json:"cpu_usage"`
+}
+
+type BwgRawUsageStats struct {
+	Data   []BwgUsageStat `json:"data"`
+	VmType string         `json:"vm_type"`
+}
+
+type BwgRateLimitStatus struct {
+	RemainingPoints15Min int64 `json:"remaining_points_15min"`
+	RemainingPoints24H   int64 `json:"remaining_points_24h"`
+}
+
+type BwgAuditLogEntry struct {
+	Timestamp     int64  `json:"timestamp"`
+	RequestorIpv4 int64  `json:"requestor_ipv4"`
+	Type          int    `json:"type"`
+	Summary       string `json:"summary"`
+}
+
+// RequestorIp 将整数形式的 IPv4 地址转换为点分十进制
+func (e BwgAuditLogEntry) RequestorIp() string {
+	ip := uint32(e.RequestorIpv4)
+	return fmt.Sprintf("%d.%d.%d.%d", ip>>24, ip>>16&0xff, ip>>8&0xff, ip&0xff)
+}
+
+type BwgAuditLog struct {
+	LogEntries []BwgAuditLogEntry `json:"log_entries"`
+}
+
+type BwgAvailableOSes struct {
+	Installed string   `json:"installed"`
+	Templates []string `json:"templates"`
+}
+
+func NewBwgClient(veid string, apiKey string) *BwgClient {
+	return &BwgClient{
+		BaseUrl:    bwgApiBaseUrl,
+		HttpClient: bwgHttpClient,
+		Veid:       veid,
+		ApiKey:     apiKey,
+	}
+}
+
+// call 调用 KiwiVM API 并将结果解析到 result 中
+func (c *BwgClient) call(method string, params url.Values, result any) error {
+	if len(c.Veid) == 0 || len(c.ApiKey) == 0 {
+		return errors.New("veid 或 apiKey 不可为空")
+	}
+
+	form := url.Values{}
+	for key, values := range params {
+		form[key] = values
+	}
+	form.Set("veid", c.Veid)
+	form.Set("api_key", c.ApiKey)
+
+	// 通过 POST 表单传递 API KEY，避免出现在地址和访问日志中，返回内容中出现时同样隐藏
+	httpClient := *c.HttpClient
+	httpClient.Secrets = append(slices.Clone(c.HttpClient.Secrets), c.ApiKey)
+	body, err := httpClient.PostForm(fmt.Sprintf("%s/%s", strings.TrimSuffix(c.BaseUrl, "/"), method), form)
+	if err != nil {
+		return err
+	}
+
+	var apiError struct {
+		Error   int    `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &apiError); err != nil {
+		return err
+	}
+	if apiError.Error != 0 {
+		return &BwgApiError{Code: apiError.Error, Message: apiError.Message}
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(body, result)
+}
+
+func (c *BwgClient) GetServiceInfo() (*BwgServerInfo, error) {
+	var info BwgServerInfo
+	if err := c.call("getServiceInfo", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *BwgClient) GetLiveServiceInfo() (*BwgLiveServiceInfo, error) {
+	var info BwgLiveServiceInfo
+	if err := c.call("getLiveServiceInfo", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *BwgClient) GetRawUsageStats() (*BwgRawUsageStats, error) {
+	var stats BwgRawUsageStats
+	if err := c.call("getRawUsageStats", nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+func (c *BwgClient) GetRateLimitStatus() (*BwgRateLimitStatus, error) {
+	var status BwgRateLimitStatus
+	if err := c.call("getRateLimitStatus", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (c *BwgClient) GetAuditLog() (*BwgAuditLog, error) {
+	var auditLog BwgAuditLog
+	if err := c.call("getAuditLog", nil, &auditLog); err != nil {
+		return nil, err
+	}
+	return &auditLog, nil
+}
+
+// GetAvailableOSes 对应 KiwiVM 的 getAvailableOS 接口
+func (c *BwgClient) GetAvailableOSes() (*BwgAvailableOSes, error) {
+	var oses BwgAvailableOSes
+	if err := c.call("getAvailableOS", nil, &oses); err != nil {
+		return nil, err
+	}
+	return &oses, nil
+}
+
+func (c *BwgClient) Start() error {
+	return c.power("start")
+}
+
+func (c *BwgClient) Stop() error {
+	return c.power("stop")
+}
+
+func (c *BwgClient) Restart() error {
+	return c.power("restart")
+}
+
+// power 电源操作不是幂等的，失败后不自动重试
+func (c *BwgClient) power(method string) error {
+	httpClient := *c.HttpClient
+	httpClient.MaxRetries = 0
+	client := *c
+	client.HttpClient = &httpClient
+	return client.call(method, nil, nil)
+}
+
+type bwgInfoKey struct {
+	veid   string
+	apiKey string
+}
+
+// 按 VEID 和 API KEY 缓存服务器信息，API KEY 错误的请求不会读到其他用户的缓存
+var bwgInfoCache atomic.Pointer[TtlCache[bwgInfoKey, *BwgServerInfo]]
+
+func InitBwgInfoCache(ttl time.Duration) {
+	bwgInfoCache.Store(NewTtlCache[bwgInfoKey, *BwgServerInfo]("bwg_info", ttl))
+}
+
+// GetBwgServerInfo 返回缓存的服务器信息，结果被多个调用方共享，不可修改
+func GetBwgServerInfo(veid string, apiKey string) (*BwgServerInfo, error) {
+	return bwgInfoCache.Load().Get(bwgInfoKey{veid: veid, apiKey: apiKey}, func() (*BwgServerInfo, error) {
+		return NewBwgClient(veid, apiKey).GetServiceInfo()
+	})
+}
+
+// InvalidateBwgServerInfo 开关机等操作后清除缓存
+func InvalidateBwgServerInfo(veid string, apiKey string) {
+	bwgInfoCache.Load().Invalidate(bwgInfoKey{veid: veid, apiKey: apiKey})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	tele "gopkg.in/telebot.v3"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// BwgMonitor 定期检查所有已绑定服务器的流量，超过阈值、临近重置或重置后通知绑定人
+type BwgMonitor struct {
+	Percents   []int
+	RemindDays int
+}
+
+var bwgMonitor atomic.Pointer[BwgMonitor]
+
+const bwgUsageSnapshotRetentionDays = 100
+
+// InitBwgMonitor 应用搬瓦工流量监控配置，重新加载配置时也会调用
+func InitBwgMonitor(config BwgConfig) {
+	// 缓存时间未改变时保留已缓存的服务器信息
+	if cache := bwgInfoCache.Load(); cache == nil || cache.ttl != config.InfoCacheTtl {
+		InitBwgInfoCache(config.InfoCacheTtl)
+	}
+	percents := slices.Clone(config.AlertPercents)
+	slices.Sort(percents)
+	bwgMonitor.Store(&BwgMonitor{Percents: slices.Compact(percents), RemindDays: config.ResetRemindDays})
+}
+
+func AddBwgMonitorJob(scheduler *cron.Cron, cronStr string) error {
+	_, err := scheduler.AddFunc(cronStr, func() {
+		bwgMonitor.Load().CheckAll()
+	})
+	if err != nil {
+		return fmt.Errorf("添加搬瓦工流量监控定时任务失败: %w", err)
+	}
+	return nil
+}
+
+func (m *BwgMonitor) CheckAll() {
+	bwgApiKeys, err := store.BwgKeys.SelectAll()
+	if err != nil {
+		log.WithField("component", "bwg_monitor").Error("查询已绑定的服务器失败: ", err)
+		return
+	}
+
+	for _, bwgApiKey := range *bwgApiKeys {
+		veid, apiKey, err := decryptBwgKey(&bwgApiKey)
+		if err != nil {
+			continue
+		}
+		// 定时检查需要最新的用量，不使用缓存
+		info, err := NewBwgClient(veid, apiKey).GetServiceInfo()
+		if err != nil {
+			log.Warnf("获取服务器 %s 信息失败: %v", bwgApiKey.Alias, err)
+			continue
+		}
+		now := time.Now()
+		err = store.BwgStates.InsertUsageSnapshot(&BwgUsageSnapshot{
+			BwgApiKeyPid:    bwgApiKey.Pid,
+			DataCounter:     info.DataCounter,
+			PlanMonthlyData: info.PlanMonthlyData,
+			DataNextReset:   info.DataNextReset,
+			CreateTime:      now,
+		})
+		if err != nil {
+			log.WithField("component", "bwg_monitor").Error("保存搬瓦工流量快照失败: ", err)
+		}
+		m.Check(&bwgApiKey, info, now)
+	}
+
+	// 快照只用于展示近期趋势，保留最近几个计费周期即可
+	if err := store.BwgStates.DeleteUsageSnapshotsBefore(time.Now().AddDate(0, 0, -bwgUsageSnapshotRetentionDays)); err != nil {
+		log.WithField("component", "bwg_monitor").Error("清理搬瓦工流量快照失败: ", err)
+	}
+}
+
+// Check 对比告警状态，发送需要的通知并保存新状态
+func (m *BwgMonitor) Check(bwgApiKey *BwgApiKey, info *BwgServerInfo, now time.Time) {
+	if info.PlanMonthlyData == 0 {
+		return
+	}
+
+	state, err := store.BwgStates.SelectAlertStateByKeyPid(bwgApiKey.Pid)
+	if err != nil {
+		log.WithField("component", "bwg_monitor").Error("查询搬瓦工流量告警状态失败: ", err)
+		return
+	}
+
+	messages := make([]string, 0)
+	if state == nil {
+		state = &BwgAlertState{BwgApiKeyPid: bwgApiKey.Pid, DataNextReset: info.DataNextReset}
+	} else if info.DataNextReset > state.DataNextReset {
+		// 重置时间后移说明进入了新的计费周期
+		messages = append(messages, fmt.Sprintf("服务器 `%s` 流量已重置\n*下次重置时间*：%s", bwgApiKey.Alias,
+			ReplaceForMarkdownV2(time.Unix(info.DataNextReset, 0).Format(DateTimeFormat))))
+		state = &BwgAlertState{Pid: state.Pid, BwgApiKeyPid: bwgApiKey.Pid, DataNextReset: info.DataNextReset}
+	}
+
+	percent := int(info.DataCounter * 100 / info.PlanMonthlyData)
+	crossed := 0
+	for _, threshold := range m.Percents {
+		if percent >= threshold {
+			crossed = threshold
+		}
+	}
+	if crossed > state.NotifiedPercent {
+		messages = append(messages, fmt.Sprintf("服务器 `%s` 流量已使用 *%d%%*，超过 %d%%\n*流量使用情况*：%s / %s", bwgApiKey.Alias, percent, crossed,
+			ReplaceForMarkdownV2(calculateTraffic(info.DataCounter)), ReplaceForMarkdownV2(calculateTraffic(info.PlanMonthlyData))))
+		state.NotifiedPercent = crossed
+	}
+
+	nextReset := time.Unix(info.DataNextReset, 0)
+	if !state.ResetReminded && nextReset.Sub(now) <= time.Duration(m.RemindDays)*24*time.Hour {
+		messages = append(messages, buildBwgResetReminder(bwgApiKey.Alias, info, now))
+		state.ResetReminded = true
+	}
+
+	for _, message := range messages {
+		if _, err := bot.Send(&tele.User{ID: bwgApiKey.UserId}, message); err != nil {
+			log.WithField("component", "bwg_monitor").Error("发送搬瓦工流量通知失败: ", err)
+		}
+	}
+
+	state.UpdateTime = now
+	_ = store.BwgStates.SaveAlertState(state)
+}
+
+func buildBwgResetReminder(alias string, info *BwgServerInfo, now time.Time) string {
+	nextReset := time.Unix(info.DataNextReset, 0)
+	msgSlice := []string{
+		fmt.Sprintf("服务器 `%s` 距离流量重置还有 %s", alias, GetDuration(nextReset)),
+		fmt.Sprintf("*流量使用情况*：%s / %s", ReplaceForMarkdownV2(calculateTraffic(info.DataCounter)), ReplaceForMarkdownV2(calculateTraffic(info.PlanMonthlyData))),
+	}
+
+	projected, exhaustAt := ProjectBwgUsage(info, now)
+	if projected > info.PlanMonthlyData {
+		msgSlice = append(msgSlice, fmt.Sprintf("按当前速度预计将在 *%s* 用尽流量", ReplaceForMarkdownV2(exhaustAt.Format(DateTimeFormat))))
+	} else {
+		msgSlice = append(msgSlice, fmt.Sprintf("按当前速度预计重置前共使用 %s，流量充足", ReplaceForMarkdownV2(calculateTraffic(projected))))
+	}
+	return strings.Join(msgSlice, "\n")
+}
+
+// ProjectBwgUsage 按本周期的平均速度推算重置前的总用量，以及流量用尽的时间
+func ProjectBwgUsage(info *BwgServerInfo, now time.Time) (int64, time.Time) {
+	nextReset := time.Unix(info.DataNextReset, 0)
+	cycleStart := nextReset.AddDate(0, -1, 0)
+	elapsed := now.Sub(cycleStart)
+	if elapsed <= 0 || info.DataCounter <= 0 {
+		return info.DataCounter, time.Time{}
+	}
+
+	rate := float64(info.DataCounter) / elapsed.Seconds()
+	projected := info.DataCounter + int64(rate*nextReset.Sub(now).Seconds())
+	exhaustAt := now.Add(time.Duration(float64(info.PlanMonthlyData-info.DataCounter)/rate) * time.Second)
+	return projected, exhaustAt
+}
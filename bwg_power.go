@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	tele "gopkg.in/telebot.v3"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BwgPowerActionType = string
+
+const (
+	BwgPowerStart   BwgPowerActionType = "start"
+	BwgPowerStop    BwgPowerActionType = "stop"
+	BwgPowerRestart BwgPowerActionType = "restart"
+)
+
+// BwgPowerUnique 电源操作确认按钮的回调标识
+const BwgPowerUnique = "bp"
+
+// 确认按钮的有效期
+const bwgPowerConfirmTimeout = 60 * time.Second
+
+var bwgPowerActionNames = map[BwgPowerActionType]string{
+	BwgPowerStart:   "开机",
+	BwgPowerStop:    "关机",
+	BwgPowerRestart: "重启",
+}
+
+// 等待确认的操作，Key 为 chatId:messageId，确认、取消或过期后删除，保证每个按钮只能生效一次
+var bwgPendingPowerActions sync.Map
+
+func BwgStartHandler(c tele.Context) error {
+	return requestBwgPowerAction(c, BwgPowerStart)
+}
+
+func BwgStopHandler(c tele.Context) error {
+	return requestBwgPowerAction(c, BwgPowerStop)
+}
+
+func BwgRestartHandler(c tele.Context) error {
+	return requestBwgPowerAction(c, BwgPowerRestart)
+}
+
+func requestBwgPowerAction(c tele.Context, action BwgPowerActionType) error {
+	alias := ""
+	if args := c.Args(); len(args) > 0 {
+		alias = args[0]
+	}
+
+	bwgApiKey, err := selectBwgKey(c.Sender().ID, alias)
+	if err != nil {
+		return sendBwgKeyError(c, err)
+	}
+
+	chatId := c.Chat().ID
+	issued := strconv.FormatInt(time.Now().Unix(), 10)
+	pid := strconv.FormatInt(bwgApiKey.Pid, 10)
+	markup := &tele.ReplyMarkup{}
+	markup.Inline(markup.Row(
+		bwgPowerButton(markup, chatId, "确认", "y", action, pid, issued),
+		bwgPowerButton(markup, chatId, "取消", "n", action, pid, issued),
+	))
+
+	reply := fmt.Sprintf("确认要*%s*服务器 `%s` 吗？\n%d 秒内有效", bwgPowerActionNames[action], bwgApiKey.Alias, int(bwgPowerConfirmTimeout.Seconds()))
+	message, err := c.Bot().Send(c.Chat(), reply, markup)
+	if err != nil {
+		return err
+	}
+
+	key := bwgPowerMessageKey(chatId, message.ID)
+	bwgPendingPowerActions.Store(key, struct{}{})
+	time.AfterFunc(bwgPowerConfirmTimeout, func() {
+		if _, ok := bwgPendingPowerActions.LoadAndDelete(key); ok {
+			_, _ = c.Bot().Edit(message, ReplaceForMarkdownV2(fmt.Sprintf("%s操作已过期", bwgPowerActionNames[action])))
+		}
+	})
+	return nil
+}
+
+// bwgPowerButton 数据格式为 confirm|action|pid|issued|signature
+func bwgPowerButton(markup *tele.ReplyMarkup, chatId int64, text string, confirm string, action BwgPowerActionType, pid string, issued string) tele.Btn {
+	signature := signCallbackData(chatId, strings.Join([]string{confirm, action, pid, issued}, "|"))
+	return markup.Data(text, BwgPowerUnique, confirm, action, pid, issued, signature)
+}
+
+func bwgPowerMessageKey(chatId int64, messageId int) string {
+	return fmt.Sprintf("%d:%d", chatId, messageId)
+}
+
+func BwgPowerCallbackHandler(c tele.Context) error {
+	chatId := c.Chat().ID
+	parts := strings.Split(c.Callback().Data, "|")
+	if len(parts) != 5 || !verifyCallbackData(chatId, strings.Join(parts[:4], "|"), parts[4]) {
+		log.Warn("电源操作回调数据无效: ", c.Callback().Data)
+		return respondFailure(c, "按钮已失效")
+	}
+	confirm, action := parts[0], parts[1]
+	pid, _ := strconv.ParseInt(parts[2], 10, 64)
+	issued, _ := strconv.ParseInt(parts[3], 10, 64)
+	actionName, ok := bwgPowerActionNames[action]
+	if !ok {
+		return respondFailure(c, "按钮已失效")
+	}
+
+	// 只有绑定该 VEID 的用户可以操作
+	bwgApiKey, err := store.BwgKeys.SelectByPid(pid)
+	if err != nil || bwgApiKey.UserId != c.Sender().ID {
+		return respondFailure(c, "无操作权限")
+	}
+
+	if time.Since(time.Unix(issued, 0)) > bwgPowerConfirmTimeout {
+		bwgPendingPowerActions.Delete(bwgPowerMessageKey(chatId, c.Message().ID))
+		_ = c.Edit(ReplaceForMarkdownV2(fmt.Sprintf("%s操作已过期", actionName)))
+		return respondFailure(c, "操作已过期")
+	}
+	if _, ok := bwgPendingPowerActions.LoadAndDelete(bwgPowerMessageKey(chatId, c.Message().ID)); !ok {
+		return respondFailure(c, "操作已处理")
+	}
+
+	if confirm != "y" {
+		_ = c.Edit(ReplaceForMarkdownV2(fmt.Sprintf("已取消%s操作", actionName)))
+		return c.Respond()
+	}
+
+	veid, apiKey, err := decryptBwgKey(bwgApiKey)
+	if err != nil {
+		reply := "已保存的 VEID 或 API KEY 解密失败\n请使用 /bwg\\_bind 命令重新绑定"
+		markAuditFailure(c, reply)
+		_ = c.Edit(reply)
+		return c.Respond()
+	}
+	client := NewBwgClient(veid, apiKey)
+	switch action {
+	case BwgPowerStart:
+		err = client.Start()
+	case BwgPowerStop:
+		err = client.Stop()
+	case BwgPowerRestart:
+		err = client.Restart()
+	}
+	InvalidateBwgServerInfo(veid, apiKey)
+
+	result := "success"
+	if err != nil {
+		result = err.Error()
+		log.Errorf("搬瓦工%s操作失败: %v", actionName, err)
+	}
+	// veid 为密文，另外记录服务器的 pid 和别名以便查询
+	_ = store.BwgStates.InsertPowerAction(&BwgPowerAction{
+		UserId:       c.Sender().ID,
+		Username:     c.Sender().Username,
+		BwgApiKeyPid: bwgApiKey.Pid,
+		Alias:        bwgApiKey.Alias,
+		Veid:         bwgApiKey.Veid,
+		Action:       action,
+		Result:       result,
+		CreateTime:   time.Now(),
+	})
+
+	var reply string
+	var apiError *BwgApiError
+	switch {
+	case err == nil:
+		reply = fmt.Sprintf("*%s成功*！\n服务器 `%s`", actionName, bwgApiKey.Alias)
+	case errors.As(err, &apiError):
+		reply = fmt.Sprintf("*%s失败*！\n%s", actionName, ReplaceForMarkdownV2(apiError.Message))
+	default:
+		reply = fmt.Sprintf("*%s失败*！\n请稍后再试", actionName)
+	}
+	if err != nil {
+		markAuditFailure(c, result)
+	}
+	_ = c.Edit(reply)
+	return c.Respond()
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// newFakeKiwiVM 模拟 KiwiVM API，校验 veid 和 api_key 后按接口名返回固定内容
+func newFakeKiwiVM(t *testing.T) *httptest.Server {
+	responses := map[string]string{
+		"/v1/getServiceInfo":     `{"hostname":"example","node_datacenter":"US, Los Angeles","ip_addresses":["1.2.3.4"],"plan_monthly_data":1099511627776,"data_counter":1073741824,"data_next_reset":1760000000,"error":0}`,
+		"/v1/getLiveServiceInfo": `{"hostname":"example","ve_status":"Running","ve_used_disk_space_b":"2147483648","plan_ram":1073741824,"plan_disk":21474836480,"mem_available_kb":524288,"swap_total_kb":"262144","swap_available_kb":131072,"load_average":"0.10 0.20 0.30","is_cpu_throttled":"0","error":0}`,
+		"/v1/getRawUsageStats":   `{"data":[{"timestamp":1760000000,"network_in_bytes":100,"network_out_bytes":200,"disk_read_bytes":300,"disk_write_bytes":400,"cpu_usage":5}],"vm_type":"kvm","error":0}`,
+		"/v1/getRateLimitStatus": `{"remaining_points_15min":900,"remaining_points_24h":18000,"error":0}`,
+		"/v1/getAuditLog":        `{"log_entries":[{"timestamp":1760000000,"requestor_ipv4":16909060,"type":0,"summary":"Restart"}],"error":0}`,
+		"/v1/getAvailableOS":     `{"installed":"debian-12-x86_64","templates":["debian-12-x86_64","ubuntu-24.04-x86_64"],"error":0}`,
+		"/v1/start":              `{"error":0}`,
+		"/v1/stop":               `{"error":0}`,
+		"/v1/restart":            `{"error":0}`,
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.RawQuery != "" {
+			t.Errorf("credentials must be sent in the request body, got %s %s", r.Method, r.URL)
+		}
+		if r.PostFormValue("veid") != "123456" || r.PostFormValue("api_key") != "private_a+b&c" {
+			_, _ = w.Write([]byte(`{"error":700005,"message":"Authentication failure"}`))
+			return
+		}
+		response, ok := responses[r.URL.Path]
+		if !ok {
+			t.Errorf("unexpected path %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(response))
+	}))
+}
+
+func newTestBwgClient(server *httptest.Server, apiKey string) *BwgClient {
+	client := NewBwgClient("123456", apiKey)
+	client.BaseUrl = server.URL + "/v1"
+	client.HttpClient = NewHttpClient("KiwiVM", 5*time.Second)
+	return client
+}
+
+func TestBwgClient(t *testing.T) {
+	server := newFakeKiwiVM(t)
+	defer server.Close()
+	client := newTestBwgClient(server, "private_a+b&c")
+
+	info, err := client.GetServiceInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.HostName != "example" || info.DataCounter != 1<<30 || len(info.IpAddresses) != 1 {
+		t.Fatalf("unexpected service info: %+v", info)
+	}
+
+	live, err := client.GetLiveServiceInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live.VeStatus != "Running" || live.VeUsedDiskSpaceB != 2<<30 || live.SwapTotalKb != 262144 || live.PlanRam != 1<<30 {
+		t.Fatalf("unexpected live service info: %+v", live)
+	}
+
+	usage, err := client.GetRawUsageStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage.Data) != 1 || usage.Data[0].NetworkOutBytes != 200 || usage.VmType != "kvm" {
+		t.Fatalf("unexpected usage stats: %+v", usage)
+	}
+
+	rateLimit, err := client.GetRateLimitStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rateLimit.RemainingPoints15Min != 900 || rateLimit.RemainingPoints24H != 18000 {
+		t.Fatalf("unexpected rate limit status: %+v", rateLimit)
+	}
+
+	auditLog, err := client.GetAuditLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(auditLog.LogEntries) != 1 || auditLog.LogEntries[0].RequestorIp() != "1.2.3.4" {
+		t.Fatalf("unexpected audit log: %+v", auditLog)
+	}
+
+	oses, err := client.GetAvailableOSes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oses.Installed != "debian-12-x86_64" || len(oses.Templates) != 2 {
+		t.Fatalf("unexpected available oses: %+v", oses)
+	}
+}
+
+func TestBwgClientPowerActions(t *testing.T) {
+	server := newFakeKiwiVM(t)
+	defer server.Close()
+	client := newTestBwgClient(server, "private_a+b&c")
+
+	for name, action := range map[string]func() error{"start": client.Start, "stop": client.Stop, "restart": client.Restart} {
+		if err := action(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	client.ApiKey = "wrong"
+	if err := client.Restart(); err == nil {
+		t.Fatal("expected restart to fail with wrong api key")
+	}
+}
+
+func TestBwgClientApiError(t *testing.T) {
+	server := newFakeKiwiVM(t)
+	defer server.Close()
+	client := newTestBwgClient(server, "wrong")
+
+	_, err := client.GetServiceInfo()
+	var apiError *BwgApiError
+	if !errors.As(err, &apiError) || apiError.Code != 700005 {
+		t.Fatalf("expected api error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "Authentication failure") {
+		t.Fatalf("unexpected error message: %v", err)
+	}
+}
+
+func TestCalculateBwgDailyUsage(t *testing.T) {
+	day := time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local)
+	info := &BwgServerInfo{DataCounter: 700, DataNextReset: 1}
+	snapshots := []BwgUsageSnapshot{
+		// 上个周期的快照不参与计算
+		{DataCounter: 9000, DataNextReset: 0, CreateTime: day.Add(-time.Hour)},
+		{DataCounter: 100, DataNextReset: 1, CreateTime: day.Add(time.Hour)},
+		{DataCounter: 300, DataNextReset: 1, CreateTime: day.Add(20 * time.Hour)},
+		{DataCounter: 500, DataNextReset: 1, CreateTime: day.Add(30 * time.Hour)},
+	}
+
+	dailyUsages := CalculateBwgDailyUsage(snapshots, info, day.Add(50*time.Hour))
+	expected := []BwgDailyUsage{{"2026-10-01", 300}, {"2026-10-02", 200}, {"2026-10-03", 200}}
+	if len(dailyUsages) != len(expected) {
+		t.Fatalf("unexpected daily usages: %+v", dailyUsages)
+	}
+	for i := range expected {
+		if dailyUsages[i] != expected[i] {
+			t.Fatalf("unexpected daily usages: %+v", dailyUsages)
+		}
+	}
+}
+
+func TestBwgClientRedactsApiKey(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("upstream rejected api_key=" + r.PostFormValue("api_key")))
+	}))
+	defer server.Close()
+	client := NewBwgClient("123456", "private_secret")
+	client.BaseUrl = server.URL + "/v1"
+	client.HttpClient = NewHttpClient("KiwiVM", 5*time.Second)
+
+	_, err := client.GetServiceInfo()
+	if err == nil || strings.Contains(err.Error(), "private_secret") {
+		t.Fatalf("API KEY 应当在错误信息中隐藏: %v", err)
+	}
+}
+
+func TestBwgBindConversation(t *testing.T) {
+	initTestStore(t)
+	InitKeyring(KeyConfig{Passphrase: "bwg bind test passphrase"})
+	server := newFakeKiwiVM(t)
+	defer server.Close()
+	baseUrl := bwgApiBaseUrl
+	bwgApiBaseUrl = server.URL + "/v1"
+	t.Cleanup(func() { bwgApiBaseUrl = baseUrl })
+
+	send := func(text string) *fakeContext {
+		c := newFakeContext(1, 10, text)
+		if strings.HasPrefix(text, "/") {
+			_ = BwgBindHandler(c)
+		} else {
+			_ = TextHandler(c)
+		}
+		return c
+	}
+
+	if c := send("/bwg_bind bad/alias"); !strings.Contains(c.lastSent(), "别名只能包含") {
+		t.Fatalf("非法别名的回复 = %q", c.lastSent())
+	}
+	if c := send("/bwg_bind main"); !strings.Contains(c.lastSent(), "请输入 VEID") {
+		t.Fatalf("开始绑定的回复 = %q", c.lastSent())
+	}
+	// 每条输入读取后都会被删除
+	if c := send("abc"); !strings.Contains(c.lastSent(), "VEID 应为数字") || c.deleted != 1 {
+		t.Fatalf("VEID 错误的回复 = %q，删除 %d 条", c.lastSent(), c.deleted)
+	}
+	if c := send("123456"); !strings.Contains(c.lastSent(), "请输入 API KEY") || c.deleted != 1 {
+		t.Fatalf("输入 VEID 后的回复 = %q，删除 %d 条", c.lastSent(), c.deleted)
+	}
+	if c := send("wrong"); !strings.Contains(c.lastSent(), "验证失败") || c.deleted != 1 {
+		t.Fatalf("API KEY 错误的回复 = %q，删除 %d 条", c.lastSent(), c.deleted)
+	}
+	if c := send("private_a+b&c"); !strings.Contains(c.lastSent(), "绑定成功") || c.deleted != 1 {
+		t.Fatalf("绑定完成的回复 = %q，删除 %d 条", c.lastSent(), c.deleted)
+	}
+	// 绑定完成后对话结束
+	if c := send("private_a+b&c"); !strings.Contains(c.lastSent(), "只支持输入命令") {
+		t.Fatalf("对话结束后的回复 = %q", c.lastSent())
+	}
+
+	bwgApiKey, err := store.BwgKeys.SelectByUserIdAndAlias(10, "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bwgApiKey.ApiKey == "private_a+b&c" {
+		t.Fatal("API KEY 应当加密保存")
+	}
+	veid, apiKey, err := decryptBwgKey(bwgApiKey)
+	if err != nil || veid != "123456" || apiKey != "private_a+b&c" {
+		t.Fatalf("解密结果 = %s %s %v", veid, apiKey, err)
+	}
+}
+
+func TestBwgBindCancel(t *testing.T) {
+	c := newFakeContext(1, 10, "/bwg_bind")
+	_ = BwgBindHandler(c)
+	_ = CancelHandler(newFakeContext(1, 10, "/cancel"))
+	if handled, _ := conversations.Handle(newFakeContext(1, 10, "123456")); handled {
+		t.Fatal("取消后不应继续绑定")
+	}
+}
+
+func TestBwgPowerCallback(t *testing.T) {
+	initTestCallbackSigner(t)
+	InitBwgInfoCache(time.Minute)
+	server := newFakeKiwiVM(t)
+	defer server.Close()
+	baseUrl := bwgApiBaseUrl
+	bwgApiBaseUrl = server.URL + "/v1"
+	t.Cleanup(func() { bwgApiBaseUrl = baseUrl })
+
+	veid, _ := encryptSecret(10, "123456")
+	apiKey, _ := encryptSecret(10, "private_a+b&c")
+	_ = store.BwgKeys.Insert(&BwgApiKey{UserId: 10, Veid: veid, ApiKey: apiKey, Alias: "main"})
+	bwgApiKey, _ := store.BwgKeys.SelectByUserIdAndAlias(10, "main")
+
+	// press 模拟 userId 点击 messageId 上签发于 issued 的按钮
+	press := func(userId int64, messageId int, confirm string, issued time.Time) *fakeContext {
+		btn := bwgPowerButton(&tele.ReplyMarkup{}, 1, "", confirm, BwgPowerRestart, strconv.FormatInt(bwgApiKey.Pid, 10), strconv.FormatInt(issued.Unix(), 10))
+		c := newFakeCallbackContext(1, userId, messageId, btn.Data)
+		_ = BwgPowerCallbackHandler(c)
+		return c
+	}
+	pending := func(messageId int) {
+		bwgPendingPowerActions.Store(bwgPowerMessageKey(1, messageId), struct{}{})
+	}
+	countActions := func() int {
+		var count int
+		_ = store.db.Get(&count, "SELECT count(*) FROM bwg_power_action")
+		return count
+	}
+
+	// 其他用户点击时拒绝，按钮仍然可以由绑定的用户确认
+	pending(1)
+	if c := press(11, 1, "y", time.Now()); len(c.responded) != 1 || c.responded[0] != "无操作权限" || len(c.edited) != 0 {
+		t.Fatalf("其他用户点击的响应 = %v，编辑 %v", c.responded, c.edited)
+	}
+	if _, ok := bwgPendingPowerActions.Load(bwgPowerMessageKey(1, 1)); !ok {
+		t.Fatal("其他用户点击后操作不应被取消")
+	}
+
+	// 超过有效期的按钮不执行，并且不能再次使用
+	pending(2)
+	if c := press(10, 2, "y", time.Now().Add(-bwgPowerConfirmTimeout-time.Second)); c.responded[0] != "操作已过期" || !strings.Contains(c.edited[0], "已过期") {
+		t.Fatalf("过期按钮的响应 = %v，编辑 %v", c.responded, c.edited)
+	}
+	if _, ok := bwgPendingPowerActions.Load(bwgPowerMessageKey(1, 2)); ok {
+		t.Fatal("过期的操作应当被删除")
+	}
+
+	if c := press(10, 1, "y", time.Now()); len(c.edited) != 1 || !strings.Contains(c.edited[0], "重启成功") {
+		t.Fatalf("确认后的回复 = %v", c.edited)
+	}
+	// 已确认的按钮重复点击不会再次执行
+	if c := press(10, 1, "y", time.Now()); c.responded[0] != "操作已处理" || len(c.edited) != 0 {
+		t.Fatalf("重复点击的响应 = %v，编辑 %v", c.responded, c.edited)
+	}
+	// 没有等待确认的消息（如重启后）上的按钮同样不执行
+	if c := press(10, 3, "y", time.Now()); c.responded[0] != "操作已处理" {
+		t.Fatalf("未签发消息的响应 = %v", c.responded)
+	}
+	if count := countActions(); count != 1 {
+		t.Fatalf("应当只记录 1 次电源操作，实际 %d 次", count)
+	}
+
+	var powerAction BwgPowerAction
+	if err := store.db.Get(&powerAction, "SELECT pid, user_id, username, bwg_api_key_pid, alias, veid, action, result, create_time FROM bwg_power_action"); err != nil {
+		t.Fatal(err)
+	}
+	if powerAction.BwgApiKeyPid != bwgApiKey.Pid || powerAction.Alias != "main" || powerAction.Action != BwgPowerRestart || powerAction.Result != "success" {
+		t.Errorf("电源操作记录 = %+v", powerAction)
+	}
+	if powerAction.Veid == "123456" {
+		t.Error("电源操作记录中的 VEID 应当加密保存")
+	}
+
+	pending(4)
+	if c := press(10, 4, "n", time.Now()); !strings.Contains(c.edited[0], "已取消") || countActions() != 1 {
+		t.Fatalf("取消后的回复 = %v", c.edited)
+	}
+}
+
+func TestBuildServerTableMessage(t *testing.T) {
+	initTestStore(t)
+	InitKeyring(KeyConfig{Passphrase: "bwg table test passphrase"})
+	InitBwgInfoCache(time.Minute)
+	server := newFakeKiwiVM(t)
+	defer server.Close()
+	baseUrl := bwgApiBaseUrl
+	bwgApiBaseUrl = server.URL + "/v1"
+	t.Cleanup(func() { bwgApiBaseUrl = baseUrl })
+
+	veid, _ := encryptSecret(10, "123456")
+	apiKey, _ := encryptSecret(10, "private_a+b&c")
+	bwgApiKeys := []BwgApiKey{
+		{UserId: 10, Veid: veid, ApiKey: apiKey, Alias: "main"},
+		{UserId: 10, Veid: veid, ApiKey: apiKey, Alias: "a_longer_alias"},
+	}
+	message := buildServerTableMessage(bwgApiKeys)
+	table := strings.Split(message[strings.Index(message, "```\n")+4:strings.LastIndex(message, "\n```")], "\n")
+	if len(table) != 3 {
+		t.Fatalf("表格 = %q", table)
+	}
+	// 表头中的中文按 2 列计算，最后一列之前的各列宽度一致
+	columns := displayWidth(table[0][:strings.LastIndex(table[0], " ")])
+	for _, row := range table[1:] {
+		if width := displayWidth(row[:strings.LastIndex(row, " ")]); width != columns {
+			t.Errorf("表格未对齐:\n%s", strings.Join(table, "\n"))
+		}
+	}
+	if !strings.HasPrefix(table[2], "a_longer_alias ") {
+		t.Errorf("别名列应当按最长的别名加宽: %q", table[2])
+	}
+}
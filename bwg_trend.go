@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+	tele "gopkg.in/telebot.v3"
+	"strings"
+	"time"
+)
+
+type BwgDailyUsage struct {
+	Date  string
+	Usage int64
+}
+
+// CalculateBwgDailyUsage 根据本周期的快照计算每日用量，最后以当前计数补齐当天
+// 快照缺失的日期，其用量会计入下一个有快照的日期
+func CalculateBwgDailyUsage(snapshots []BwgUsageSnapshot, info *BwgServerInfo, now time.Time) []BwgDailyUsage {
+	points := make([]BwgUsageSnapshot, 0, len(snapshots)+1)
+	for _, snapshot := range snapshots {
+		if snapshot.DataNextReset == info.DataNextReset {
+			points = append(points, snapshot)
+		}
+	}
+	points = append(points, BwgUsageSnapshot{DataCounter: info.DataCounter, DataNextReset: info.DataNextReset, CreateTime: now})
+
+	dailyUsages := make([]BwgDailyUsage, 0)
+	var previous int64 = 0
+	for _, point := range points {
+		usage := point.DataCounter - previous
+		if usage < 0 {
+			usage = point.DataCounter
+		}
+		previous = point.DataCounter
+
+		date := point.CreateTime.Format(DateFormat)
+		if len(dailyUsages) > 0 && dailyUsages[len(dailyUsages)-1].Date == date {
+			dailyUsages[len(dailyUsages)-1].Usage += usage
+		} else {
+			dailyUsages = append(dailyUsages, BwgDailyUsage{Date: date, Usage: usage})
+		}
+	}
+	return dailyUsages
+}
+
+func BwgTrendHandler(c tele.Context) error {
+	alias := ""
+	if args := c.Args(); len(args) > 0 {
+		alias = args[0]
+	}
+
+	bwgApiKey, err := selectBwgKey(c.Sender().ID, alias)
+	if err != nil {
+		return sendBwgKeyError(c, err)
+	}
+
+	veid, apiKey, err := decryptBwgKey(bwgApiKey)
+	if err != nil {
+		return sendBwgKeyError(c, err)
+	}
+	info, err := GetBwgServerInfo(veid, apiKey)
+	if err != nil || info.PlanMonthlyData == 0 {
+		return replyFailure(c, "获取服务器信息失败，请确认 VEID 和 API KEY 是否正确\n确认后重新使用 /bwg\\_bind 命令更新信息")
+	}
+
+	now := time.Now()
+	nextReset := time.Unix(info.DataNextReset, 0)
+	cycleStart := nextReset.AddDate(0, -1, 0)
+	snapshots, err := store.BwgStates.SelectUsageSnapshotsByKeyPidSince(bwgApiKey.Pid, cycleStart)
+	if err != nil {
+		log.Error("查询搬瓦工流量快照失败: ", err)
+		return replyFailure(c, "查询流量趋势失败，请稍后再试")
+	}
+
+	msgSlice := make([]string, 0)
+	msgSlice = append(msgSlice, fmt.Sprintf("*%s 本周期流量趋势*", ReplaceForMarkdownV2(bwgApiKey.Alias)))
+	msgSlice = append(msgSlice, fmt.Sprintf("*计费周期*：%s", ReplaceForMarkdownV2(cycleStart.Format(DateFormat)+" ~ "+nextReset.Format(DateFormat))))
+	msgSlice = append(msgSlice, fmt.Sprintf("*流量使用情况*：%s / %s", ReplaceForMarkdownV2(calculateTraffic(info.DataCounter)), ReplaceForMarkdownV2(calculateTraffic(info.PlanMonthlyData))))
+
+	msgSlice = append(msgSlice, "*每日用量*：")
+	for _, dailyUsage := range CalculateBwgDailyUsage(*snapshots, info, now) {
+		msgSlice = append(msgSlice, fmt.Sprintf("`%s` %s", dailyUsage.Date[5:], ReplaceForMarkdownV2(calculateTraffic(dailyUsage.Usage))))
+	}
+
+	elapsedDays := decimal.NewFromFloat(now.Sub(cycleStart).Hours() / 24)
+	if elapsedDays.IsPositive() {
+		dailyRate := decimal.NewFromInt(info.DataCounter).Div(elapsedDays).IntPart()
+		msgSlice = append(msgSlice, fmt.Sprintf("*平均速度*：%s / 天", ReplaceForMarkdownV2(calculateTraffic(dailyRate))))
+	}
+
+	projected, exhaustAt := ProjectBwgUsage(info, now)
+	if projected > info.PlanMonthlyData {
+		msgSlice = append(msgSlice, fmt.Sprintf("*预计用尽时间*：%s", ReplaceForMarkdownV2(exhaustAt.Format(DateTimeFormat))))
+	} else {
+		msgSlice = append(msgSlice, fmt.Sprintf("*预计重置前用量*：%s，流量充足", ReplaceForMarkdownV2(calculateTraffic(projected))))
+	}
+
+	return c.Send(strings.Join(msgSlice, "\n"))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errCacheLoadPanic 加载函数 panic 时，等待同一次加载的其他调用方收到该错误
+var errCacheLoadPanic = errors.New("加载缓存数据时发生 panic")
+
+type cacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+type cacheCall[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// TtlCache 带过期时间的缓存，同一个 key 同时只会加载一次，其余调用方等待同一个结果。
+// 加载失败的结果不缓存，ttl 不大于 0 时只合并并发的加载而不缓存。缓存的值由所有调用方共享，不可修改
+type TtlCache[K comparable, V any] struct {
+	name string
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	entries map[K]cacheEntry[V]
+	calls   map[K]*cacheCall[V]
+}
+
+func NewTtlCache[K comparable, V any](name string, ttl time.Duration) *TtlCache[K, V] {
+	return &TtlCache[K, V]{
+		name:    name,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[K]cacheEntry[V]{},
+		calls:   map[K]*cacheCall[V]{},
+	}
+}
+
+// Get 返回未过期的缓存，否则调用 load 加载
+func (c *TtlCache[K, V]) Get(key K, load func() (V, error)) (V, error) {
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok && c.now().Before(entry.expires) {
+		c.mu.Unlock()
+		cacheRequests.WithLabelValues(c.name, "hit").Inc()
+		return entry.value, nil
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		cacheRequests.WithLabelValues(c.name, "shared").Inc()
+		<-call.done
+		return call.value, call.err
+	}
+	call := &cacheCall[V]{done: make(chan struct{}), err: errCacheLoadPanic}
+	c.calls[key] = call
+	c.mu.Unlock()
+	cacheRequests.WithLabelValues(c.name, "miss").Inc()
+
+	defer func() {
+		c.mu.Lock()
+		// 加载期间被 Invalidate 的结果不写入缓存
+		if c.calls[key] == call {
+			delete(c.calls, key)
+			if call.err == nil && c.ttl > 0 {
+				c.prune()
+				c.entries[key] = cacheEntry[V]{value: call.value, expires: c.now().Add(c.ttl)}
+			}
+		}
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	call.value, call.err = load()
+	return call.value, call.err
+}
+
+// Invalidate 删除缓存，正在进行的加载结果也不会写入缓存
+func (c *TtlCache[K, V]) Invalidate(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+	delete(c.calls, key)
+}
+
+// prune 删除已过期的缓存，调用方需持有锁
+func (c *TtlCache[K, V]) prune() {
+	now := c.now()
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
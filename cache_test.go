@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTtlCacheExpire(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.Local)
+	cache := NewTtlCache[string, int]("test", time.Minute)
+	cache.now = func() time.Time { return now }
+
+	loads := 0
+	load := func() (int, error) {
+		loads++
+		return loads, nil
+	}
+	if value, _ := cache.Get("a", load); value != 1 {
+		t.Fatalf("首次加载 = %d", value)
+	}
+	now = now.Add(59 * time.Second)
+	if value, _ := cache.Get("a", load); value != 1 {
+		t.Fatalf("未过期时应当使用缓存，得到 %d", value)
+	}
+	now = now.Add(time.Second)
+	if value, _ := cache.Get("a", load); value != 2 {
+		t.Fatalf("过期后应当重新加载，得到 %d", value)
+	}
+
+	// 加载失败不缓存
+	if _, err := cache.Get("b", func() (int, error) { return 0, errors.New("failed") }); err == nil {
+		t.Fatal("应当返回加载错误")
+	}
+	if value, _ := cache.Get("b", load); value != 3 {
+		t.Fatalf("失败后应当重新加载，得到 %d", value)
+	}
+
+	cache.Invalidate("a")
+	if value, _ := cache.Get("a", load); value != 4 {
+		t.Fatalf("Invalidate 后应当重新加载，得到 %d", value)
+	}
+}
+
+func TestTtlCacheSingleFlight(t *testing.T) {
+	cache := NewTtlCache[string, int]("test", time.Minute)
+	release := make(chan struct{})
+	var loads atomic.Int32
+	load := func() (int, error) {
+		loads.Add(1)
+		<-release
+		return 42, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]int, 10)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = cache.Get("a", load)
+		}()
+	}
+	// 等待所有调用方进入等待后再完成加载
+	for {
+		cache.mu.Lock()
+		started := len(cache.calls) == 1
+		cache.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if loads.Load() != 1 {
+		t.Errorf("并发调用应当只加载 1 次，实际 %d 次", loads.Load())
+	}
+	for i, result := range results {
+		if result != 42 {
+			t.Errorf("第 %d 个调用方得到 %d", i, result)
+		}
+	}
+}
+
+func TestTtlCacheInvalidateDuringLoad(t *testing.T) {
+	cache := NewTtlCache[string, int]("test", time.Minute)
+	_, _ = cache.Get("a", func() (int, error) {
+		// 例如流量收集任务在查询期间重置了计数
+		cache.Invalidate("a")
+		return 1, nil
+	})
+	if value, _ := cache.Get("a", func() (int, error) { return 2, nil }); value != 2 {
+		t.Fatalf("加载期间被 Invalidate 的结果不应写入缓存，得到 %d", value)
+	}
+}
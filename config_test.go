@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigYamlAndToml(t *testing.T) {
+	yamlPath := writeConfigFile(t, "config.yaml", `
+telegram:
+  token: "123:abc"
+key:
+  passphrase: "a passphrase long enough"
+xray:
+  api:
+    port: 10085
+  admins: [1, 2]
+bwg:
+  alert_percents: [90]
+`)
+	tomlPath := writeConfigFile(t, "config.toml", `
+[telegram]
+token = "123:abc"
+
+[key]
+passphrase = "a passphrase long enough"
+
+[xray]
+admins = [1, 2]
+
+[xray.api]
+port = 10085
+
+[bwg]
+alert_percents = [90]
+`)
+
+	for _, path := range []string{yamlPath, tomlPath} {
+		config, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if config.Xray.Api.Port != 10085 || config.Xray.Api.Host != "127.0.0.1" {
+			t.Errorf("%s: Xray API 配置错误: %+v", path, config.Xray.Api)
+		}
+		if len(config.Xray.Admins) != 2 || len(config.Bwg.AlertPercents) != 1 {
+			t.Errorf("%s: 列表配置错误: %v %v", path, config.Xray.Admins, config.Bwg.AlertPercents)
+		}
+		if config.Xray.StatsCron != "*/5 * * * *" {
+			t.Errorf("%s: 未填写的配置应当使用默认值: %s", path, config.Xray.StatsCron)
+		}
+	}
+}
+
+func TestLoadConfigEnvOverride(t *testing.T) {
+	path := writeConfigFile(t, "config.yml", "telegram:\n  token: \"from-file\"\n")
+	t.Setenv("TOKEN", "from-env")
+	t.Setenv("KEY", "a passphrase long enough")
+	t.Setenv("XRAY_STATS_ADMIN", "1, 2;3")
+	t.Setenv("RATE_LIMIT_BWG", "2/30s")
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Telegram.Token != "from-env" {
+		t.Errorf("环境变量应当覆盖配置文件: %s", config.Telegram.Token)
+	}
+	if len(config.Xray.Admins) != 3 {
+		t.Errorf("管理员解析错误: %v", config.Xray.Admins)
+	}
+	if config.RateLimit.Bwg != (RateLimitRule{Burst: 2, Interval: 30 * time.Second}) {
+		t.Errorf("限流规则解析错误: %+v", config.RateLimit.Bwg)
+	}
+
+	t.Setenv("XRAY_API_PORT", "abc")
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "XRAY_API_PORT") {
+		t.Errorf("环境变量格式错误时应当报错: %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := DefaultConfig()
+	config.Key.Passphrase = "short"
+	config.Xray.Api.Port = 70000
+	config.Xray.StatsCron = "every five minutes"
+	config.Bwg.AlertPercents = []int{120}
+	config.CloudflareD1.InsertUrl = "not a url"
+	config.Telegram.Webhook.PublicUrl = "http://bot.example.com/telegram/webhook"
+	config.Telegram.Webhook.SecretToken = "not valid!"
+	config.Alert.Interval = 0
+	config.Backup.Cron = "daily"
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("无效配置应当校验失败")
+	}
+	for _, field := range []string{"telegram.token", "key.passphrase", "xray.api.port", "xray.stats_cron", "bwg.alert_percents", "cloudflare_d1.insert_url", "cloudflare_d1.request_token", "telegram.webhook.public_url", "telegram.webhook.secret_token", "http.listen", "alert.interval", "backup.cron"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("错误信息中缺少 %s: %v", field, err)
+		}
+	}
+}
+
+func TestLoadConfigUnsupportedFormat(t *testing.T) {
+	path := writeConfigFile(t, "config.json", "{}")
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("不支持的格式应当报错")
+	}
+}
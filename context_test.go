@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	tele "gopkg.in/telebot.v3"
+	"strings"
+)
+
+// fakeContext 记录处理函数的回复，未覆盖的方法在测试中调用时会 panic
+type fakeContext struct {
+	tele.Context
+
+	message  *tele.Message
+	callback *tele.Callback
+	store    map[string]interface{}
+
+	sent      []string
+	edited    []string
+	responded []string
+	deleted   int
+}
+
+// newFakeContext 模拟用户在会话中发送的一条文本消息
+func newFakeContext(chatId int64, userId int64, text string) *fakeContext {
+	return &fakeContext{
+		message: &tele.Message{
+			ID:     1,
+			Text:   text,
+			Chat:   &tele.Chat{ID: chatId, Type: tele.ChatPrivate},
+			Sender: &tele.User{ID: userId, Username: fmt.Sprint("user", userId)},
+		},
+		store: map[string]interface{}{},
+	}
+}
+
+// newFakeCallbackContext 模拟用户点击了消息上的按钮
+func newFakeCallbackContext(chatId int64, userId int64, messageId int, data string) *fakeContext {
+	c := newFakeContext(chatId, userId, "")
+	c.message.ID = messageId
+	c.callback = &tele.Callback{Sender: c.message.Sender, Message: c.message, Data: data}
+	return c
+}
+
+func (c *fakeContext) Message() *tele.Message   { return c.message }
+func (c *fakeContext) Callback() *tele.Callback { return c.callback }
+func (c *fakeContext) Chat() *tele.Chat         { return c.message.Chat }
+func (c *fakeContext) Sender() *tele.User       { return c.message.Sender }
+func (c *fakeContext) Text() string             { return c.message.Text }
+
+func (c *fakeContext) Args() []string {
+	if c.callback != nil {
+		return strings.Split(c.callback.Data, "|")
+	}
+	if fields := strings.Fields(c.message.Text); len(fields) > 0 && strings.HasPrefix(fields[0], "/") {
+		return fields[1:]
+	}
+	return nil
+}
+
+func (c *fakeContext) Send(what interface{}, opts ...interface{}) error {
+	c.sent = append(c.sent, fmt.Sprint(what))
+	return nil
+}
+
+func (c *fakeContext) Edit(what interface{}, opts ...interface{}) error {
+	c.edited = append(c.edited, fmt.Sprint(what))
+	return nil
+}
+
+func (c *fakeContext) Respond(resp ...*tele.CallbackResponse) error {
+	text := ""
+	if len(resp) > 0 {
+		text = resp[0].Text
+	}
+	c.responded = append(c.responded, text)
+	return nil
+}
+
+func (c *fakeContext) Delete() error {
+	c.deleted++
+	return nil
+}
+
+func (c *fakeContext) Notify(action tele.ChatAction) error { return nil }
+
+func (c *fakeContext) Set(key string, value interface{}) { c.store[key] = value }
+func (c *fakeContext) Get(key string) interface{}        { return c.store[key] }
+
+// lastSent 返回最后一条回复，没有回复时为空字符串
+func (c *fakeContext) lastSent() string {
+	if len(c.sent) == 0 {
+		return ""
+	}
+	return c.sent[len(c.sent)-1]
+}
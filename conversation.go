@@ -0,0 +1,146 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	tele "gopkg.in/telebot.v3"
+	"sync"
+	"time"
+)
+
+// ConversationStep 处理对话中用户输入的下一条文本
+type ConversationStep func(c tele.Context, conversation *Conversation) error
+
+// Conversation 多步对话的状态，按会话和用户区分
+type Conversation struct {
+	Name string
+	Data map[string]string
+
+	key   conversationKey
+	step  ConversationStep
+	timer *time.Timer
+}
+
+type conversationKey struct {
+	ChatId int64
+	UserId int64
+}
+
+// ConversationManager 管理进行中的对话，超时未回复的对话会被自动结束
+type ConversationManager struct {
+	Timeout time.Duration
+	// 对话超时结束后调用，用于提醒用户
+	OnExpire func(conversation *Conversation)
+
+	mu            sync.Mutex
+	conversations map[conversationKey]*Conversation
+}
+
+var conversations = NewConversationManager(5 * time.Minute)
+
+func NewConversationManager(timeout time.Duration) *ConversationManager {
+	return &ConversationManager{
+		Timeout:       timeout,
+		OnExpire:      notifyConversationExpired,
+		conversations: map[conversationKey]*Conversation{},
+	}
+}
+
+// Start 开始新的对话，同一用户在同一会话中已有的对话会被替换
+func (m *ConversationManager) Start(c tele.Context, name string, step ConversationStep) *Conversation {
+	key := conversationKey{ChatId: c.Chat().ID, UserId: c.Sender().ID}
+	conversation := &Conversation{Name: name, Data: map[string]string{}, key: key, step: step}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if previous, ok := m.conversations[key]; ok {
+		previous.timer.Stop()
+	}
+	m.conversations[key] = conversation
+	conversation.timer = time.AfterFunc(m.Timeout, func() {
+		m.expire(conversation)
+	})
+	return conversation
+}
+
+// Next 设置对话的下一步，并重新计算超时时间
+func (m *ConversationManager) Next(conversation *Conversation, step ConversationStep) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conversation.step = step
+	conversation.timer.Reset(m.Timeout)
+}
+
+// End 结束对话
+func (m *ConversationManager) End(conversation *Conversation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conversation.timer.Stop()
+	if m.conversations[conversation.key] == conversation {
+		delete(m.conversations, conversation.key)
+	}
+}
+
+// Cancel 结束当前用户进行中的对话，返回是否存在对话
+func (m *ConversationManager) Cancel(c tele.Context) bool {
+	conversation, ok := m.get(c)
+	if ok {
+		m.End(conversation)
+	}
+	return ok
+}
+
+// Handle 将文本交给进行中的对话处理，没有对话时返回 false
+func (m *ConversationManager) Handle(c tele.Context) (bool, error) {
+	conversation, ok := m.get(c)
+	if !ok {
+		return false, nil
+	}
+
+	m.mu.Lock()
+	step := conversation.step
+	m.mu.Unlock()
+	return true, step(c, conversation)
+}
+
+// Current 返回消息所属的进行中的对话
+func (m *ConversationManager) Current(c tele.Context) (*Conversation, bool) {
+	return m.get(c)
+}
+
+func (m *ConversationManager) get(c tele.Context) (*Conversation, bool) {
+	if c.Chat() == nil || c.Sender() == nil {
+		return nil, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conversation, ok := m.conversations[conversationKey{ChatId: c.Chat().ID, UserId: c.Sender().ID}]
+	return conversation, ok
+}
+
+func (m *ConversationManager) expire(conversation *Conversation) {
+	m.mu.Lock()
+	if m.conversations[conversation.key] != conversation {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.conversations, conversation.key)
+	m.mu.Unlock()
+
+	if m.OnExpire != nil {
+		m.OnExpire(conversation)
+	}
+}
+
+func notifyConversationExpired(conversation *Conversation) {
+	_, err := bot.Send(&tele.Chat{ID: conversation.key.ChatId}, ReplaceForMarkdownV2("操作已超时，请重新开始"))
+	if err != nil {
+		log.Warn("发送对话超时提醒失败: ", err)
+	}
+}
+
+func CancelHandler(c tele.Context) error {
+	if conversations.Cancel(c) {
+		return c.Send("已取消当前操作")
+	}
+	return c.Send("当前没有进行中的操作")
+}
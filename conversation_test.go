@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+func TestConversationSteps(t *testing.T) {
+	manager := NewConversationManager(time.Minute)
+	steps := make([]string, 0)
+	var second ConversationStep = func(c tele.Context, conversation *Conversation) error {
+		steps = append(steps, "second:"+c.Text())
+		manager.End(conversation)
+		return nil
+	}
+	manager.Start(newFakeContext(1, 10, "/start"), "test", func(c tele.Context, conversation *Conversation) error {
+		steps = append(steps, "first:"+c.Text())
+		conversation.Data["first"] = c.Text()
+		manager.Next(conversation, second)
+		return nil
+	})
+
+	for _, text := range []string{"a", "b", "c"} {
+		_, _ = manager.Handle(newFakeContext(1, 10, text))
+	}
+	// 第二步结束对话后，后续消息不再交给对话处理
+	if strings.Join(steps, ",") != "first:a,second:b" {
+		t.Errorf("对话步骤 = %v", steps)
+	}
+}
+
+func TestConversationKeyedByChatAndUser(t *testing.T) {
+	manager := NewConversationManager(time.Minute)
+	handled := make([]int64, 0)
+	manager.Start(newFakeContext(1, 10, "/start"), "test", func(c tele.Context, conversation *Conversation) error {
+		handled = append(handled, c.Chat().ID)
+		return nil
+	})
+
+	// 同一用户在其他会话中、同一会话中的其他用户都不属于该对话
+	for _, c := range []*fakeContext{newFakeContext(2, 10, "x"), newFakeContext(1, 11, "x")} {
+		if ok, _ := manager.Handle(c); ok {
+			t.Errorf("会话 %d 用户 %d 的消息不应被对话处理", c.Chat().ID, c.Sender().ID)
+		}
+	}
+	if ok, _ := manager.Handle(newFakeContext(1, 10, "x")); !ok || len(handled) != 1 {
+		t.Error("对话中的消息应当被处理")
+	}
+}
+
+func TestConversationCancel(t *testing.T) {
+	manager := NewConversationManager(time.Minute)
+	manager.Start(newFakeContext(1, 10, "/start"), "test", func(c tele.Context, conversation *Conversation) error {
+		return nil
+	})
+
+	if manager.Cancel(newFakeContext(1, 11, "/cancel")) {
+		t.Error("其他用户不能取消该对话")
+	}
+	if !manager.Cancel(newFakeContext(1, 10, "/cancel")) {
+		t.Error("应当取消进行中的对话")
+	}
+	if manager.Cancel(newFakeContext(1, 10, "/cancel")) {
+		t.Error("对话已取消，不应再次取消")
+	}
+	if ok, _ := manager.Handle(newFakeContext(1, 10, "x")); ok {
+		t.Error("已取消的对话不应继续处理消息")
+	}
+}
+
+func TestConversationExpire(t *testing.T) {
+	manager := NewConversationManager(200 * time.Millisecond)
+	expired := make(chan *Conversation, 2)
+	manager.OnExpire = func(conversation *Conversation) {
+		expired <- conversation
+	}
+
+	var step ConversationStep
+	step = func(c tele.Context, conversation *Conversation) error {
+		manager.Next(conversation, step)
+		return nil
+	}
+	conversation := manager.Start(newFakeContext(1, 10, "/start"), "test", step)
+	// 每次回复都会重新计算超时时间
+	for range 3 {
+		time.Sleep(100 * time.Millisecond)
+		if ok, _ := manager.Handle(newFakeContext(1, 10, "x")); !ok {
+			t.Fatal("对话不应在回复后超时")
+		}
+	}
+
+	select {
+	case actual := <-expired:
+		if actual != conversation {
+			t.Errorf("超时的对话 = %+v", actual)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("对话应当超时结束")
+	}
+	if ok, _ := manager.Handle(newFakeContext(1, 10, "x")); ok {
+		t.Error("超时的对话不应继续处理消息")
+	}
+
+	// 被新对话替换或主动结束的对话不会再触发超时
+	replaced := manager.Start(newFakeContext(1, 10, "/start"), "test", step)
+	manager.End(manager.Start(newFakeContext(1, 10, "/start"), "test", step))
+	time.Sleep(400 * time.Millisecond)
+	select {
+	case actual := <-expired:
+		t.Errorf("已结束的对话 %p 不应超时，被替换的对话为 %p", actual, replaced)
+	default:
+	}
+}
@@ -2,49 +2,87 @@ package main
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"github.com/jmoiron/sqlx"
 	log "github.com/sirupsen/logrus"
-	_ "modernc.org/sqlite"
+	"time"
 )
 
-const bwgApiKeySchema = `
-	CREATE TABLE IF NOT EXISTS bwg_api_key (
-		pid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
-		user_id integer NOT NULL,
-		veid text(200) NOT NULL,
-		api_key text(200) NOT NULL);
-	CREATE UNIQUE INDEX uniq_user_id ON bwg_api_key (user_id ASC);
-`
-
-const xrayUserStatsSchema = `
-	CREATE TABLE IF NOT EXISTS xray_user_stats (
-		pid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
-		user text(20) NOT NULL,
-		date text(30) NOT NULL,
-		time text(10) NOT NULL,
-		down integer NOT NULL,
-		up integer NOT NULL);
-`
-
-const xrayLogSchema = `
-	CREATE TABLE IF NOT EXISTS xray_log (
-		pid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
-		user text NOT NULL,
-		ip text NOT NULL,
-		target text NOT NULL,
-		inbound text NOT NULL,
-		outbound text NOT NULL,
-		timestamp DATETIME NOT NULL);
-`
-
-var db *sqlx.DB
-
 type BwgApiKey struct {
 	Pid    int64  `db:"pid"`
 	UserId int64  `db:"user_id"`
 	Veid   string `db:"veid"`
 	ApiKey string `db:"api_key"`
+	Alias  string `db:"alias"`
+}
+
+type BwgPowerAction struct {
+	Pid          int64  `db:"pid"`
+	UserId       int64  `db:"user_id"`
+	Username     string `db:"username"`
+	BwgApiKeyPid int64  `db:"bwg_api_key_pid"`
+	Alias        string `db:"alias"`
+	// Veid 与 bwg_api_key 相同，为加密后的密文
+	Veid       string    `db:"veid"`
+	Action     string    `db:"action"`
+	Result     string    `db:"result"`
+	CreateTime time.Time `db:"create_time"`
+}
+
+type BwgAlertState struct {
+	Pid             int64     `db:"pid"`
+	BwgApiKeyPid    int64     `db:"bwg_api_key_pid"`
+	DataNextReset   int64     `db:"data_next_reset"`
+	NotifiedPercent int       `db:"notified_percent"`
+	ResetReminded   bool      `db:"reset_reminded"`
+	UpdateTime      time.Time `db:"update_time"`
+}
+
+type BwgUsageSnapshot struct {
+	Pid             int64     `db:"pid"`
+	BwgApiKeyPid    int64     `db:"bwg_api_key_pid"`
+	DataCounter     int64     `db:"data_counter"`
+	PlanMonthlyData int64     `db:"plan_monthly_data"`
+	DataNextReset   int64     `db:"data_next_reset"`
+	CreateTime      time.Time `db:"create_time"`
+}
+
+type AuditEvent struct {
+	Pid        int64     `db:"pid"`
+	UserId     int64     `db:"user_id"`
+	Event      string    `db:"event"`
+	Detail     string    `db:"detail"`
+	CreateTime time.Time `db:"create_time"`
+}
+
+type CommandAudit struct {
+	Pid        int64     `db:"pid"`
+	UserId     int64     `db:"user_id"`
+	Username   string    `db:"username"`
+	ChatId     int64     `db:"chat_id"`
+	Command    string    `db:"command"`
+	Args       string    `db:"args"`
+	Outcome    string    `db:"outcome"`
+	Error      string    `db:"error"`
+	LatencyMs  int64     `db:"latency_ms"`
+	CreateTime time.Time `db:"create_time"`
+}
+
+type RateLimitMute struct {
+	Pid        int64     `db:"pid"`
+	UserId     int64     `db:"user_id"`
+	MutedUntil time.Time `db:"muted_until"`
+	UpdateTime time.Time `db:"update_time"`
+}
+
+type XrayDigestSubscription struct {
+	Pid        int64     `db:"pid"`
+	UserId     int64     `db:"user_id"`
+	Digest     string    `db:"digest"`
+	Enabled    bool      `db:"enabled"`
+	UpdateTime time.Time `db:"update_time"`
 }
 
 type XrayUserStats struct {
@@ -56,49 +94,86 @@ type XrayUserStats struct {
 	Up   int64  `db:"up" json:"up"`
 }
 
-func InitSqlite() {
-	db, _ = sqlx.Open("sqlite", "./telegram.db")
+// XrayLogRecord 导出时读取的访问日志
+type XrayLogRecord struct {
+	User      string    `db:"user"`
+	IP        string    `db:"ip"`
+	Target    string    `db:"target"`
+	Inbound   string    `db:"inbound"`
+	Outbound  string    `db:"outbound"`
+	Timestamp time.Time `db:"timestamp"`
+}
+
+// 以下为 SQLite 和 PostgreSQL 共用的实现，查询使用 ? 占位符并通过 Rebind 转换，
+// user、date、time 和 timestamp 列加引号以兼容 PostgreSQL
 
-	var name string
-	err := db.Get(&name, "SELECT name FROM sqlite_master WHERE type = 'table' AND name = 'bwg_api_key'")
+// eachRow 逐行读取查询结果，导出大量数据时不需要全部加载到内存
+func eachRow[T any](db *sqlx.DB, fn func(row *T) error, query string, args ...any) error {
+	rows, err := db.Queryx(db.Rebind(query), args...)
 	if err != nil {
-		log.Info("初始化搬瓦工 KEY 数据库...")
-		_, _ = db.Exec(bwgApiKeySchema)
-		log.Info("初始化搬瓦工 KEY 数据库完成")
+		return err
 	}
+	defer rows.Close()
+	for rows.Next() {
+		row := new(T)
+		if err := rows.StructScan(row); err != nil {
+			return err
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+type sqlBwgKeyRepository struct {
+	db *sqlx.DB
+}
 
-	err = db.Get(&name, "SELECT name FROM sqlite_master WHERE type = 'table' AND name = 'xray_user_stats'")
+func (r *sqlBwgKeyRepository) SelectByUserId(userId int64) (*[]BwgApiKey, error) {
+	bwgApiKeys := make([]BwgApiKey, 0)
+	err := r.db.Select(&bwgApiKeys, r.db.Rebind("select pid, user_id, veid, api_key, alias from bwg_api_key where user_id = ? order by pid"), userId)
 	if err != nil {
-		log.Info("初始化 Xray 用户信息数据库...")
-		_, _ = db.Exec(xrayUserStatsSchema)
-		log.Info("初始化 Xray 用户信息数据库完成")
+		return nil, err
 	}
+	return &bwgApiKeys, nil
+}
 
-	err = db.Get(&name, "SELECT name FROM sqlite_master WHERE type = 'table' AND name = 'xray_log'")
+func (r *sqlBwgKeyRepository) SelectAll() (*[]BwgApiKey, error) {
+	bwgApiKeys := make([]BwgApiKey, 0)
+	err := r.db.Select(&bwgApiKeys, "select pid, user_id, veid, api_key, alias from bwg_api_key order by pid")
 	if err != nil {
-		log.Info("初始化 Xray 日志数据库...")
-		_, _ = db.Exec(xrayLogSchema)
-		log.Info("初始化 Xray 日志数据库完成")
+		return nil, err
 	}
+	return &bwgApiKeys, nil
 }
 
-func SelectBwgKeyByUserId(userId int64) (*BwgApiKey, error) {
-	if &userId == nil {
-		return nil, errors.New("userId 不可为空")
+func (r *sqlBwgKeyRepository) SelectByUserIdAndAlias(userId int64, alias string) (*BwgApiKey, error) {
+	if len(alias) == 0 {
+		return nil, errors.New("alias 不可为空")
+	}
+	bwgApiKey := BwgApiKey{}
+	err := r.db.Get(&bwgApiKey, r.db.Rebind("select pid, user_id, veid, api_key, alias from bwg_api_key where user_id = ? and alias = ?"), userId, alias)
+	if err != nil {
+		return nil, err
 	}
+	return &bwgApiKey, nil
+}
+
+func (r *sqlBwgKeyRepository) SelectByPid(pid int64) (*BwgApiKey, error) {
 	bwgApiKey := BwgApiKey{}
-	err := db.Get(&bwgApiKey, "select pid, user_id, veid, api_key from bwg_api_key where user_id = ?", userId)
+	err := r.db.Get(&bwgApiKey, r.db.Rebind("select pid, user_id, veid, api_key, alias from bwg_api_key where pid = ?"), pid)
 	if err != nil {
 		return nil, err
 	}
 	return &bwgApiKey, nil
 }
 
-func InsertBwgKey(bwgApiKey *BwgApiKey) error {
+func (r *sqlBwgKeyRepository) Insert(bwgApiKey *BwgApiKey) error {
 	if bwgApiKey == nil {
 		return nil
 	}
-	_, err := db.Exec("insert into bwg_api_key (user_id, veid, api_key) VALUES (?, ?, ?)", bwgApiKey.UserId, bwgApiKey.Veid, bwgApiKey.ApiKey)
+	_, err := r.db.Exec(r.db.Rebind("insert into bwg_api_key (user_id, veid, api_key, alias) VALUES (?, ?, ?, ?)"), bwgApiKey.UserId, bwgApiKey.Veid, bwgApiKey.ApiKey, bwgApiKey.Alias)
 	if err != nil {
 		log.Warn("插入 bwg_api_key 错误, err: ", err)
 		return err
@@ -106,11 +181,11 @@ func InsertBwgKey(bwgApiKey *BwgApiKey) error {
 	return nil
 }
 
-func UpdateBwgKeyByUserId(bwgApiKey *BwgApiKey) error {
+func (r *sqlBwgKeyRepository) UpdateByUserIdAndAlias(bwgApiKey *BwgApiKey) error {
 	if bwgApiKey == nil {
 		return nil
 	}
-	_, err := db.Exec("update bwg_api_key set veid = ?, api_key = ? where user_id = ?", bwgApiKey.Veid, bwgApiKey.ApiKey, bwgApiKey.UserId)
+	_, err := r.db.Exec(r.db.Rebind("update bwg_api_key set veid = ?, api_key = ? where user_id = ? and alias = ?"), bwgApiKey.Veid, bwgApiKey.ApiKey, bwgApiKey.UserId, bwgApiKey.Alias)
 	if err != nil {
 		log.Warn("更新 bwg_api_key 错误, err: ", err)
 		return err
@@ -118,42 +193,247 @@ func UpdateBwgKeyByUserId(bwgApiKey *BwgApiKey) error {
 	return nil
 }
 
-func SelectXrayUserStatsByDate(date string) (*[]XrayUserStats, error) {
+func (r *sqlBwgKeyRepository) DeleteByUserIdAndAlias(userId int64, alias string) (int64, error) {
+	result, err := r.db.Exec(r.db.Rebind("delete from bwg_api_key where user_id = ? and alias = ?"), userId, alias)
+	if err != nil {
+		log.Warn("删除 bwg_api_key 错误, err: ", err)
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// RekeySecrets 任一条失败则全部回滚
+func (r *sqlBwgKeyRepository) RekeySecrets(rekey func(userId int64, ciphertext string) (string, bool, error)) (int, int, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	bwgApiKeys := make([]BwgApiKey, 0)
+	if err = tx.Select(&bwgApiKeys, "select pid, user_id, veid, api_key, alias from bwg_api_key"); err != nil {
+		return 0, 0, err
+	}
+	keyCount := 0
+	for _, bwgApiKey := range bwgApiKeys {
+		veid, veidChanged, err := rekey(bwgApiKey.UserId, bwgApiKey.Veid)
+		if err != nil {
+			return 0, 0, fmt.Errorf("bwg_api_key pid %d: %w", bwgApiKey.Pid, err)
+		}
+		apiKey, apiKeyChanged, err := rekey(bwgApiKey.UserId, bwgApiKey.ApiKey)
+		if err != nil {
+			return 0, 0, fmt.Errorf("bwg_api_key pid %d: %w", bwgApiKey.Pid, err)
+		}
+		if !veidChanged && !apiKeyChanged {
+			continue
+		}
+		if _, err = tx.Exec(tx.Rebind("update bwg_api_key set veid = ?, api_key = ? where pid = ?"), veid, apiKey, bwgApiKey.Pid); err != nil {
+			return 0, 0, err
+		}
+		keyCount++
+	}
+
+	powerActions := make([]BwgPowerAction, 0)
+	if err = tx.Select(&powerActions, "select pid, user_id, veid from bwg_power_action"); err != nil {
+		return 0, 0, err
+	}
+	actionCount := 0
+	for _, powerAction := range powerActions {
+		veid, changed, err := rekey(powerAction.UserId, powerAction.Veid)
+		if err != nil {
+			return 0, 0, fmt.Errorf("bwg_power_action pid %d: %w", powerAction.Pid, err)
+		}
+		if !changed {
+			continue
+		}
+		if _, err = tx.Exec(tx.Rebind("update bwg_power_action set veid = ? where pid = ?"), veid, powerAction.Pid); err != nil {
+			return 0, 0, err
+		}
+		actionCount++
+	}
+
+	return keyCount, actionCount, tx.Commit()
+}
+
+type sqlBwgStateRepository struct {
+	db *sqlx.DB
+}
+
+func (r *sqlBwgStateRepository) InsertPowerAction(bwgPowerAction *BwgPowerAction) error {
+	if bwgPowerAction == nil {
+		return nil
+	}
+	_, err := r.db.NamedExec(`
+		INSERT INTO bwg_power_action (user_id, username, bwg_api_key_pid, alias, veid, action, result, create_time)
+		VALUES (:user_id, :username, :bwg_api_key_pid, :alias, :veid, :action, :result, :create_time)
+	`, bwgPowerAction)
+	if err != nil {
+		log.Warn("插入 bwg_power_action 错误, err: ", err)
+		return err
+	}
+	return nil
+}
+
+func (r *sqlBwgStateRepository) SelectAlertStateByKeyPid(bwgApiKeyPid int64) (*BwgAlertState, error) {
+	bwgAlertState := &BwgAlertState{}
+	err := r.db.Get(bwgAlertState, r.db.Rebind("select pid, bwg_api_key_pid, data_next_reset, notified_percent, reset_reminded, update_time from bwg_alert_state where bwg_api_key_pid = ?"), bwgApiKeyPid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return bwgAlertState, nil
+}
+
+func (r *sqlBwgStateRepository) SaveAlertState(bwgAlertState *BwgAlertState) error {
+	if bwgAlertState == nil {
+		return nil
+	}
+	_, err := r.db.NamedExec(`
+		INSERT INTO bwg_alert_state (bwg_api_key_pid, data_next_reset, notified_percent, reset_reminded, update_time)
+		VALUES (:bwg_api_key_pid, :data_next_reset, :notified_percent, :reset_reminded, :update_time)
+		ON CONFLICT (bwg_api_key_pid) DO UPDATE SET data_next_reset = excluded.data_next_reset,
+			notified_percent = excluded.notified_percent, reset_reminded = excluded.reset_reminded, update_time = excluded.update_time
+	`, bwgAlertState)
+	if err != nil {
+		log.Warn("保存 bwg_alert_state 错误, err: ", err)
+		return err
+	}
+	return nil
+}
+
+func (r *sqlBwgStateRepository) DeleteAlertStateByKeyPid(bwgApiKeyPid int64) error {
+	_, err := r.db.Exec(r.db.Rebind("delete from bwg_alert_state where bwg_api_key_pid = ?"), bwgApiKeyPid)
+	return err
+}
+
+func (r *sqlBwgStateRepository) InsertUsageSnapshot(bwgUsageSnapshot *BwgUsageSnapshot) error {
+	if bwgUsageSnapshot == nil {
+		return nil
+	}
+	_, err := r.db.NamedExec(`
+		INSERT INTO bwg_usage_snapshot (bwg_api_key_pid, data_counter, plan_monthly_data, data_next_reset, create_time)
+		VALUES (:bwg_api_key_pid, :data_counter, :plan_monthly_data, :data_next_reset, :create_time)
+	`, bwgUsageSnapshot)
+	return err
+}
+
+func (r *sqlBwgStateRepository) SelectUsageSnapshotsByKeyPidSince(bwgApiKeyPid int64, since time.Time) (*[]BwgUsageSnapshot, error) {
+	snapshots := make([]BwgUsageSnapshot, 0)
+	err := r.db.Select(&snapshots, r.db.Rebind(`
+		select pid, bwg_api_key_pid, data_counter, plan_monthly_data, data_next_reset, create_time
+		from bwg_usage_snapshot where bwg_api_key_pid = ? and create_time >= ? order by create_time
+	`), bwgApiKeyPid, since)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshots, nil
+}
+
+func (r *sqlBwgStateRepository) DeleteUsageSnapshotsBefore(before time.Time) error {
+	_, err := r.db.Exec(r.db.Rebind("delete from bwg_usage_snapshot where create_time < ?"), before)
+	return err
+}
+
+type sqlXrayStatsRepository struct {
+	db *sqlx.DB
+}
+
+func (r *sqlXrayStatsRepository) SelectByDate(date string) (*[]XrayUserStats, error) {
 	if len(date) == 0 {
 		return nil, errors.New("时间不可为空")
 	}
 	xrayUserStatsList := make([]XrayUserStats, 0)
-	err := db.Select(&xrayUserStatsList, "select pid, user, date, time, down, up from xray_user_stats where date = ?", date)
+	err := r.db.Select(&xrayUserStatsList, r.db.Rebind(`select pid, "user", "date", "time", down, up from xray_user_stats where "date" = ?`), date)
 	if err != nil {
 		return nil, err
 	}
 	return &xrayUserStatsList, nil
 }
 
-func InsertXrayUserStats(xrayUserStats *XrayUserStats) error {
+func (r *sqlXrayStatsRepository) EachByDateRange(from string, to string, fn func(xrayUserStats *XrayUserStats) error) error {
+	return eachRow(r.db, fn, `select pid, "user", "date", "time", down, up from xray_user_stats where "date" >= ? and "date" <= ? order by "date", "time", "user"`, from, to)
+}
+
+func (r *sqlXrayStatsRepository) EachDailyByDateRange(from string, to string, fn func(xrayUserStats *XrayUserStats) error) error {
+	return eachRow(r.db, fn, `
+		select 0 as pid, "user", "date", '' as "time", sum(down) as down, sum(up) as up from xray_user_stats
+		where "date" >= ? and "date" <= ? group by "date", "user" order by "date", "user"
+	`, from, to)
+}
+
+func (r *sqlXrayStatsRepository) SelectUserTotalsByDateRange(from string, to string) (*[]Traffic, error) {
+	traffics := make([]Traffic, 0)
+	err := r.db.Select(&traffics, r.db.Rebind(`
+		select "user", sum(down) as down, sum(up) as up from xray_user_stats
+		where "date" >= ? and "date" <= ? group by "user" order by sum(down) + sum(up) desc
+	`), from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &traffics, nil
+}
+
+func (r *sqlXrayStatsRepository) SelectByDateRange(from string, to string) (*[]XrayUserStats, error) {
+	if len(from) == 0 || len(to) == 0 {
+		return nil, errors.New("时间不可为空")
+	}
+	xrayUserStatsList := make([]XrayUserStats, 0)
+	err := r.db.Select(&xrayUserStatsList, r.db.Rebind(`select pid, "user", "date", "time", down, up from xray_user_stats where "date" >= ? and "date" <= ? order by "date", "time"`), from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &xrayUserStatsList, nil
+}
+
+func (r *sqlXrayStatsRepository) SelectByUserAndDateRange(user string, from string, to string) (*[]XrayUserStats, error) {
+	if len(from) == 0 || len(to) == 0 {
+		return nil, errors.New("时间不可为空")
+	}
+	xrayUserStatsList := make([]XrayUserStats, 0)
+	err := r.db.Select(&xrayUserStatsList, r.db.Rebind(`select pid, "user", "date", "time", down, up from xray_user_stats where "user" = ? and "date" >= ? and "date" <= ? order by "date", "time"`), user, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &xrayUserStatsList, nil
+}
+
+func (r *sqlXrayStatsRepository) SelectByTimeAndDateRange(time string, from string, to string) (*[]XrayUserStats, error) {
+	if len(from) == 0 || len(to) == 0 {
+		return nil, errors.New("时间不可为空")
+	}
+	xrayUserStatsList := make([]XrayUserStats, 0)
+	err := r.db.Select(&xrayUserStatsList, r.db.Rebind(`select pid, "user", "date", "time", down, up from xray_user_stats where "time" = ? and "date" >= ? and "date" <= ?`), time, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &xrayUserStatsList, nil
+}
+
+func (r *sqlXrayStatsRepository) Insert(xrayUserStats *XrayUserStats) error {
 	if xrayUserStats == nil {
 		return nil
 	}
 
-	_, err := db.NamedExec("INSERT INTO xray_user_stats (user, date, time, down, up) VALUES (:user, :date, :time, :down, :up)", xrayUserStats)
+	_, err := r.db.NamedExec(`INSERT INTO xray_user_stats ("user", "date", "time", down, up) VALUES (:user, :date, :time, :down, :up)`, xrayUserStats)
 	return err
 }
 
-func UpdateXrayUserStats(xrayUserStats *XrayUserStats) error {
+func (r *sqlXrayStatsRepository) Update(xrayUserStats *XrayUserStats) error {
 	if xrayUserStats == nil {
 		return nil
 	}
-	_, err := db.Exec("update xray_user_stats set down = ?, up = ? where user = ? and date = ? and time = ?",
+	_, err := r.db.Exec(r.db.Rebind(`update xray_user_stats set down = ?, up = ? where "user" = ? and "date" = ? and "time" = ?`),
 		xrayUserStats.Down, xrayUserStats.Up, xrayUserStats.User, xrayUserStats.Date, xrayUserStats.Time)
 	return err
 }
 
-func SelectXrayUserStatsByUserAndDateTime(user string, date string, time string) (*XrayUserStats, error) {
+func (r *sqlXrayStatsRepository) SelectByUserAndDateTime(user string, date string, time string) (*XrayUserStats, error) {
 	if len(date) == 0 {
 		return nil, errors.New("时间不可为空")
 	}
 	xrayUserStats := &XrayUserStats{}
-	err := db.Get(xrayUserStats, "select pid, user, date, time, down, up from xray_user_stats where user = ? and date = ? and time = ?", user, date, time)
+	err := r.db.Get(xrayUserStats, r.db.Rebind(`select pid, "user", "date", "time", down, up from xray_user_stats where "user" = ? and "date" = ? and "time" = ?`), user, date, time)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	} else if err != nil {
@@ -162,17 +442,150 @@ func SelectXrayUserStatsByUserAndDateTime(user string, date string, time string)
 	return xrayUserStats, nil
 }
 
-func InsertXrayLog(xrayLog *XrayLog) error {
+func (r *sqlXrayStatsRepository) SelectDigestSubscriptionsByUserId(userId int64) (*[]XrayDigestSubscription, error) {
+	subscriptions := make([]XrayDigestSubscription, 0)
+	err := r.db.Select(&subscriptions, r.db.Rebind("select pid, user_id, digest, enabled, update_time from xray_digest_subscription where user_id = ?"), userId)
+	if err != nil {
+		return nil, err
+	}
+	return &subscriptions, nil
+}
+
+func (r *sqlXrayStatsRepository) SaveDigestSubscription(subscription *XrayDigestSubscription) error {
+	if subscription == nil {
+		return nil
+	}
+	_, err := r.db.NamedExec(`
+		INSERT INTO xray_digest_subscription (user_id, digest, enabled, update_time)
+		VALUES (:user_id, :digest, :enabled, :update_time)
+		ON CONFLICT (user_id, digest) DO UPDATE SET enabled = excluded.enabled, update_time = excluded.update_time
+	`, subscription)
+	if err != nil {
+		log.Warn("保存 xray_digest_subscription 错误, err: ", err)
+		return err
+	}
+	return nil
+}
+
+type sqlXrayLogRepository struct {
+	db *sqlx.DB
+}
+
+func (r *sqlXrayLogRepository) Insert(xrayLog *XrayLog) error {
 	if xrayLog == nil {
 		return nil
 	}
 
 	insertSQL := `
 		INSERT INTO xray_log 
-		    (user, ip, target, inbound, outbound, timestamp)
+		    ("user", ip, target, inbound, outbound, "timestamp")
 		VALUES 
 		    (:user, :ip, :target, :inbound, :outbound, :timestamp)
 	`
-	_, err := db.NamedExec(insertSQL, xrayLog)
+	_, err := r.db.NamedExec(insertSQL, xrayLog)
 	return err
 }
+
+func (r *sqlXrayLogRepository) EachByTimeRange(from time.Time, to time.Time, fn func(xrayLog *XrayLogRecord) error) error {
+	return eachRow(r.db, fn, `select "user", ip, target, inbound, outbound, "timestamp" from xray_log where "timestamp" >= ? and "timestamp" < ? order by "timestamp"`, from, to)
+}
+
+type sqlAuditRepository struct {
+	db *sqlx.DB
+}
+
+func (r *sqlAuditRepository) InsertEvent(auditEvent *AuditEvent) error {
+	if auditEvent == nil {
+		return nil
+	}
+	_, err := r.db.NamedExec(`
+		INSERT INTO audit_event (user_id, event, detail, create_time)
+		VALUES (:user_id, :event, :detail, :create_time)
+	`, auditEvent)
+	if err != nil {
+		log.Warn("插入 audit_event 错误, err: ", err)
+		return err
+	}
+	return nil
+}
+
+func (r *sqlAuditRepository) InsertCommand(commandAudit *CommandAudit) error {
+	if commandAudit == nil {
+		return nil
+	}
+	_, err := r.db.NamedExec(`
+		INSERT INTO command_audit (user_id, username, chat_id, command, args, outcome, error, latency_ms, create_time)
+		VALUES (:user_id, :username, :chat_id, :command, :args, :outcome, :error, :latency_ms, :create_time)
+	`, commandAudit)
+	if err != nil {
+		log.Warn("插入 command_audit 错误, err: ", err)
+		return err
+	}
+	return nil
+}
+
+func (r *sqlAuditRepository) SelectCommands(userId int64, since time.Time, limit int) (*[]CommandAudit, error) {
+	query, args := "create_time >= ?", []any{since}
+	if userId != 0 {
+		query, args = "user_id = ? and create_time >= ?", []any{userId, since}
+	}
+	commandAudits := make([]CommandAudit, 0)
+	err := r.db.Select(&commandAudits, r.db.Rebind(`
+		select pid, user_id, username, chat_id, command, args, outcome, error, latency_ms, create_time from command_audit
+		where `+query+` order by create_time desc, pid desc limit ?
+	`), append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	return &commandAudits, nil
+}
+
+type sqlRateLimitMuteRepository struct {
+	db *sqlx.DB
+}
+
+func (r *sqlRateLimitMuteRepository) Save(rateLimitMute *RateLimitMute) error {
+	if rateLimitMute == nil {
+		return nil
+	}
+	_, err := r.db.NamedExec(`
+		INSERT INTO rate_limit_mute (user_id, muted_until, update_time)
+		VALUES (:user_id, :muted_until, :update_time)
+		ON CONFLICT (user_id) DO UPDATE SET muted_until = excluded.muted_until, update_time = excluded.update_time
+	`, rateLimitMute)
+	if err != nil {
+		log.Warn("保存 rate_limit_mute 错误, err: ", err)
+		return err
+	}
+	return nil
+}
+
+func (r *sqlRateLimitMuteRepository) SelectActive(now time.Time) (*[]RateLimitMute, error) {
+	rateLimitMutes := make([]RateLimitMute, 0)
+	err := r.db.Select(&rateLimitMutes, r.db.Rebind("select pid, user_id, muted_until, update_time from rate_limit_mute where muted_until > ?"), now)
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimitMutes, nil
+}
+
+type sqlKeyringRepository struct {
+	db *sqlx.DB
+}
+
+func (r *sqlKeyringRepository) LoadOrCreateSalt(generated []byte) ([]byte, error) {
+	// 多个进程同时首次启动时只有一个盐会被保存，都以查询到的为准
+	_, err := r.db.Exec(r.db.Rebind(`
+		INSERT INTO keyring_salt (pid, salt, create_time) VALUES (1, ?, ?)
+		ON CONFLICT (pid) DO NOTHING
+	`), base64.StdEncoding.EncodeToString(generated), time.Now())
+	if err != nil {
+		log.Warn("保存 keyring_salt 错误, err: ", err)
+		return nil, err
+	}
+	var encoded string
+	if err := r.db.Get(&encoded, "select salt from keyring_salt where pid = 1"); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(encoded)
+}
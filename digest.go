@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	tele "gopkg.in/telebot.v3"
+	"strings"
+	"time"
+)
+
+type XrayDigest = string
+
+const (
+	DailyDigest   XrayDigest = "daily"
+	WeeklyDigest  XrayDigest = "weekly"
+	MonthlyDigest XrayDigest = "monthly"
+)
+
+type XrayDigestJob struct {
+	digest XrayDigest
+	name   string
+	// 从配置中取出推送时间
+	cron func(config XrayDigestConfig) string
+	// 根据推送时间计算报告的统计周期
+	query func(now time.Time) XrayStatsQuery
+}
+
+var xrayDigestJobs = []XrayDigestJob{
+	{DailyDigest, "每日流量摘要", func(config XrayDigestConfig) string { return config.DailyCron }, func(now time.Time) XrayStatsQuery {
+		return XrayStatsQuery{Scope: XrayStatsDay, Date: now.AddDate(0, 0, -1)}
+	}},
+	{WeeklyDigest, "每周流量摘要", func(config XrayDigestConfig) string { return config.WeeklyCron }, func(now time.Time) XrayStatsQuery {
+		return XrayStatsQuery{Scope: XrayStatsWeek, Date: now.AddDate(0, 0, -7)}
+	}},
+	{MonthlyDigest, "月度流量报告", func(config XrayDigestConfig) string { return config.MonthlyCron }, func(now time.Time) XrayStatsQuery {
+		// 上个月的最后一天
+		return XrayStatsQuery{Scope: XrayStatsMonth, Date: time.Date(now.Year(), now.Month(), 0, 0, 0, 0, 0, time.Local)}
+	}},
+}
+
+func AddDigestJobs(scheduler *cron.Cron, config XrayDigestConfig) error {
+	for _, job := range xrayDigestJobs {
+		_, err := scheduler.AddFunc(job.cron(config), func() {
+			PushXrayDigest(job)
+		})
+		if err != nil {
+			return fmt.Errorf("添加%s定时任务失败: %w", job.name, err)
+		}
+	}
+	return nil
+}
+
+// PushXrayDigest 向所有订阅了该摘要的管理员推送流量报告
+func PushXrayDigest(job XrayDigestJob) {
+	query := job.query(time.Now())
+	for _, admin := range XrayStatsAdmins() {
+		subscribed, err := IsXrayDigestSubscribed(admin, job.digest)
+		if err != nil {
+			log.WithField("component", "digest").Error("查询流量摘要订阅异常", err)
+			continue
+		}
+		if !subscribed {
+			continue
+		}
+
+		reply, markup, err := renderXrayStats(admin, query)
+		if err != nil {
+			log.WithField("component", "digest").Errorf("生成%s异常: %v", job.name, err)
+			continue
+		}
+
+		message := fmt.Sprintf("*%s*\n%s", ReplaceForMarkdownV2(job.name), reply)
+		if _, err := bot.Send(&tele.User{ID: admin}, message, markup); err != nil {
+			log.WithField("component", "digest").Errorf("推送%s异常: %v", job.name, err)
+		}
+	}
+}
+
+// IsXrayDigestSubscribed 未设置过订阅状态时管理员默认订阅，可以使用 /unsubscribe 取消
+func IsXrayDigestSubscribed(userId int64, digest XrayDigest) (bool, error) {
+	subscriptions, err := store.XrayStats.SelectDigestSubscriptionsByUserId(userId)
+	if err != nil {
+		return false, err
+	}
+	for _, subscription := range *subscriptions {
+		if subscription.Digest == digest {
+			return subscription.Enabled, nil
+		}
+	}
+	return IsXrayStatsAdmin(userId), nil
+}
+
+func SubscribeHandler(c tele.Context) error {
+	return updateXrayDigestSubscription(c, true)
+}
+
+func UnsubscribeHandler(c tele.Context) error {
+	return updateXrayDigestSubscription(c, false)
+}
+
+func updateXrayDigestSubscription(c tele.Context, enabled bool) error {
+	userId := c.Sender().ID
+	if !IsXrayStatsAdmin(userId) {
+		return replyFailure(c, "无订阅权限")
+	}
+
+	args := c.Args()
+	if len(args) > 0 {
+		digests := make([]XrayDigest, 0, len(xrayDigestJobs))
+		for _, arg := range args {
+			arg = strings.ToLower(arg)
+			if arg == "all" {
+				digests = digests[:0]
+				for _, job := range xrayDigestJobs {
+					digests = append(digests, job.digest)
+				}
+				break
+			}
+			if !isXrayDigest(arg) {
+				return replyFailure(c, ReplaceForMarkdownV2(fmt.Sprintf("未知的摘要类型：%s", arg))+"\n"+xrayDigestUsage())
+			}
+			digests = append(digests, arg)
+		}
+
+		for _, digest := range digests {
+			err := store.XrayStats.SaveDigestSubscription(&XrayDigestSubscription{
+				UserId:     userId,
+				Digest:     digest,
+				Enabled:    enabled,
+				UpdateTime: time.Now(),
+			})
+			if err != nil {
+				return replyFailure(c, "*订阅修改失败*！\n请稍后再试")
+			}
+		}
+	}
+
+	reply, err := buildXrayDigestSubscriptionMessage(userId)
+	if err != nil {
+		log.WithField("component", "digest").Error("查询流量摘要订阅异常", err)
+		return replyFailure(c, "查询订阅状态失败")
+	}
+	return c.Send(reply)
+}
+
+func buildXrayDigestSubscriptionMessage(userId int64) (string, error) {
+	msgSlice := make([]string, 0)
+	msgSlice = append(msgSlice, "*流量摘要订阅状态*")
+	for _, job := range xrayDigestJobs {
+		subscribed, err := IsXrayDigestSubscribed(userId, job.digest)
+		if err != nil {
+			return "", err
+		}
+		status := "未订阅"
+		if subscribed {
+			status = "已订阅"
+		}
+		msgSlice = append(msgSlice, fmt.Sprintf("*%s* `%s`：%s", ReplaceForMarkdownV2(job.name), job.digest, status))
+	}
+	msgSlice = append(msgSlice, "", xrayDigestUsage())
+	return strings.Join(msgSlice, "\n"), nil
+}
+
+func xrayDigestUsage() string {
+	return "使用 `/subscribe daily` 或 `/unsubscribe daily` 修改订阅，`all` 表示全部"
+}
+
+func isXrayDigest(digest string) bool {
+	for _, job := range xrayDigestJobs {
+		if job.digest == digest {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestXrayDigestSubscription(t *testing.T) {
+	initTestStore(t)
+	previousConfig := currentConfig.Load()
+	previousAdmins := xrayStatsAdmins.Load()
+	t.Cleanup(func() {
+		currentConfig.Store(previousConfig)
+		xrayStatsAdmins.Store(previousAdmins)
+	})
+	currentConfig.Store(&Config{Telegram: TelegramConfig{Owner: 1}})
+	xrayStatsAdmins.Store(&[]int64{1, 2})
+
+	subscribed := func(userId int64, digest XrayDigest) bool {
+		t.Helper()
+		ok, err := IsXrayDigestSubscribed(userId, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	// 没有记录时管理员默认订阅
+	if !subscribed(1, DailyDigest) || !subscribed(2, DailyDigest) {
+		t.Fatal("未设置时管理员应当默认订阅")
+	}
+
+	if c := newFakeContext(2, 2, "/unsubscribe daily Weekly"); UnsubscribeHandler(c) != nil || !strings.Contains(c.lastSent(), "`daily`：未订阅") {
+		t.Fatalf("取消订阅后的回复 = %q", c.lastSent())
+	}
+	if subscribed(2, DailyDigest) || subscribed(2, WeeklyDigest) || !subscribed(2, MonthlyDigest) {
+		t.Fatal("应当只取消指定的摘要")
+	}
+	_ = SubscribeHandler(newFakeContext(2, 2, "/subscribe daily"))
+	if !subscribed(2, DailyDigest) || subscribed(2, WeeklyDigest) {
+		t.Fatal("重新订阅后应当推送")
+	}
+
+	// 所有者取消订阅后同样不再推送
+	_ = UnsubscribeHandler(newFakeContext(1, 1, "/unsubscribe all"))
+	for _, job := range xrayDigestJobs {
+		if subscribed(1, job.digest) {
+			t.Fatalf("%s 应当已取消订阅", job.digest)
+		}
+	}
+
+	// 未知的摘要类型不修改任何订阅
+	if c := newFakeContext(2, 2, "/unsubscribe monthly yearly"); UnsubscribeHandler(c) != nil || !strings.Contains(c.lastSent(), "未知的摘要类型") {
+		t.Fatalf("未知类型的回复 = %q", c.lastSent())
+	}
+	if !subscribed(2, MonthlyDigest) {
+		t.Fatal("参数错误时不应修改订阅")
+	}
+
+	if c := newFakeContext(3, 3, "/subscribe all"); SubscribeHandler(c) != nil || !strings.Contains(c.lastSent(), "无订阅权限") {
+		t.Fatalf("非管理员的回复 = %q", c.lastSent())
+	}
+	if subscribed(3, DailyDigest) {
+		t.Fatal("非管理员不能订阅")
+	}
+}
+
+func TestXrayDigestQuery(t *testing.T) {
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, time.Local)
+	}
+	jobs := make(map[XrayDigest]XrayDigestJob)
+	for _, job := range xrayDigestJobs {
+		jobs[job.digest] = job
+	}
+	cases := []struct {
+		digest   XrayDigest
+		now      time.Time
+		from, to time.Time
+	}{
+		// 元旦推送上一年最后一天、最后一周和 12 月
+		{DailyDigest, time.Date(2024, 1, 1, 9, 0, 0, 0, time.Local), day(2023, 12, 31), day(2023, 12, 31)},
+		{WeeklyDigest, time.Date(2024, 1, 1, 9, 0, 0, 0, time.Local), day(2023, 12, 25), day(2023, 12, 31)},
+		{MonthlyDigest, time.Date(2024, 1, 1, 9, 0, 0, 0, time.Local), day(2023, 12, 1), day(2023, 12, 31)},
+		{DailyDigest, time.Date(2024, 3, 1, 9, 0, 0, 0, time.Local), day(2024, 2, 29), day(2024, 2, 29)},
+		{MonthlyDigest, time.Date(2024, 3, 1, 9, 0, 0, 0, time.Local), day(2024, 2, 1), day(2024, 2, 29)},
+		// 推送时间不在月初时仍然是上个完整的月
+		{MonthlyDigest, time.Date(2024, 3, 31, 23, 0, 0, 0, time.Local), day(2024, 2, 1), day(2024, 2, 29)},
+	}
+	for _, c := range cases {
+		if from, to := jobs[c.digest].query(c.now).Range(); !from.Equal(c.from) || !to.Equal(c.to) {
+			t.Errorf("%s 在 %s 推送 %s ~ %s，期望 %s ~ %s", c.digest, c.now, from, to, c.from, c.to)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/xuri/excelize/v2"
+	tele "gopkg.in/telebot.v3"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	ExportFormatCsv  = "csv"
+	ExportFormatJson = "json"
+	ExportFormatXlsx = "xlsx"
+)
+
+const (
+	// 单次导出最多覆盖的天数
+	xrayExportMaxDays = 366
+	// Telegram Bot API 上传文件的大小限制
+	telegramMaxUploadSize = 50 << 20
+)
+
+// exportTable 导出文件中的一张表，XLSX 中对应一个工作表，Rows 逐行输出数据
+type exportTable struct {
+	Name    string
+	Columns []string
+	Rows    func(emit func(values ...any) error) error
+}
+
+// XrayExportRequest /xray_export 的参数，日期包含两端
+type XrayExportRequest struct {
+	From       time.Time
+	To         time.Time
+	Format     string
+	IncludeLog bool
+}
+
+func parseXrayExportArgs(args []string) (*XrayExportRequest, error) {
+	if len(args) < 2 {
+		return nil, errors.New("缺少开始日期或结束日期")
+	}
+	parseDate := func(value string) (time.Time, error) {
+		for _, layout := range []string{callbackDateFormat, DateFormat} {
+			if date, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+				return date, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("无法识别的日期：%s", value)
+	}
+
+	request := &XrayExportRequest{Format: ExportFormatCsv}
+	var err error
+	if request.From, err = parseDate(args[0]); err != nil {
+		return nil, err
+	}
+	if request.To, err = parseDate(args[1]); err != nil {
+		return nil, err
+	}
+	if request.To.Before(request.From) {
+		return nil, errors.New("结束日期不能早于开始日期")
+	}
+	if request.To.Sub(request.From) >= xrayExportMaxDays*24*time.Hour {
+		return nil, fmt.Errorf("单次最多导出 %d 天", xrayExportMaxDays)
+	}
+
+	for _, arg := range args[2:] {
+		switch arg {
+		case ExportFormatCsv, ExportFormatJson, ExportFormatXlsx:
+			request.Format = arg
+		case "log":
+			request.IncludeLog = true
+		default:
+			return nil, fmt.Errorf("无法识别的参数：%s", arg)
+		}
+	}
+	return request, nil
+}
+
+func XrayExportHandler(c tele.Context) error {
+	if !IsXrayStatsAdmin(c.Sender().ID) {
+		return replyFailure(c, "无查询权限")
+	}
+	request, err := parseXrayExportArgs(c.Args())
+	if err != nil {
+		return replyFailure(c, ReplaceForMarkdownV2(err.Error()+"\n用法：/xray_export <开始日期> <结束日期> [csv|json|xlsx] [log]\n日期格式如 20240501，加上 log 时另外导出访问日志"))
+	}
+	_ = c.Notify(tele.UploadingDocument)
+
+	from, to := request.From.Format(DateFormat), request.To.Format(DateFormat)
+	period := fmt.Sprintf("%s ~ %s", from, to)
+	if err := sendExportFile(c, fmt.Sprintf("xray_stats_%s_%s", from, to), request.Format, "Xray 流量 "+period, xrayStatsExportTables(request)...); err != nil {
+		return err
+	}
+	if request.IncludeLog {
+		return sendExportFile(c, fmt.Sprintf("xray_log_%s_%s", from, to), request.Format, "Xray 访问日志 "+period, xrayLogExportTable(request))
+	}
+	return nil
+}
+
+// xrayStatsExportTables XLSX 包含用户汇总和每日明细两个工作表，CSV 和 JSON 输出每小时的原始记录
+func xrayStatsExportTables(request *XrayExportRequest) []exportTable {
+	from, to := request.From.Format(DateFormat), request.To.Format(DateFormat)
+	if request.Format != ExportFormatXlsx {
+		return []exportTable{{
+			Name:    "流量",
+			Columns: []string{"user", "date", "time", "down", "up"},
+			Rows: func(emit func(values ...any) error) error {
+				return store.XrayStats.EachByDateRange(from, to, func(stats *XrayUserStats) error {
+					return emit(stats.User, stats.Date, stats.Time, stats.Down, stats.Up)
+				})
+			},
+		}}
+	}
+	return []exportTable{
+		{
+			Name:    "用户汇总",
+			Columns: []string{"用户", "下行（字节）", "上行（字节）", "合计（字节）"},
+			Rows: func(emit func(values ...any) error) error {
+				traffics, err := store.XrayStats.SelectUserTotalsByDateRange(from, to)
+				if err != nil {
+					return err
+				}
+				for _, traffic := range *traffics {
+					if err := emit(traffic.User, traffic.Down, traffic.Up, traffic.Down+traffic.Up); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:    "每日明细",
+			Columns: []string{"日期", "用户", "下行（字节）", "上行（字节）", "合计（字节）"},
+			Rows: func(emit func(values ...any) error) error {
+				return store.XrayStats.EachDailyByDateRange(from, to, func(stats *XrayUserStats) error {
+					return emit(stats.Date, stats.User, stats.Down, stats.Up, stats.Down+stats.Up)
+				})
+			},
+		},
+	}
+}
+
+func xrayLogExportTable(request *XrayExportRequest) exportTable {
+	return exportTable{
+		Name:    "访问日志",
+		Columns: []string{"time", "user", "ip", "target", "inbound", "outbound"},
+		Rows: func(emit func(values ...any) error) error {
+			return store.XrayLogs.EachByTimeRange(request.From, request.To.AddDate(0, 0, 1), func(xrayLog *XrayLogRecord) error {
+				return emit(xrayLog.Timestamp.Format(DateTimeFormat), xrayLog.User, xrayLog.IP, xrayLog.Target, xrayLog.Inbound, xrayLog.Outbound)
+			})
+		},
+	}
+}
+
+// sendExportFile 将数据写入临时文件后作为文件发送，发送后删除临时文件
+func sendExportFile(c tele.Context, name string, format string, caption string, tables ...exportTable) error {
+	path, err := writeExportFile(format, tables)
+	if path != "" {
+		defer os.Remove(path)
+	}
+	if err != nil {
+		log.Error("导出流量数据失败: ", err)
+		return replyFailure(c, "导出失败")
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if stat.Size() > telegramMaxUploadSize {
+		return replyFailure(c, ReplaceForMarkdownV2(fmt.Sprintf("%s 文件大小 %s，超过 Telegram 的 50MB 限制，请缩小日期范围", caption, calculateTraffic(stat.Size()))))
+	}
+	return c.Send(&tele.Document{
+		File:     tele.FromDisk(path),
+		FileName: name + "." + format,
+		Caption:  ReplaceForMarkdownV2(caption),
+	})
+}
+
+// writeExportFile 按格式写入临时文件并返回路径，出错时也会返回已创建的路径以便删除
+func writeExportFile(format string, tables []exportTable) (string, error) {
+	file, err := os.CreateTemp("", "xray_export_*."+format)
+	if err != nil {
+		return "", err
+	}
+	path := file.Name()
+
+	if format == ExportFormatXlsx {
+		_ = file.Close()
+		return path, writeXlsx(path, tables)
+	}
+
+	writer := bufio.NewWriter(file)
+	switch format {
+	case ExportFormatJson:
+		err = writeJson(writer, tables[0])
+	default:
+		err = writeCsv(writer, tables[0])
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return path, err
+}
+
+func writeCsv(w io.Writer, table exportTable) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(table.Columns); err != nil {
+		return err
+	}
+	record := make([]string, len(table.Columns))
+	err := table.Rows(func(values ...any) error {
+		for i, value := range values {
+			record[i] = fmt.Sprint(value)
+		}
+		return writer.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// writeJson 逐行输出对象数组，字段顺序与 Columns 一致
+func writeJson(w io.Writer, table exportTable) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	first := true
+	err := table.Rows(func(values ...any) error {
+		separator := ",\n"
+		if first {
+			separator, first = "\n", false
+		}
+		if _, err := io.WriteString(w, separator+"{"); err != nil {
+			return err
+		}
+		for i, value := range values {
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			field := strconv.Quote(table.Columns[i]) + ":" + string(encoded)
+			if i > 0 {
+				field = "," + field
+			}
+			if _, err := io.WriteString(w, field); err != nil {
+				return err
+			}
+		}
+		_, err := io.WriteString(w, "}")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n]\n")
+	return err
+}
+
+// writeXlsx 每张表一个工作表，使用 StreamWriter 逐行写入
+func writeXlsx(path string, tables []exportTable) error {
+	file := excelize.NewFile()
+	defer file.Close()
+
+	for i, table := range tables {
+		if i == 0 {
+			if err := file.SetSheetName(file.GetSheetName(0), table.Name); err != nil {
+				return err
+			}
+		} else if _, err := file.NewSheet(table.Name); err != nil {
+			return err
+		}
+
+		writer, err := file.NewStreamWriter(table.Name)
+		if err != nil {
+			return err
+		}
+		header := make([]any, len(table.Columns))
+		for j, column := range table.Columns {
+			header[j] = column
+		}
+		if err := writer.SetRow("A1", header); err != nil {
+			return err
+		}
+		row := 2
+		err = table.Rows(func(values ...any) error {
+			cell, err := excelize.CoordinatesToCellName(1, row)
+			if err != nil {
+				return err
+			}
+			row++
+			return writer.SetRow(cell, values)
+		})
+		if err != nil {
+			return err
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+	}
+	return file.SaveAs(path)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestParseXrayExportArgs(t *testing.T) {
+	request, err := parseXrayExportArgs([]string{"20240501", "2024-05-31", "xlsx", "log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Format != ExportFormatXlsx || !request.IncludeLog ||
+		!request.From.Equal(time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)) || !request.To.Equal(time.Date(2024, 5, 31, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("解析结果 = %+v", request)
+	}
+	if request, _ := parseXrayExportArgs([]string{"20240501", "20240501"}); request == nil || request.Format != ExportFormatCsv {
+		t.Errorf("默认格式应当为 csv: %+v", request)
+	}
+
+	for _, args := range [][]string{
+		{"20240501"},
+		{"20240531", "20240501"},
+		{"20240501", "20250601"},
+		{"20240501", "20240531", "pdf"},
+		{"may", "20240531"},
+	} {
+		if _, err := parseXrayExportArgs(args); err == nil {
+			t.Errorf("参数 %v 应当返回错误", args)
+		}
+	}
+}
+
+func testExportTable() exportTable {
+	return exportTable{
+		Name:    "流量",
+		Columns: []string{"user", "date", "down"},
+		Rows: func(emit func(values ...any) error) error {
+			if err := emit("alice", "2024-05-01", int64(100)); err != nil {
+				return err
+			}
+			return emit("bob, \"jr\"", "2024-05-02", int64(200))
+		},
+	}
+}
+
+func TestWriteCsvAndJson(t *testing.T) {
+	var csvBuffer bytes.Buffer
+	if err := writeCsv(&csvBuffer, testExportTable()); err != nil {
+		t.Fatal(err)
+	}
+	expected := "user,date,down\nalice,2024-05-01,100\n\"bob, \"\"jr\"\"\",2024-05-02,200\n"
+	if csvBuffer.String() != expected {
+		t.Errorf("CSV = %q", csvBuffer.String())
+	}
+
+	var jsonBuffer bytes.Buffer
+	if err := writeJson(&jsonBuffer, testExportTable()); err != nil {
+		t.Fatal(err)
+	}
+	var rows []map[string]any
+	if err := json.Unmarshal(jsonBuffer.Bytes(), &rows); err != nil {
+		t.Fatalf("JSON 无法解析: %v\n%s", err, jsonBuffer.String())
+	}
+	if len(rows) != 2 || rows[1]["user"] != "bob, \"jr\"" || rows[1]["down"] != float64(200) {
+		t.Errorf("JSON = %v", rows)
+	}
+
+	empty := exportTable{Columns: []string{"user"}, Rows: func(emit func(values ...any) error) error { return nil }}
+	jsonBuffer.Reset()
+	if err := writeJson(&jsonBuffer, empty); err != nil || jsonBuffer.String() != "[\n]\n" {
+		t.Errorf("没有数据时 JSON = %q, %v", jsonBuffer.String(), err)
+	}
+}
+
+func TestWriteXlsx(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export.xlsx")
+	summary := testExportTable()
+	summary.Name = "用户汇总"
+	daily := testExportTable()
+	daily.Name = "每日明细"
+	if err := writeXlsx(path, []exportTable{summary, daily}); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := excelize.OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if sheets := file.GetSheetList(); len(sheets) != 2 || sheets[0] != "用户汇总" || sheets[1] != "每日明细" {
+		t.Fatalf("工作表 = %v", sheets)
+	}
+	rows, err := file.GetRows("每日明细")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][0] != "user" || rows[2][2] != "200" {
+		t.Errorf("每日明细 = %v", rows)
+	}
+}
+
+func TestXrayExportQueries(t *testing.T) {
+	initTestStore(t)
+	for _, stats := range []XrayUserStats{
+		{User: "alice", Date: "2024-05-01", Time: "10:00", Down: 100, Up: 10},
+		{User: "alice", Date: "2024-05-01", Time: "11:00", Down: 200, Up: 20},
+		{User: "bob", Date: "2024-05-02", Time: "10:00", Down: 1000, Up: 100},
+		{User: "bob", Date: "2024-06-01", Time: "10:00", Down: 1, Up: 1},
+	} {
+		if err := store.XrayStats.Insert(&stats); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	totals, err := store.XrayStats.SelectUserTotalsByDateRange("2024-05-01", "2024-05-31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*totals) != 2 || (*totals)[0] != (Traffic{User: "bob", Down: 1000, Up: 100}) || (*totals)[1] != (Traffic{User: "alice", Down: 300, Up: 30}) {
+		t.Errorf("用户汇总 = %+v", *totals)
+	}
+
+	daily := make([]XrayUserStats, 0)
+	err = store.XrayStats.EachDailyByDateRange("2024-05-01", "2024-05-31", func(stats *XrayUserStats) error {
+		daily = append(daily, *stats)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(daily) != 2 || daily[0].User != "alice" || daily[0].Down != 300 || daily[1].Date != "2024-05-02" {
+		t.Errorf("每日明细 = %+v", daily)
+	}
+
+	hourly := 0
+	if err := store.XrayStats.EachByDateRange("2024-05-01", "2024-05-31", func(stats *XrayUserStats) error {
+		hourly++
+		return nil
+	}); err != nil || hourly != 3 {
+		t.Errorf("每小时记录 %d 条, %v", hourly, err)
+	}
+}
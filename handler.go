@@ -1,18 +1,18 @@
 package main
 
 import (
-	"encoding/json"
+	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/shopspring/decimal"
 	log "github.com/sirupsen/logrus"
 	tele "gopkg.in/telebot.v3"
-	"io"
-	"net/http"
-	"os"
-	"sort"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,24 +22,69 @@ type CommandHandler struct {
 	handler tele.HandlerFunc
 }
 
+type CallbackHandler struct {
+	unique  string
+	handler tele.HandlerFunc
+}
+
 const (
 	Info           Command = "/info"
 	Start          Command = "/start"
+	Cancel         Command = "/cancel"
 	BwgBind        Command = "/bwg_bind"
 	BwgInfo        Command = "/bwg_info"
+	BwgList        Command = "/bwg_list"
+	BwgUnbind      Command = "/bwg_unbind"
+	BwgStatus      Command = "/bwg_status"
+	BwgUsage       Command = "/bwg_usage"
+	BwgAudit       Command = "/bwg_audit"
+	BwgTrend       Command = "/bwg_trend"
+	BwgStart       Command = "/bwg_start"
+	BwgStop        Command = "/bwg_stop"
+	BwgRestart     Command = "/bwg_restart"
 	QueryXrayStats Command = "/xray_stats"
+	Subscribe      Command = "/subscribe"
+	Unsubscribe    Command = "/unsubscribe"
+	Reload         Command = "/reload"
+	Health         Command = "/health"
+	Audit          Command = "/audit"
+	XrayExport     Command = "/xray_export"
+	BackupNow      Command = "/backup_now"
 )
 
 var commandHandlers map[Command]CommandHandler
+var callbackHandlers map[string]CallbackHandler
 
 func InitCommandHandler() {
-	commandHandlers = make(map[Command]CommandHandler, 5)
+	commandHandlers = make(map[Command]CommandHandler, 22)
 
 	commandHandlers[Start] = CommandHandler{Start, StartHandler}
 	commandHandlers[Info] = CommandHandler{Info, InfoHandler}
+	commandHandlers[Cancel] = CommandHandler{Cancel, CancelHandler}
 	commandHandlers[BwgBind] = CommandHandler{BwgBind, BwgBindHandler}
 	commandHandlers[BwgInfo] = CommandHandler{BwgInfo, BwgInfoHandler}
+	commandHandlers[BwgList] = CommandHandler{BwgList, BwgListHandler}
+	commandHandlers[BwgUnbind] = CommandHandler{BwgUnbind, BwgUnbindHandler}
+	commandHandlers[BwgStatus] = CommandHandler{BwgStatus, BwgStatusHandler}
+	commandHandlers[BwgUsage] = CommandHandler{BwgUsage, BwgUsageHandler}
+	commandHandlers[BwgAudit] = CommandHandler{BwgAudit, BwgAuditHandler}
+	commandHandlers[BwgTrend] = CommandHandler{BwgTrend, BwgTrendHandler}
+	commandHandlers[BwgStart] = CommandHandler{BwgStart, BwgStartHandler}
+	commandHandlers[BwgStop] = CommandHandler{BwgStop, BwgStopHandler}
+	commandHandlers[BwgRestart] = CommandHandler{BwgRestart, BwgRestartHandler}
 	commandHandlers[QueryXrayStats] = CommandHandler{QueryXrayStats, QueryXrayStatsHandler}
+	commandHandlers[Subscribe] = CommandHandler{Subscribe, SubscribeHandler}
+	commandHandlers[Unsubscribe] = CommandHandler{Unsubscribe, UnsubscribeHandler}
+	commandHandlers[Reload] = CommandHandler{Reload, ReloadHandler}
+	commandHandlers[Health] = CommandHandler{Health, HealthHandler}
+	commandHandlers[Audit] = CommandHandler{Audit, AuditHandler}
+	commandHandlers[XrayExport] = CommandHandler{XrayExport, XrayExportHandler}
+	commandHandlers[BackupNow] = CommandHandler{BackupNow, BackupNowHandler}
+
+	callbackHandlers = make(map[string]CallbackHandler, 2)
+
+	callbackHandlers[XrayStatsUnique] = CallbackHandler{XrayStatsUnique, XrayStatsCallbackHandler}
+	callbackHandlers[BwgPowerUnique] = CallbackHandler{BwgPowerUnique, BwgPowerCallbackHandler}
 }
 
 func StartHandler(c tele.Context) error {
@@ -61,50 +106,169 @@ func InfoHandler(c tele.Context) error {
 	return c.Send(reply)
 }
 
+// 服务器别名只允许字母、数字、下划线和短横线
+var bwgAliasRegex = regexp.MustCompile(`^[\w-]{1,32}$`)
+
+const defaultBwgAlias = "default"
+
+// BwgBindConversation 绑定服务器的对话名称
+const BwgBindConversation = "bwg_bind"
+
+// BwgBindHandler 以对话形式依次询问 VEID 和 API KEY，读取后立即删除用户消息，避免 API KEY 留在聊天记录中
 func BwgBindHandler(c tele.Context) error {
-	message := c.Message()
 	args := c.Args()
-	if len(args) != 2 {
-		return c.Send("请在命令后指定您的 VEID 和 API KEY，用空格分隔\n如：`/bwg_bind VEID API_KEY`")
+	alias := defaultBwgAlias
+	switch len(args) {
+	case 0:
+	case 1:
+		alias = args[0]
+	default:
+		// 旧的 `/bwg_bind VEID API_KEY` 用法会把 API KEY 留在聊天记录中，删除后改用对话绑定
+		if err := c.Delete(); err != nil {
+			log.Warn("删除包含 API KEY 的消息失败: ", err)
+		}
+		_ = c.Send("为避免 API KEY 留在聊天记录中，已删除该消息，请按提示重新输入")
+		if len(args) == 3 {
+			alias = args[2]
+		}
+	}
+	if !bwgAliasRegex.MatchString(alias) {
+		return replyFailure(c, "别名只能包含字母、数字、下划线和短横线，且不超过 32 个字符")
 	}
 
-	userId := message.Sender.ID
+	conversation := conversations.Start(c, BwgBindConversation, bwgBindVeidStep)
+	conversation.Data["alias"] = alias
+	return c.Send(fmt.Sprintf("正在绑定服务器 `%s`\n请输入 VEID，输入 /cancel 取消", alias))
+}
+
+func bwgBindVeidStep(c tele.Context, conversation *Conversation) error {
+	veid := strings.TrimSpace(c.Text())
+	if err := c.Delete(); err != nil {
+		log.Warn("删除 VEID 消息失败: ", err)
+	}
+	if _, err := strconv.ParseInt(veid, 10, 64); err != nil {
+		return c.Send("VEID 应为数字，请重新输入")
+	}
 
-	encryptedVeid, _ := encryptString(args[0])
-	encryptedApiKey, _ := encryptString(args[1])
-	bwgApiKey := &BwgApiKey{UserId: userId, Veid: encryptedVeid, ApiKey: encryptedApiKey}
+	conversation.Data["veid"] = veid
+	conversations.Next(conversation, bwgBindApiKeyStep)
+	return c.Send("请输入 API KEY，消息读取后会立即删除")
+}
 
-	_, err := SelectBwgKeyByUserId(userId)
+func bwgBindApiKeyStep(c tele.Context, conversation *Conversation) error {
+	apiKey := strings.TrimSpace(c.Text())
+	if err := c.Delete(); err != nil {
+		log.Warn("删除 API KEY 消息失败: ", err)
+	}
+
+	veid := conversation.Data["veid"]
+	alias := conversation.Data["alias"]
+	info, err := NewBwgClient(veid, apiKey).GetServiceInfo()
 	if err != nil {
-		insertErr := InsertBwgKey(bwgApiKey)
-		if insertErr != nil {
-			return c.Send("*绑定失败*！\n请稍后再试")
-		}
-	} else {
-		updateErr := UpdateBwgKeyByUserId(bwgApiKey)
-		if updateErr != nil {
-			return c.Send("*绑定失败*！\n请稍后再试")
-		}
+		log.Warn("验证 VEID 和 API KEY 失败: ", err)
+		return c.Send("验证失败，请确认 VEID 和 API KEY 是否正确后重新输入 API KEY，输入 /cancel 取消")
+	}
+	conversations.End(conversation)
+
+	if err := saveBwgKey(c.Sender().ID, veid, apiKey, alias); err != nil {
+		return c.Send("*绑定失败*！\n请稍后再试")
+	}
+	return c.Send(fmt.Sprintf("*绑定成功*！\n别名：`%s`\n主机名：%s\n请使用 /bwg\\_info 命令获取信息", alias, ReplaceForMarkdownV2(info.HostName)))
+}
+
+// saveBwgKey 加密保存 VEID 和 API KEY，同一别名已存在时覆盖
+func saveBwgKey(userId int64, veid string, apiKey string, alias string) error {
+	encryptedVeid, err := encryptSecret(userId, veid)
+	if err != nil {
+		return err
+	}
+	encryptedApiKey, err := encryptSecret(userId, apiKey)
+	if err != nil {
+		return err
+	}
+	bwgApiKey := &BwgApiKey{UserId: userId, Veid: encryptedVeid, ApiKey: encryptedApiKey, Alias: alias}
+
+	existing, err := store.BwgKeys.SelectByUserIdAndAlias(userId, alias)
+	if err != nil {
+		return store.BwgKeys.Insert(bwgApiKey)
+	}
+
+	if err := store.BwgKeys.UpdateByUserIdAndAlias(bwgApiKey); err != nil {
+		return err
+	}
+	// 别名可能指向了新的服务器，清除旧的告警状态
+	_ = store.BwgStates.DeleteAlertStateByKeyPid(existing.Pid)
+	return nil
+}
+
+func BwgUnbindHandler(c tele.Context) error {
+	args := c.Args()
+	if len(args) != 1 {
+		return replyFailure(c, "请在命令后指定要解绑的服务器别名\n如：`/bwg_unbind 别名`")
 	}
 
-	return c.Send("*绑定成功*！\n请使用 /bwg\\_info 命令获取信息")
+	if existing, err := store.BwgKeys.SelectByUserIdAndAlias(c.Sender().ID, args[0]); err == nil {
+		_ = store.BwgStates.DeleteAlertStateByKeyPid(existing.Pid)
+	}
+	deleted, err := store.BwgKeys.DeleteByUserIdAndAlias(c.Sender().ID, args[0])
+	if err != nil {
+		return replyFailure(c, "*解绑失败*！\n请稍后再试")
+	}
+	if deleted == 0 {
+		return replyFailure(c, "未找到该别名的服务器\n请使用 /bwg\\_list 查看已绑定的服务器")
+	}
+	return c.Send("*解绑成功*！")
+}
+
+func BwgListHandler(c tele.Context) error {
+	bwgApiKeys, err := store.BwgKeys.SelectByUserId(c.Sender().ID)
+	if err != nil {
+		log.Error("查询已绑定的服务器失败: ", err)
+		return replyFailure(c, "查询已绑定的服务器失败，请稍后再试")
+	}
+	if len(*bwgApiKeys) == 0 {
+		return replyFailure(c, "请先使用 /bwg\\_bind 命令绑定 VEID 和 API KEY")
+	}
+
+	msgSlice := make([]string, 0)
+	msgSlice = append(msgSlice, "*已绑定的服务器*")
+	for _, bwgApiKey := range *bwgApiKeys {
+		veid, err := decryptSecret(bwgApiKey.UserId, bwgApiKey.Veid, fmt.Sprintf("bwg_api_key.veid pid=%d", bwgApiKey.Pid))
+		if err != nil {
+			msgSlice = append(msgSlice, fmt.Sprintf("`%s`：解密失败，请重新绑定", bwgApiKey.Alias))
+			continue
+		}
+		msgSlice = append(msgSlice, fmt.Sprintf("`%s`：VEID %s", bwgApiKey.Alias, ReplaceForMarkdownV2(veid)))
+	}
+	return c.Send(strings.Join(msgSlice, "\n"))
 }
 
 func BwgInfoHandler(c tele.Context) error {
 	message := c.Message()
 	userId := message.Sender.ID
 
-	bwgApiKey, err := SelectBwgKeyByUserId(userId)
+	args := c.Args()
+	if len(args) == 0 {
+		bwgApiKeys, err := store.BwgKeys.SelectByUserId(userId)
+		if err != nil || len(*bwgApiKeys) == 0 {
+			return replyFailure(c, "请先使用 /bwg\\_bind 命令绑定 VEID 和 API KEY")
+		}
+		return c.Send(buildServerTableMessage(*bwgApiKeys))
+	}
+
+	bwgApiKey, err := store.BwgKeys.SelectByUserIdAndAlias(userId, args[0])
 	if err != nil {
-		return c.Send("请先使用 /bwg\\_bind 命令绑定 VEID 和 API KEY")
+		return replyFailure(c, "未找到该别名的服务器\n请使用 /bwg\\_list 查看已绑定的服务器")
 	}
 
-	veid, _ := decryptString(bwgApiKey.Veid)
-	apiKey, _ := decryptString(bwgApiKey.ApiKey)
+	veid, apiKey, err := decryptBwgKey(bwgApiKey)
+	if err != nil {
+		return sendBwgKeyError(c, err)
+	}
 
 	info, err := GetBwgServerInfo(veid, apiKey)
 	if err != nil || info == nil || info.Error != 0 {
-		return c.Send("获取服务器信息失败，请确认 VEID 和 API KEY 是否正确\n确认后重新使用 /bwg\\_bind 命令更新信息")
+		return replyFailure(c, "获取服务器信息失败，请确认 VEID 和 API KEY 是否正确\n确认后重新使用 /bwg\\_bind 命令更新信息")
 	}
 
 	reply := buildServerInfoMessage(info)
@@ -112,6 +276,50 @@ func BwgInfoHandler(c tele.Context) error {
 	return c.Send(reply)
 }
 
+// buildServerTableMessage 并发查询所有已绑定的服务器，以表格形式展示流量概况
+func buildServerTableMessage(bwgApiKeys []BwgApiKey) string {
+	infos := make([]*BwgServerInfo, len(bwgApiKeys))
+	var wg sync.WaitGroup
+	for i, bwgApiKey := range bwgApiKeys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			veid, apiKey, err := decryptBwgKey(&bwgApiKey)
+			if err != nil {
+				return
+			}
+			info, err := GetBwgServerInfo(veid, apiKey)
+			if err != nil {
+				log.Warnf("获取服务器 %s 信息失败: %v", bwgApiKey.Alias, err)
+				return
+			}
+			infos[i] = info
+		}()
+	}
+	wg.Wait()
+
+	lines := make([]string, 0, len(bwgApiKeys)+1)
+	// fmt 按字符数补齐，表头中的中文占 2 列，改为按显示宽度补齐，别名列按最长的别名加宽
+	aliasColumns := 12
+	for _, bwgApiKey := range bwgApiKeys {
+		aliasColumns = max(aliasColumns, displayWidth(bwgApiKey.Alias))
+	}
+	lines = append(lines, strings.Join([]string{padRight("别名", aliasColumns), padLeft("已用", 9), padLeft("总量", 7), padLeft("占比", 7), "重置"}, " "))
+	for i, bwgApiKey := range bwgApiKeys {
+		info := infos[i]
+		if info == nil || info.PlanMonthlyData == 0 {
+			lines = append(lines, padRight(bwgApiKey.Alias, aliasColumns)+" 获取失败")
+			continue
+		}
+		used := decimal.NewFromInt(info.DataCounter).Div(decimal.NewFromInt(1 << 30)).Round(2).String()
+		percent := decimal.NewFromInt(info.DataCounter).Mul(decimal.NewFromInt(100)).Div(decimal.NewFromInt(info.PlanMonthlyData)).Round(1).String()
+		lines = append(lines, strings.Join([]string{padRight(bwgApiKey.Alias, aliasColumns), padLeft(used+"G", 9), padLeft(fmt.Sprintf("%dG", info.PlanMonthlyData>>30), 7),
+			padLeft(percent+"%", 7), time.Unix(info.DataNextReset, 0).Format("01-02")}, " "))
+	}
+
+	return fmt.Sprintf("*已绑定的服务器*\n```\n%s\n```\n使用 `/bwg_info 别名` 查看详情", strings.Join(lines, "\n"))
+}
+
 func buildServerInfoMessage(info *BwgServerInfo) string {
 	hostname := ReplaceForMarkdownV2(info.HostName)
 	ipAddresses := ReplaceForMarkdownV2(strings.Join(info.IpAddresses, ", "))
@@ -128,144 +336,265 @@ func buildServerInfoMessage(info *BwgServerInfo) string {
 	return reply
 }
 
-func QueryXrayStatsHandler(c tele.Context) error {
-	// 判断查询权限
-	userId := c.Message().Sender.ID
-	xrayStatsAdmin := os.Getenv("XRAY_STATS_ADMIN")
-	if !strings.Contains(xrayStatsAdmin, strconv.FormatInt(userId, 10)) {
-		return c.Send("无查询权限")
+// errBwgAliasRequired 用户绑定了多台服务器但未指定别名
+var errBwgAliasRequired = errors.New("未指定服务器别名")
+
+// selectBwgKey 查询用户指定别名的服务器，未指定别名且只绑定了一台时使用该台
+func selectBwgKey(userId int64, alias string) (*BwgApiKey, error) {
+	if len(alias) > 0 {
+		return store.BwgKeys.SelectByUserIdAndAlias(userId, alias)
 	}
 
-	var date string
-	args := c.Args()
-	if len(args) > 0 {
-		parsedDate, err := time.Parse("20060102", args[0])
-		if err != nil {
-			log.Error("日期解析错误: ", err)
-			return c.Send("获取流量情况失败")
-		}
-		date = parsedDate.Format(DateFormat)
+	bwgApiKeys, err := store.BwgKeys.SelectByUserId(userId)
+	if err != nil {
+		return nil, err
 	}
+	switch len(*bwgApiKeys) {
+	case 0:
+		return nil, sql.ErrNoRows
+	case 1:
+		return &(*bwgApiKeys)[0], nil
+	default:
+		return nil, errBwgAliasRequired
+	}
+}
 
-	if len(date) == 0 {
-		date = time.Now().Format(DateFormat)
+// bwgClientOf 根据用户绑定的 VEID 和 API KEY 创建 KiwiVM 客户端
+func bwgClientOf(userId int64, alias string) (*BwgClient, error) {
+	bwgApiKey, err := selectBwgKey(userId, alias)
+	if err != nil {
+		return nil, err
 	}
 
-	xrayUserStatsList, err := SelectXrayUserStatsByDate(date)
+	veid, apiKey, err := decryptBwgKey(bwgApiKey)
 	if err != nil {
-		log.Error("获取流量情况失败", err)
-		return c.Send("获取流量情况失败")
+		return nil, err
 	}
+	return NewBwgClient(veid, apiKey), nil
+}
 
-	isToday := time.Now().Format(DateFormat) == date
-	if len(*xrayUserStatsList) == 0 && !isToday {
-		return c.Send(ReplaceForMarkdownV2(fmt.Sprintf("%s 流量信息为空", date)))
+func sendBwgKeyError(c tele.Context, err error) error {
+	if errors.Is(err, errBwgAliasRequired) {
+		return replyFailure(c, "您绑定了多台服务器，请在命令后指定别名\n可使用 /bwg\\_list 查看已绑定的服务器")
+	}
+	if errors.Is(err, errBwgSecretInvalid) {
+		return replyFailure(c, "已保存的 VEID 或 API KEY 解密失败，数据可能已损坏或加密密钥已变更\n请使用 /bwg\\_bind 命令重新绑定")
 	}
+	return replyFailure(c, "未找到绑定的服务器\n请使用 /bwg\\_list 查看或使用 /bwg\\_bind 命令绑定 VEID 和 API KEY")
+}
 
-	userTrafficList := make([]*Traffic, 0)
-	userTrafficMap := map[string]*Traffic{}
-	for _, xrayUserStats := range *xrayUserStatsList {
-		userTraffic, ok := userTrafficMap[xrayUserStats.User]
-		if !ok {
-			userTraffic = &Traffic{
-				User: xrayUserStats.User,
-				Down: xrayUserStats.Down,
-				Up:   xrayUserStats.Up,
+// parseBwgArgs 解析命令参数，数字视为数量，其余视为服务器别名
+func parseBwgArgs(args []string, defaultCount int) (alias string, count int, ok bool) {
+	count = defaultCount
+	for _, arg := range args {
+		if parsed, err := strconv.Atoi(arg); err == nil {
+			if parsed <= 0 {
+				return "", 0, false
 			}
-			userTrafficMap[xrayUserStats.User] = userTraffic
-			userTrafficList = append(userTrafficList, userTraffic)
+			count = parsed
 		} else {
-			userTraffic.Down = userTraffic.Down + xrayUserStats.Down
-			userTraffic.Up = userTraffic.Up + xrayUserStats.Up
+			alias = arg
 		}
 	}
+	return alias, count, true
+}
 
-	// 如果是当天 统计还未落库的数据
-	if isToday {
-		trafficList, _ := GetTraffic(false)
-		for _, traffic := range trafficList {
-			userTraffic, ok := userTrafficMap[traffic.User]
-			if !ok {
-				userTraffic = &Traffic{
-					User: traffic.User,
-					Down: traffic.Down,
-					Up:   traffic.Up,
-				}
-				userTrafficMap[traffic.User] = userTraffic
-				userTrafficList = append(userTrafficList, userTraffic)
-			} else {
-				userTraffic.Down = userTraffic.Down + traffic.Down
-				userTraffic.Up = userTraffic.Up + traffic.Up
-			}
-		}
+func BwgStatusHandler(c tele.Context) error {
+	alias := ""
+	if args := c.Args(); len(args) > 0 {
+		alias = args[0]
 	}
 
-	// 排序
-	sort.Slice(userTrafficList, func(i, j int) bool {
-		iTotal := userTrafficList[i].Down + userTrafficList[i].Up
-		jTotal := userTrafficList[j].Down + userTrafficList[j].Up
-		return iTotal > jTotal
-	})
+	client, err := bwgClientOf(c.Sender().ID, alias)
+	if err != nil {
+		return sendBwgKeyError(c, err)
+	}
+
+	info, err := client.GetLiveServiceInfo()
+	if err != nil {
+		log.Error("获取服务器实时状态失败: ", err)
+		return replyFailure(c, "获取服务器实时状态失败，请稍后再试")
+	}
 
-	var total int64 = 0
 	msgSlice := make([]string, 0)
-	msgSlice = append(msgSlice, fmt.Sprintf("*%s 流量使用情况*", ReplaceForMarkdownV2(date)))
-	for _, traffic := range userTrafficList {
-		userTotal := traffic.Up + traffic.Down
-		total = total + userTotal
-		if userTotal == 0 {
-			continue
-		}
-		trafficInfo := fmt.Sprintf("*%s*：%s", ReplaceForMarkdownV2(traffic.User), ReplaceForMarkdownV2(calculateTraffic(userTotal)))
-		msgSlice = append(msgSlice, trafficInfo)
+	msgSlice = append(msgSlice, fmt.Sprintf("*主机名*：%s", ReplaceForMarkdownV2(info.HostName)))
+	msgSlice = append(msgSlice, fmt.Sprintf("*状态*：%s", ReplaceForMarkdownV2(info.VeStatus)))
+	if oses, err := client.GetAvailableOSes(); err == nil {
+		msgSlice = append(msgSlice, fmt.Sprintf("*系统*：%s", ReplaceForMarkdownV2(oses.Installed)))
+	}
+	msgSlice = append(msgSlice, fmt.Sprintf("*负载*：%s", ReplaceForMarkdownV2(info.LoadAverage)))
+	if info.PlanRam > 0 {
+		memUsed := info.PlanRam - int64(info.MemAvailableKb)<<10
+		msgSlice = append(msgSlice, fmt.Sprintf("*内存*：%s / %s", ReplaceForMarkdownV2(calculateTraffic(memUsed)), ReplaceForMarkdownV2(calculateTraffic(info.PlanRam))))
+	}
+	if info.SwapTotalKb > 0 {
+		swapUsed := int64(info.SwapTotalKb-info.SwapAvailableKb) << 10
+		msgSlice = append(msgSlice, fmt.Sprintf("*Swap*：%s / %s", ReplaceForMarkdownV2(calculateTraffic(swapUsed)), ReplaceForMarkdownV2(calculateTraffic(int64(info.SwapTotalKb)<<10))))
+	}
+	msgSlice = append(msgSlice, fmt.Sprintf("*磁盘*：%s / %s", ReplaceForMarkdownV2(calculateTraffic(int64(info.VeUsedDiskSpaceB))), ReplaceForMarkdownV2(calculateTraffic(info.PlanDisk))))
+	if info.IsCpuThrottled != 0 {
+		msgSlice = append(msgSlice, "*CPU*：已被限速")
+	}
+	if status, err := client.GetRateLimitStatus(); err == nil {
+		msgSlice = append(msgSlice, fmt.Sprintf("*API 剩余调用点数*：15 分钟 %d，24 小时 %d", status.RemainingPoints15Min, status.RemainingPoints24H))
 	}
-	msgSlice = append(msgSlice, fmt.Sprintf("*总流量*：%s", ReplaceForMarkdownV2(calculateTraffic(total))))
 
 	return c.Send(strings.Join(msgSlice, "\n"))
 }
 
-func TextHandler(c tele.Context) error {
-	jsonMessage, _ := json.Marshal(c.Message())
-	log.Infof("收到请求：%s", jsonMessage)
+func BwgUsageHandler(c tele.Context) error {
+	alias, days, ok := parseBwgArgs(c.Args(), 7)
+	if !ok {
+		return replyFailure(c, "请在命令后指定服务器别名和查询天数\n如：`/bwg_usage [别名] 7`")
+	}
 
-	if IsCommand(c.Message()) {
-		return c.Send(fmt.Sprint("未知的命令：", c.Text()))
-	} else {
-		return c.Send("只支持输入命令")
+	client, err := bwgClientOf(c.Sender().ID, alias)
+	if err != nil {
+		return sendBwgKeyError(c, err)
 	}
-}
 
-type BwgServerInfo struct {
-	HostName        string   `json:"hostname"`
-	NodeDataCenter  string   `json:"node_datacenter"`
-	IpAddresses     []string `json:"ip_addresses"`
-	PlanMonthlyData int64    `json:"plan_monthly_data"`
-	DataCounter     int64    `json:"data_counter"`
-	DataNextReset   int64    `json:"data_next_reset"`
-	Error           int      `json:"error"`
+	stats, err := client.GetRawUsageStats()
+	if err != nil {
+		log.Error("获取服务器用量失败: ", err)
+		return replyFailure(c, "获取服务器用量失败，请稍后再试")
+	}
+
+	// 按天汇总网络与磁盘用量
+	now := time.Now()
+	since := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local).AddDate(0, 0, 1-days)
+	dates := make([]string, 0)
+	usageMap := map[string]*BwgUsageStat{}
+	for _, stat := range stats.Data {
+		statTime := time.Unix(stat.Timestamp, 0)
+		if statTime.Before(since) {
+			continue
+		}
+		date := statTime.Format(DateFormat)
+		usage, ok := usageMap[date]
+		if !ok {
+			usage = &BwgUsageStat{}
+			usageMap[date] = usage
+			dates = append(dates, date)
+		}
+		usage.NetworkInBytes += stat.NetworkInBytes
+		usage.NetworkOutBytes += stat.NetworkOutBytes
+		usage.DiskReadBytes += stat.DiskReadBytes
+		usage.DiskWriteBytes += stat.DiskWriteBytes
+	}
+	if len(dates) == 0 {
+		return c.Send(ReplaceForMarkdownV2(fmt.Sprintf("近 %d 天用量信息为空", days)))
+	}
+	slices.Sort(dates)
+
+	msgSlice := make([]string, 0)
+	msgSlice = append(msgSlice, fmt.Sprintf("*近 %d 天用量*", days))
+	for _, date := range dates {
+		usage := usageMap[date]
+		msgSlice = append(msgSlice, fmt.Sprintf("*%s*：↓ %s ↑ %s，读 %s 写 %s", ReplaceForMarkdownV2(date),
+			ReplaceForMarkdownV2(calculateTraffic(usage.NetworkInBytes)), ReplaceForMarkdownV2(calculateTraffic(usage.NetworkOutBytes)),
+			ReplaceForMarkdownV2(calculateTraffic(usage.DiskReadBytes)), ReplaceForMarkdownV2(calculateTraffic(usage.DiskWriteBytes))))
+	}
+
+	return c.Send(strings.Join(msgSlice, "\n"))
 }
 
-func GetBwgServerInfo(veid string, apiKey string) (*BwgServerInfo, error) {
-	if len(veid) == 0 || len(apiKey) == 0 {
-		return nil, errors.New("veid 或 apiKey 不可为空")
+func BwgAuditHandler(c tele.Context) error {
+	alias, limit, ok := parseBwgArgs(c.Args(), 10)
+	if !ok {
+		return replyFailure(c, "请在命令后指定服务器别名和查询条数\n如：`/bwg_audit [别名] 10`")
 	}
 
-	resp, err := http.Get(fmt.Sprintf("https://api.64clouds.com/v1/getServiceInfo?veid=%s&api_key=%s", veid, apiKey))
+	client, err := bwgClientOf(c.Sender().ID, alias)
 	if err != nil {
-		return nil, err
+		return sendBwgKeyError(c, err)
 	}
 
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	auditLog, err := client.GetAuditLog()
 	if err != nil {
-		return nil, err
+		log.Error("获取服务器审计日志失败: ", err)
+		return replyFailure(c, "获取服务器审计日志失败，请稍后再试")
+	}
+	if len(auditLog.LogEntries) == 0 {
+		return c.Send("审计日志为空")
+	}
+
+	// 最新的记录在前
+	entries := slices.Clone(auditLog.LogEntries)
+	slices.SortFunc(entries, func(a, b BwgAuditLogEntry) int {
+		return int(b.Timestamp - a.Timestamp)
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	msgSlice := make([]string, 0)
+	msgSlice = append(msgSlice, "*审计日志*")
+	for _, entry := range entries {
+		msgSlice = append(msgSlice, fmt.Sprintf("*%s* `%s`\n%s",
+			ReplaceForMarkdownV2(time.Unix(entry.Timestamp, 0).Format(DateTimeFormat)), entry.RequestorIp(), ReplaceForMarkdownV2(entry.Summary)))
+	}
+
+	return c.Send(strings.Join(msgSlice, "\n"))
+}
+
+func QueryXrayStatsHandler(c tele.Context) error {
+	// 判断查询权限
+	userId := c.Message().Sender.ID
+	if !IsXrayStatsAdmin(userId) {
+		return replyFailure(c, "无查询权限")
 	}
 
-	var bwgServerInfo BwgServerInfo
-	err = json.Unmarshal(body, &bwgServerInfo)
+	query := XrayStatsQuery{Scope: XrayStatsDay, Date: time.Now()}
+	args := c.Args()
+	if len(args) > 0 {
+		parsedDate, err := time.ParseInLocation("20060102", args[0], time.Local)
+		if err != nil {
+			log.Error("日期解析错误: ", err)
+			return replyFailure(c, "获取流量情况失败")
+		}
+		query.Date = parsedDate
+	}
+
+	reply, markup, err := renderXrayStats(c.Chat().ID, query)
 	if err != nil {
-		return nil, err
+		log.Error("获取流量情况失败", err)
+		return replyFailure(c, "获取流量情况失败")
 	}
 
-	return &bwgServerInfo, nil
+	return c.Send(reply, markup)
+}
+
+// 可以查询 Xray 流量的用户 ID，重新加载配置时整体替换
+var xrayStatsAdmins atomic.Pointer[[]int64]
+
+func XrayStatsAdmins() []int64 {
+	if admins := xrayStatsAdmins.Load(); admins != nil {
+		return *admins
+	}
+	return nil
+}
+
+func IsXrayStatsAdmin(userId int64) bool {
+	return slices.Contains(XrayStatsAdmins(), userId)
+}
+
+func TextHandler(c tele.Context) error {
+	// 进行中的对话优先处理，对话内容可能包含密钥，不记录日志
+	if !IsCommand(c.Message()) {
+		if handled, err := conversations.Handle(c); handled {
+			return err
+		}
+	}
+
+	// 对话超时或重启后用户仍可能继续发送密钥，只记录来源，不记录消息内容
+	log.Infof("收到非对话消息：用户 %d，会话 %d", c.Sender().ID, c.Chat().ID)
+
+	if IsCommand(c.Message()) {
+		fields := strings.Fields(c.Text())
+		command, _, _ := strings.Cut(fields[0], "@")
+		recordCommandAudit(c, command, redactAuditArgs(command, fields[1:]), AuditOutcomeUnknown, nil, 0)
+		return c.Send(fmt.Sprint("未知的命令：", c.Text()))
+	} else {
+		return c.Send("只支持输入命令")
+	}
 }
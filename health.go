@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	tele "gopkg.in/telebot.v3"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 单个组件检查的超时时间
+const healthCheckTimeout = 5 * time.Second
+
+// Xray 日志超过该时间没有新内容时视为异常
+const xrayLogFreshness = 30 * time.Minute
+
+// HealthCheck 组件的检查函数，Critical 的组件异常时 /healthz 也返回失败。
+// /healthz 只执行 Critical 的检查，这些检查只能检查进程内的状态，不请求外部服务
+type HealthCheck struct {
+	Name     string
+	Critical bool
+	Check    func(ctx context.Context) error
+}
+
+// ComponentHealth 组件的检查结果
+type ComponentHealth struct {
+	Name     string    `json:"name"`
+	Ok       bool      `json:"ok"`
+	Critical bool      `json:"critical"`
+	Error    string    `json:"error,omitempty"`
+	LastOk   time.Time `json:"last_ok,omitempty"`
+	Duration string    `json:"duration"`
+}
+
+// HealthReport 所有组件的检查结果
+type HealthReport struct {
+	Ok         bool              `json:"ok"`
+	Ready      bool              `json:"ready"`
+	CheckedAt  time.Time         `json:"checked_at"`
+	Components []ComponentHealth `json:"components"`
+}
+
+// HealthRegistry 各组件注册自己的检查函数，并记录最后一次正常的时间
+type HealthRegistry struct {
+	mu     sync.Mutex
+	checks []HealthCheck
+	lastOk map[string]time.Time
+}
+
+var healthRegistry = NewHealthRegistry()
+
+// Telegram 轮询是否在运行
+var telegramPolling atomic.Bool
+
+func NewHealthRegistry() *HealthRegistry {
+	return &HealthRegistry{lastOk: map[string]time.Time{}}
+}
+
+func (r *HealthRegistry) Register(check HealthCheck) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks = append(r.checks, check)
+}
+
+// Check 并发执行所有检查
+func (r *HealthRegistry) Check(ctx context.Context) *HealthReport {
+	r.mu.Lock()
+	checks := slices.Clone(r.checks)
+	r.mu.Unlock()
+	return r.check(ctx, checks)
+}
+
+// CheckCritical 只执行 Critical 的检查，用于存活检查
+func (r *HealthRegistry) CheckCritical(ctx context.Context) *HealthReport {
+	r.mu.Lock()
+	checks := slices.DeleteFunc(slices.Clone(r.checks), func(check HealthCheck) bool {
+		return !check.Critical
+	})
+	r.mu.Unlock()
+	return r.check(ctx, checks)
+}
+
+func (r *HealthRegistry) check(ctx context.Context, checks []HealthCheck) *HealthReport {
+	components := make([]ComponentHealth, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			components[i] = r.run(ctx, check)
+		}()
+	}
+	wg.Wait()
+
+	report := &HealthReport{Ok: true, Ready: true, CheckedAt: time.Now(), Components: components}
+	for _, component := range components {
+		if !component.Ok {
+			report.Ready = false
+			if component.Critical {
+				report.Ok = false
+			}
+		}
+	}
+	return report
+}
+
+func (r *HealthRegistry) run(ctx context.Context, check HealthCheck) ComponentHealth {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- check.Check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("检查超时")
+	}
+
+	component := ComponentHealth{Name: check.Name, Ok: err == nil, Critical: check.Critical, Duration: time.Since(start).Round(time.Millisecond).String()}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		r.lastOk[check.Name] = start
+	} else {
+		component.Error = err.Error()
+	}
+	component.LastOk = r.lastOk[check.Name]
+	return component
+}
+
+// healthPoller 记录轮询是否在运行，长轮询和 Webhook 都可以包装
+type healthPoller struct {
+	tele.Poller
+}
+
+func (p *healthPoller) Poll(b *tele.Bot, dest chan tele.Update, stop chan struct{}) {
+	telegramPolling.Store(true)
+	defer telegramPolling.Store(false)
+	p.Poller.Poll(b, dest, stop)
+}
+
+// InitHealth 注册基础组件的检查，并在内置 HTTP 服务上注册 /healthz 和 /readyz
+func InitHealth(config TelegramConfig) {
+	healthRegistry.Register(HealthCheck{Name: "telegram_polling", Critical: true, Check: func(ctx context.Context) error {
+		if !telegramPolling.Load() {
+			return fmt.Errorf("未在接收消息")
+		}
+		return nil
+	}})
+	// 请求 Telegram API 的检查只影响 /readyz
+	healthRegistry.Register(HealthCheck{Name: "telegram", Check: func(ctx context.Context) error {
+		_, err := bot.Raw("getMe", nil)
+		return err
+	}})
+	if len(config.Webhook.PublicUrl) > 0 {
+		healthRegistry.Register(HealthCheck{Name: "telegram_webhook", Check: func(ctx context.Context) error {
+			return checkWebhook(config.Webhook)
+		}})
+	}
+	healthRegistry.Register(HealthCheck{Name: "database", Critical: true, Check: func(ctx context.Context) error {
+		return store.Ping(ctx)
+	}})
+	healthRegistry.Register(HealthCheck{Name: "xray_stats", Check: func(ctx context.Context) error {
+		_, err := GetTraffic(false)
+		return err
+	}})
+
+	httpMux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		report := healthRegistry.CheckCritical(r.Context())
+		writeHealthReport(w, report, report.Ok)
+	})
+	httpMux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		report := healthRegistry.Check(r.Context())
+		writeHealthReport(w, report, report.Ready)
+	})
+}
+
+func writeHealthReport(w http.ResponseWriter, report *HealthReport, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Warn("输出健康检查结果失败: ", err)
+	}
+}
+
+func buildHealthMessage(report *HealthReport) string {
+	status := "正常"
+	if !report.Ok {
+		status = "异常"
+	} else if !report.Ready {
+		status = "部分异常"
+	}
+
+	msgSlice := []string{fmt.Sprintf("*运行状态*：%s", status)}
+	for _, component := range report.Components {
+		icon := "✅"
+		if !component.Ok {
+			icon = "❌"
+		}
+		line := fmt.Sprintf("%s `%s` %s", icon, component.Name, ReplaceForMarkdownV2(component.Duration))
+		if !component.Ok {
+			line += "\n    " + ReplaceForMarkdownV2(component.Error)
+			if component.LastOk.IsZero() {
+				line += "\n    启动后从未正常"
+			} else {
+				line += "\n    最后正常：" + ReplaceForMarkdownV2(component.LastOk.Format(DateTimeFormat))
+			}
+		}
+		msgSlice = append(msgSlice, line)
+	}
+	return strings.Join(msgSlice, "\n")
+}
+
+func HealthHandler(c tele.Context) error {
+	if !IsOwner(c.Sender().ID) {
+		return replyFailure(c, "无操作权限")
+	}
+	return c.Send(buildHealthMessage(healthRegistry.Check(context.Background())))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthRegistry(t *testing.T) {
+	registry := NewHealthRegistry()
+	registry.Register(HealthCheck{Name: "critical", Critical: true, Check: func(ctx context.Context) error {
+		return nil
+	}})
+	failing := errors.New("unreachable")
+	registry.Register(HealthCheck{Name: "optional", Check: func(ctx context.Context) error {
+		return failing
+	}})
+
+	report := registry.Check(context.Background())
+	if !report.Ok || report.Ready {
+		t.Errorf("非关键组件异常时应当存活但未就绪: %+v", report)
+	}
+	if !report.Components[0].Ok || report.Components[0].LastOk.IsZero() {
+		t.Errorf("正常组件应当记录最后正常时间: %+v", report.Components[0])
+	}
+	if report.Components[1].Ok || report.Components[1].Error != "unreachable" || !report.Components[1].LastOk.IsZero() {
+		t.Errorf("异常组件结果错误: %+v", report.Components[1])
+	}
+
+	// 存活检查只执行关键组件的检查
+	if report := registry.CheckCritical(context.Background()); !report.Ok || len(report.Components) != 1 || report.Components[0].Name != "critical" {
+		t.Errorf("存活检查不应执行非关键组件的检查: %+v", report)
+	}
+
+	failing = nil
+	if report := registry.Check(context.Background()); !report.Ready {
+		t.Errorf("组件恢复后应当就绪: %+v", report)
+	}
+
+	recorder := httptest.NewRecorder()
+	failing = errors.New("unreachable")
+	writeHealthReport(recorder, registry.Check(context.Background()), false)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("未就绪时应当返回 503: %d", recorder.Code)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 在日志和错误信息中需要隐藏的 query 参数
+var defaultSecretParams = []string{"api_key", "apikey", "key", "token", "access_token", "secret"}
+
+const redactedValue = "***"
+
+// 错误信息中最多保留的响应内容长度
+const maxErrorBodyLength = 512
+
+// 服务端要求等待的时间超过该值时不再重试
+const maxRetryAfter = 30 * time.Second
+
+// HttpClient 对外部服务 HTTP 调用的统一封装，负责超时、重试、状态码检查，并在日志和错误中隐去敏感信息
+type HttpClient struct {
+	Name   string
+	Client *http.Client
+	// 默认不重试，只有幂等的请求才应设置
+	MaxRetries int
+	RetryWait  time.Duration
+	// 关闭后不再等待重试，直接返回最后一次的错误
+	Stop         <-chan struct{}
+	SecretParams []string
+	// 除 query 参数外需要隐藏的敏感值，如请求头中的 token
+	Secrets []string
+}
+
+// HttpStatusError 响应状态码不是 2xx
+type HttpStatusError struct {
+	Name       string
+	StatusCode int
+	Body       string
+}
+
+func (e *HttpStatusError) Error() string {
+	return fmt.Sprintf("%s 请求失败，状态码: %d，返回内容: %s", e.Name, e.StatusCode, e.Body)
+}
+
+func NewHttpClient(name string, timeout time.Duration) *HttpClient {
+	return &HttpClient{
+		Name:         name,
+		Client:       &http.Client{Timeout: timeout},
+		RetryWait:    500 * time.Millisecond,
+		SecretParams: defaultSecretParams,
+	}
+}
+
+// Get 发送 GET 请求，query 会与 rawUrl 中已有的参数合并并正确编码
+func (c *HttpClient) Get(rawUrl string, query url.Values) ([]byte, error) {
+	return c.Do(http.MethodGet, rawUrl, query, nil, nil)
+}
+
+// PostForm 以表单形式发送 POST 请求，敏感参数放在请求体中而不是地址中
+func (c *HttpClient) PostForm(rawUrl string, form url.Values) ([]byte, error) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.Do(http.MethodPost, rawUrl, nil, header, []byte(form.Encode()))
+}
+
+// PostJson 发送 JSON 格式的 POST 请求
+func (c *HttpClient) PostJson(rawUrl string, header http.Header, body []byte) ([]byte, error) {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "application/json")
+	return c.Do(http.MethodPost, rawUrl, nil, header, body)
+}
+
+// Do 发送请求并返回响应内容，设置了 MaxRetries 时网络错误和 5xx 会按指数退避重试，
+// 429 只在服务端返回 Retry-After 时按要求的时间重试
+func (c *HttpClient) Do(method string, rawUrl string, query url.Values, header http.Header, body []byte) ([]byte, error) {
+	requestUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, fmt.Errorf("%s 请求地址错误: %s", c.Name, c.Redact(rawUrl))
+	}
+	if len(query) > 0 {
+		merged := requestUrl.Query()
+		for key, values := range query {
+			merged[key] = values
+		}
+		requestUrl.RawQuery = merged.Encode()
+	}
+
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		respBody, retryAfter, err := c.doOnce(method, requestUrl, header, body)
+		if err == nil {
+			return respBody, nil
+		}
+		lastErr = err
+		if retryAfter < 0 || attempt >= c.MaxRetries {
+			return nil, lastErr
+		}
+
+		wait := max(c.RetryWait<<attempt, retryAfter)
+		log.Warnf("%s 请求失败，%s 后第 %d 次重试: %v", c.Name, wait, attempt+1, lastErr)
+		select {
+		case <-c.Stop:
+			return nil, lastErr
+		case <-time.After(wait):
+		}
+	}
+}
+
+// doOnce 发送一次请求，retryAfter 小于 0 表示不可重试，大于 0 表示服务端要求的最短等待时间
+func (c *HttpClient) doOnce(method string, requestUrl *url.URL, header http.Header, body []byte) ([]byte, time.Duration, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, requestUrl.String(), reader)
+	if err != nil {
+		return nil, -1, c.redactError(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, 0, c.redactError(err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, c.redactError(err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		content := c.Redact(string(respBody))
+		if len(content) > maxErrorBodyLength {
+			content = content[:maxErrorBodyLength] + "..."
+		}
+		statusError := &HttpStatusError{Name: c.Name, StatusCode: resp.StatusCode, Body: content}
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			// 没有 Retry-After 时立即重试只会继续消耗对方的调用额度
+			retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+			if !ok || retryAfter > maxRetryAfter {
+				return nil, -1, statusError
+			}
+			return nil, retryAfter, statusError
+		case resp.StatusCode >= 500:
+			return nil, 0, statusError
+		default:
+			return nil, -1, statusError
+		}
+	}
+	return respBody, 0, nil
+}
+
+// parseRetryAfter 解析秒数或 HTTP 日期格式的 Retry-After
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if len(value) == 0 {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// redactedError 隐去敏感信息后的错误，保留原始错误链以便 errors.Is 判断超时等情况
+type redactedError struct {
+	message string
+	err     error
+}
+
+func (e *redactedError) Error() string {
+	return e.message
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError 替换 *url.Error 中的地址，避免密钥随错误信息打印到日志中
+func (c *HttpClient) redactError(err error) error {
+	var urlError *url.Error
+	if errors.As(err, &urlError) {
+		message := fmt.Sprintf("%s %q: %s", urlError.Op, c.RedactUrl(urlError.URL), c.Redact(urlError.Err.Error()))
+		return &redactedError{message: message, err: urlError.Err}
+	}
+	return &redactedError{message: c.Redact(err.Error()), err: err}
+}
+
+// RedactUrl 隐藏地址中敏感参数的值
+func (c *HttpClient) RedactUrl(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return c.Redact(rawUrl)
+	}
+	query := parsed.Query()
+	for key := range query {
+		for _, secretParam := range c.SecretParams {
+			if strings.EqualFold(key, secretParam) {
+				query.Set(key, redactedValue)
+			}
+		}
+	}
+	parsed.RawQuery = query.Encode()
+	if parsed.User != nil {
+		parsed.User = url.User(redactedValue)
+	}
+	return c.Redact(parsed.String())
+}
+
+// Redact 隐藏文本中出现的敏感值
+func (c *HttpClient) Redact(text string) string {
+	for _, secret := range c.Secrets {
+		if len(secret) > 0 {
+			text = strings.ReplaceAll(text, secret, redactedValue)
+		}
+	}
+	return text
+}
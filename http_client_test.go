@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHttpClientRetryAndStatus(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		switch r.URL.Path {
+		case "/throttled":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/retry-after":
+			if attempts < 2 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			_, _ = w.Write([]byte("ok"))
+		case "/flaky":
+			if attempts < 3 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			_, _ = w.Write([]byte("ok"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("missing secret-token"))
+		}
+	}))
+	defer server.Close()
+
+	client := NewHttpClient("test", time.Second)
+	client.MaxRetries = 2
+	client.RetryWait = time.Millisecond
+	client.Secrets = []string{"secret-token"}
+
+	body, err := client.Get(server.URL+"/flaky", nil)
+	if err != nil || string(body) != "ok" || attempts != 3 {
+		t.Fatalf("body = %q, err = %v, attempts = %d", body, err, attempts)
+	}
+
+	// 4xx 不重试，返回内容中的敏感值需要隐藏
+	attempts = 0
+	_, err = client.Get(server.URL+"/missing", nil)
+	var statusError *HttpStatusError
+	if !errors.As(err, &statusError) || statusError.StatusCode != http.StatusNotFound || attempts != 1 {
+		t.Fatalf("err = %v, attempts = %d", err, attempts)
+	}
+	if strings.Contains(err.Error(), "secret-token") {
+		t.Fatalf("secret leaked in error: %v", err)
+	}
+
+	// 429 没有 Retry-After 时不重试，有则按要求的时间重试
+	attempts = 0
+	if _, err = client.Get(server.URL+"/throttled", nil); err == nil || attempts != 1 {
+		t.Fatalf("err = %v, attempts = %d", err, attempts)
+	}
+	attempts = 0
+	if body, err = client.Get(server.URL+"/retry-after", nil); err != nil || string(body) != "ok" || attempts != 2 {
+		t.Fatalf("body = %q, err = %v, attempts = %d", body, err, attempts)
+	}
+
+	// 默认不重试
+	attempts = 0
+	if _, err = NewHttpClient("test", time.Second).Get(server.URL+"/flaky", nil); err == nil || attempts != 1 {
+		t.Fatalf("err = %v, attempts = %d", err, attempts)
+	}
+}
+
+func TestHttpClientStopsWaitingOnShutdown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	stop := make(chan struct{})
+	close(stop)
+	client := NewHttpClient("test", time.Second)
+	client.MaxRetries = 2
+	client.RetryWait = time.Hour
+	client.Stop = stop
+
+	start := time.Now()
+	if _, err := client.Get(server.URL, nil); err == nil {
+		t.Fatal("expected status error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("退出时仍在等待重试: %s", elapsed)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{"", 0, false},
+		{"5", 5 * time.Second, true},
+		{"Wed, 01 May 2024 12:00:30 GMT", 30 * time.Second, true},
+		{"Wed, 01 May 2024 11:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, c := range cases {
+		if actual, ok := parseRetryAfter(c.value, now); actual != c.expected || ok != c.ok {
+			t.Errorf("parseRetryAfter(%q) = %s, %v", c.value, actual, ok)
+		}
+	}
+}
+
+func TestHttpClientRedactsTransportError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	client := NewHttpClient("test", time.Second)
+	client.MaxRetries = 0
+	_, err := client.Get(server.URL, url.Values{"veid": {"123"}, "api_key": {"private_key"}})
+	if err == nil {
+		t.Fatal("expected transport error")
+	}
+	if strings.Contains(err.Error(), "private_key") || !strings.Contains(err.Error(), "veid=123") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
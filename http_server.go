@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// 内置 HTTP 服务的路由，各组件在启动前注册自己的地址
+var httpMux = http.NewServeMux()
+
+// StartHttpServer 启动内置 HTTP 服务，未设置监听地址时不启动
+func StartHttpServer(lifecycle *Lifecycle, config HttpConfig) {
+	if len(config.Listen) == 0 {
+		log.Info("未设置 HTTP 监听地址，不启动 HTTP 服务")
+		return
+	}
+
+	server := &http.Server{
+		Addr:              config.Listen,
+		Handler:           httpMux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		log.Infof("HTTP 服务已启动，监听地址: %s", config.Listen)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("HTTP 服务启动失败: ", err)
+		}
+	}()
+
+	lifecycle.OnStop("HTTP 服务", func(ctx context.Context) error {
+		return server.Shutdown(ctx)
+	})
+}
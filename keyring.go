@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/morooi/morooi-telegram-bot-go/secret"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	AuditEventEncryptFailed = "encrypt_failed"
+	AuditEventDecryptFailed = "decrypt_failed"
+)
+
+// errBwgSecretInvalid 已保存的 VEID 或 API KEY 无法解密
+var errBwgSecretInvalid = errors.New("服务器密钥解密失败")
+
+var keyring *secret.Keyring
+
+// InitKeyring 使用数据库中保存的盐从口令派生当前密钥，旧口令仅用于解密，需要先初始化 store。
+// 首次启动时生成随机盐并保存，相同口令在不同部署中派生出的密钥不同
+func InitKeyring(config KeyConfig) {
+	generated, err := secret.GenerateSalt()
+	if err != nil {
+		panic("生成加密盐失败：" + err.Error())
+	}
+	salt, err := store.Keyring.LoadOrCreateSalt(generated)
+	if err != nil {
+		panic("读取加密盐失败：" + err.Error())
+	}
+	keyring, err = secret.NewKeyring(salt, config.Passphrase, config.Previous...)
+	if err != nil {
+		panic("初始化加密实例失败：" + err.Error())
+	}
+	log.Infof("加密密钥已加载，当前密钥: %s，历史密钥: %d 个", keyring.CurrentKeyId(), len(config.Previous))
+}
+
+// encryptSecret 加密属于 userId 的敏感信息，失败时记录审计事件
+func encryptSecret(userId int64, plaintext string) (string, error) {
+	ciphertext, err := keyring.Encrypt(plaintext, secret.UserData(userId))
+	if err != nil {
+		recordAuditEvent(userId, AuditEventEncryptFailed, err.Error())
+		return "", err
+	}
+	return ciphertext, nil
+}
+
+// decryptSecret 解密属于 userId 的敏感信息，失败时记录审计事件
+func decryptSecret(userId int64, ciphertext string, field string) (string, error) {
+	plaintext, err := keyring.Decrypt(ciphertext, secret.UserData(userId))
+	if err != nil {
+		recordAuditEvent(userId, AuditEventDecryptFailed, fmt.Sprintf("%s: %v", field, err))
+		return "", err
+	}
+	return plaintext, nil
+}
+
+// decryptBwgKey 解密服务器的 VEID 和 API KEY，失败时返回 errBwgSecretInvalid
+func decryptBwgKey(bwgApiKey *BwgApiKey) (string, string, error) {
+	veid, err := decryptSecret(bwgApiKey.UserId, bwgApiKey.Veid, fmt.Sprintf("bwg_api_key.veid pid=%d", bwgApiKey.Pid))
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %w", errBwgSecretInvalid, err)
+	}
+	apiKey, err := decryptSecret(bwgApiKey.UserId, bwgApiKey.ApiKey, fmt.Sprintf("bwg_api_key.api_key pid=%d", bwgApiKey.Pid))
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %w", errBwgSecretInvalid, err)
+	}
+	return veid, apiKey, nil
+}
+
+func recordAuditEvent(userId int64, event string, detail string) {
+	log.WithFields(log.Fields{"user_id": userId, "event": event}).Warn("审计事件: ", detail)
+	_ = store.Audits.InsertEvent(&AuditEvent{UserId: userId, Event: event, Detail: detail, CreateTime: time.Now()})
+}
+
+// RekeyCommand 使用当前密钥重新加密数据库中的所有密文，轮换密钥时先将旧口令放入 key.previous 再执行
+func RekeyCommand() {
+	config, err := LoadConfig(ConfigFile())
+	if err != nil {
+		log.Fatal("配置校验失败:\n", err)
+	}
+	InitStore(config.Database)
+	InitKeyring(config.Key)
+
+	keys, actions, err := store.BwgKeys.RekeySecrets(func(userId int64, ciphertext string) (string, bool, error) {
+		return keyring.Rekey(ciphertext, secret.UserData(userId))
+	})
+	if err != nil {
+		log.Fatal("重新加密失败: ", err)
+	}
+	log.Infof("重新加密完成，服务器密钥 %d 条，电源操作记录 %d 条", keys, actions)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"github.com/morooi/morooi-telegram-bot-go/secret"
+	"strings"
+	"testing"
+)
+
+func TestInitKeyringSalt(t *testing.T) {
+	initTestStore(t)
+	config := KeyConfig{Passphrase: "keyring test passphrase"}
+	InitKeyring(config)
+	keyId := keyring.CurrentKeyId()
+
+	// 重启后使用数据库中保存的盐，派生出相同的密钥
+	InitKeyring(config)
+	if keyring.CurrentKeyId() != keyId {
+		t.Fatalf("重启后密钥 ID = %s，期望 %s", keyring.CurrentKeyId(), keyId)
+	}
+
+	// 新部署生成新的盐，相同口令派生出不同的密钥
+	initTestStore(t)
+	InitKeyring(config)
+	if keyring.CurrentKeyId() == keyId {
+		t.Fatal("不同部署使用相同口令时密钥不应相同")
+	}
+}
+
+func TestDecryptSecretAudit(t *testing.T) {
+	initTestStore(t)
+	InitKeyring(KeyConfig{Passphrase: "keyring test passphrase"})
+
+	ciphertext, err := encryptSecret(1, "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := decryptSecret(1, ciphertext, "test"); err != nil || plaintext != "123456" {
+		t.Fatalf("解密结果错误: %q %v", plaintext, err)
+	}
+	// 挪用到其他用户的密文无法解密，并记录审计事件
+	if _, err := decryptSecret(2, ciphertext, "test"); !errors.Is(err, secret.ErrAuthentication) {
+		t.Fatalf("其他用户的密文应当校验失败: %v", err)
+	}
+	var events int
+	if err := store.db.Get(&events, "SELECT count(*) FROM audit_event WHERE user_id = 2 AND event = ?", AuditEventDecryptFailed); err != nil || events != 1 {
+		t.Fatalf("解密失败的审计事件 = %d 条 %v", events, err)
+	}
+}
+
+func TestRekeySecrets(t *testing.T) {
+	initTestStore(t)
+	InitKeyring(KeyConfig{Passphrase: "old passphrase"})
+	veid, _ := encryptSecret(1, "veid")
+	apiKey, _ := encryptSecret(1, "api key")
+	_ = store.BwgKeys.Insert(&BwgApiKey{UserId: 1, Veid: veid, ApiKey: apiKey, Alias: "default"})
+
+	// 轮换口令后，旧口令放在 previous 中仍然可以解密
+	InitKeyring(KeyConfig{Passphrase: "new passphrase", Previous: []string{"old passphrase"}})
+	rekey := func(userId int64, ciphertext string) (string, bool, error) {
+		return keyring.Rekey(ciphertext, secret.UserData(userId))
+	}
+	if keys, _, err := store.BwgKeys.RekeySecrets(rekey); err != nil || keys != 1 {
+		t.Fatalf("重新加密 %d 条 %v", keys, err)
+	}
+	if keys, _, err := store.BwgKeys.RekeySecrets(rekey); err != nil || keys != 0 {
+		t.Fatalf("已经是最新密钥的记录不应再次更新: %d 条 %v", keys, err)
+	}
+
+	bwgApiKey, _ := store.BwgKeys.SelectByUserIdAndAlias(1, "default")
+	if !strings.HasPrefix(bwgApiKey.Veid, "v1:"+keyring.CurrentKeyId()+":") {
+		t.Fatalf("重新加密后应当使用当前密钥: %s", bwgApiKey.Veid)
+	}
+	// 只使用新口令时可以解密重新加密后的记录
+	InitKeyring(KeyConfig{Passphrase: "new passphrase"})
+	if veid, apiKey, err := decryptBwgKey(bwgApiKey); err != nil || veid != "veid" || apiKey != "api key" {
+		t.Fatalf("解密结果错误: %q %q %v", veid, apiKey, err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	tele "gopkg.in/telebot.v3"
+	"sync"
+	"time"
+)
+
+// Docker 默认在发送 SIGTERM 10 秒后强制结束进程，需要在此之前完成退出
+const shutdownTimeout = 8 * time.Second
+
+type stopHook struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+// Lifecycle 管理后台任务的生命周期，退出时先取消 Context 通知所有后台任务，再按注册顺序执行停止函数
+type Lifecycle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	hooks []stopHook
+	once  sync.Once
+}
+
+func NewLifecycle() *Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Lifecycle{ctx: ctx, cancel: cancel}
+}
+
+// Context 在开始退出时被取消
+func (l *Lifecycle) Context() context.Context {
+	return l.ctx
+}
+
+// OnStop 注册停止函数，退出时按注册顺序依次执行
+func (l *Lifecycle) OnStop(name string, stop func(ctx context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks = append(l.hooks, stopHook{name: name, stop: stop})
+}
+
+// Shutdown 依次执行停止函数，所有步骤共用同一个截止时间，超时后剩余的步骤不再等待
+func (l *Lifecycle) Shutdown(timeout time.Duration) error {
+	err := errors.New("重复调用 Shutdown")
+	l.once.Do(func() {
+		l.cancel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		l.mu.Lock()
+		hooks := l.hooks
+		l.mu.Unlock()
+
+		errs := make([]error, 0)
+		for _, hook := range hooks {
+			start := time.Now()
+			if hookErr := l.runHook(ctx, hook); hookErr != nil {
+				log.Errorf("停止%s失败: %v", hook.name, hookErr)
+				errs = append(errs, fmt.Errorf("%s: %w", hook.name, hookErr))
+				continue
+			}
+			log.Infof("已停止%s，耗时 %s", hook.name, time.Since(start).Round(time.Millisecond))
+		}
+		err = errors.Join(errs...)
+	})
+	return err
+}
+
+// runHook 在截止时间内执行停止函数，停止函数本身不响应 ctx 时也不会阻塞后续步骤
+func (l *Lifecycle) runHook(ctx context.Context, hook stopHook) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- hook.stop(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// HandlerTracker 记录正在执行的消息处理函数。telebot 在单独的协程中执行处理函数，bot.Stop 不会等待它们完成，
+// 退出时需要在关闭数据库前调用 Wait，开始等待后到达的消息直接丢弃
+type HandlerTracker struct {
+	mu       sync.Mutex
+	running  int
+	draining bool
+	idle     chan struct{}
+}
+
+// Middleware 作为 bot.Use 的中间件，需要在注册处理函数之前调用
+func (t *HandlerTracker) Middleware(next tele.HandlerFunc) tele.HandlerFunc {
+	return func(c tele.Context) error {
+		if !t.enter() {
+			return nil
+		}
+		defer t.leave()
+		return next(c)
+	}
+}
+
+func (t *HandlerTracker) enter() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.running++
+	return true
+}
+
+func (t *HandlerTracker) leave() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running--
+	if t.running == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// Wait 不再接收新的消息，并等待正在执行的处理函数完成或 ctx 超时
+func (t *HandlerTracker) Wait(ctx context.Context) error {
+	t.mu.Lock()
+	t.draining = true
+	if t.running == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mu.Unlock()
+	return waitDone(ctx, idle)
+}
+
+// waitDone 等待 done 关闭或 ctx 超时
+func waitDone(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+func TestLifecycleShutdown(t *testing.T) {
+	lifecycle := NewLifecycle()
+	order := make([]string, 0)
+	for _, name := range []string{"first", "second", "third"} {
+		lifecycle.OnStop(name, func(ctx context.Context) error {
+			order = append(order, name)
+			return nil
+		})
+	}
+
+	if err := lifecycle.Shutdown(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(order, []string{"first", "second", "third"}) {
+		t.Errorf("停止顺序错误: %v", order)
+	}
+	if lifecycle.Context().Err() == nil {
+		t.Error("退出后 Context 应当已取消")
+	}
+	if err := lifecycle.Shutdown(time.Second); err == nil {
+		t.Error("重复调用 Shutdown 应当返回错误")
+	}
+}
+
+func TestLifecycleShutdownDeadline(t *testing.T) {
+	lifecycle := NewLifecycle()
+	block := make(chan struct{})
+	defer close(block)
+	lifecycle.OnStop("blocking", func(ctx context.Context) error {
+		<-block
+		return nil
+	})
+	skipped := true
+	lifecycle.OnStop("after", func(ctx context.Context) error {
+		skipped = false
+		return nil
+	})
+
+	start := time.Now()
+	if err := lifecycle.Shutdown(50 * time.Millisecond); err == nil {
+		t.Fatal("超时应当返回错误")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("不响应的停止函数不应阻塞退出")
+	}
+	if !skipped {
+		t.Error("超时后不应再执行剩余步骤")
+	}
+}
+
+func TestHandlerTrackerWait(t *testing.T) {
+	tracker := &HandlerTracker{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	finished := false
+	handler := tracker.Middleware(func(c tele.Context) error {
+		close(started)
+		<-release
+		finished = true
+		return nil
+	})
+	go func() { _ = handler(nil) }()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := tracker.Wait(ctx); err == nil {
+		t.Fatal("处理函数未完成时应当等待到超时")
+	}
+
+	// 开始等待后到达的消息不再处理
+	called := false
+	_ = tracker.Middleware(func(c tele.Context) error {
+		called = true
+		return nil
+	})(nil)
+	if called {
+		t.Error("退出过程中不应处理新的消息")
+	}
+
+	close(release)
+	if err := tracker.Wait(context.Background()); err != nil || !finished {
+		t.Fatalf("应当等待处理函数完成: %v", err)
+	}
+}
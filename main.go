@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -13,26 +17,101 @@ var bot *tele.Bot
 func main() {
 	log.SetFormatter(&log.TextFormatter{FullTimestamp: true, TimestampFormat: DateTimeFormat})
 
-	InitSqlite()
-	InitBot()
+	if len(os.Args) > 1 {
+		runSubcommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	path := ConfigFile()
+	config, err := LoadConfig(path)
+	if err != nil {
+		log.Fatal("配置校验失败:\n", err)
+	}
+
+	lifecycle := NewLifecycle()
+	bwgHttpClient.Stop = lifecycle.Context().Done()
+	InitStore(config.Database)
+	InitBot(config.Telegram)
 	InitCommandHandler()
-	InitChacha20()
-	InitXrayStats()
+	InitKeyring(config.Key)
+	InitCallbackSigner()
+	InitXrayStats(config.Xray)
+	InitBwgMonitor(config.Bwg)
+	InitRateLimiter(config.RateLimit)
+	InitScheduler(config)
+	InitConfigReload(path, config)
+
+	InitMetrics()
+	InitHealth(config.Telegram)
+	StartHttpServer(lifecycle, config.Http)
+
+	// 退出顺序：停止 HTTP 服务，停止接收消息并等待处理中的消息，保存剩余日志，等待定时任务完成，发出剩余告警，最后关闭数据库
+	handlers := &HandlerTracker{}
+	bot.Use(handlers.Middleware)
+	lifecycle.OnStop("Telegram 轮询", func(ctx context.Context) error {
+		bot.Stop()
+		return nil
+	})
+	lifecycle.OnStop("处理中的消息", handlers.Wait)
+	StartXrayLogWatcher(lifecycle, config.Xray.Log, config.CloudflareD1)
+	lifecycle.OnStop("定时任务", StopScheduler)
+	lifecycle.OnStop("Xray API 连接", CloseXrayApi)
+	InitAlert(lifecycle, config.Alert, config.Telegram.Owner)
+	lifecycle.OnStop("数据库", CloseStore)
 
 	for command := range commandHandlers {
 		commandHandler := commandHandlers[command]
-		bot.Handle(commandHandler.command, commandHandler.handler)
+		handler := instrumentCommand(commandHandler.command, commandHandler.handler)
+		bot.Handle(commandHandler.command, auditCommand(commandHandler.command, rateLimitCommand(commandHandler.command, handler)))
+	}
+	for unique := range callbackHandlers {
+		callbackHandler := callbackHandlers[unique]
+		handler := rateLimitCommand(callbackHandler.unique, callbackHandler.handler)
+		bot.Handle(&tele.Btn{Unique: callbackHandler.unique}, auditCommand("callback:"+callbackHandler.unique, handler))
 	}
-	bot.Handle(tele.OnText, TextHandler)
+	bot.Handle(tele.OnText, rateLimitText(TextHandler))
 
+	go bot.Start()
 	log.Info("Telegram Bot 已启动")
-	bot.Start()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	log.Info("收到退出信号，开始退出")
+	if err := lifecycle.Shutdown(shutdownTimeout); err != nil {
+		log.Error("退出时部分任务未能正常停止: ", err)
+		os.Exit(1)
+	}
+	log.Info("Telegram Bot 已退出")
+}
+
+// runSubcommand 执行命令行子命令，执行完成后退出而不启动机器人
+func runSubcommand(name string, args []string) {
+	switch {
+	case name == "rekey":
+		RekeyCommand()
+	case name == "config" && len(args) > 0 && args[0] == "check":
+		ConfigCheckCommand(args[1:])
+	case name == "restore" && len(args) == 1:
+		RestoreCommand(args[0])
+	default:
+		fmt.Fprintln(os.Stderr, "用法: morooi-telegram-bot-go [rekey | config check [配置文件] | restore <备份文件>]")
+		os.Exit(2)
+	}
 }
 
-func InitBot() {
+func InitBot(config TelegramConfig) {
+	var poller tele.Poller = &tele.LongPoller{Timeout: 10 * time.Second}
+	if len(config.Webhook.PublicUrl) > 0 {
+		webhook := newWebhookPoller(config.Webhook)
+		httpMux.Handle(config.Webhook.Path, webhook)
+		poller = webhook
+	}
+
 	pref := tele.Settings{
-		Token:     os.Getenv("TOKEN"),
-		Poller:    &tele.LongPoller{Timeout: 10 * time.Second},
+		Token:     config.Token,
+		Poller:    &healthPoller{Poller: poller},
 		ParseMode: tele.ModeMarkdownV2,
 	}
 
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	tele "gopkg.in/telebot.v3"
+	"sync"
+	"time"
+)
+
+// 使用独立的 Registry，只暴露机器人自己的指标和运行时指标
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	xrayLogLines = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "xray_log_lines_total",
+		Help: "Xray 访问日志行数，result 为 parsed（解析成功）、dropped（无法解析）或 failed（保存失败）",
+	}, []string{"result"})
+
+	cfD1Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cf_d1_requests_total",
+		Help: "发送到 CF D1 的请求数，result 为 success 或 failure",
+	}, []string{"result"})
+
+	cfD1RequestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cf_d1_request_duration_seconds",
+		Help:    "发送到 CF D1 的请求耗时",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	xrayStatsJobDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "xray_stats_job_duration_seconds",
+		Help:    "流量收集任务的耗时",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	xrayStatsJobLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "xray_stats_job_last_success_timestamp_seconds",
+		Help: "流量收集任务最后一次成功的时间",
+	})
+
+	telegramCommands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telegram_commands_total",
+		Help: "命令的调用次数",
+	}, []string{"command"})
+
+	telegramCommandErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telegram_command_errors_total",
+		Help: "命令处理返回错误的次数",
+	}, []string{"command"})
+
+	telegramRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telegram_rate_limited_total",
+		Help: "被限流的请求数，class 为命令类别",
+	}, []string{"class"})
+
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_requests_total",
+		Help: "缓存的查询次数，result 为 hit、miss 或 shared（等待其他调用方的加载结果）",
+	}, []string{"cache", "result"})
+
+	xrayTraffic = newXrayTrafficCollector()
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		xrayLogLines,
+		cfD1Requests,
+		cfD1RequestDuration,
+		xrayStatsJobDuration,
+		xrayStatsJobLastSuccess,
+		telegramCommands,
+		telegramCommandErrors,
+		telegramRateLimited,
+		cacheRequests,
+		xrayTraffic,
+	)
+}
+
+// InitMetrics 在内置 HTTP 服务上注册 /metrics
+func InitMetrics() {
+	httpMux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
+
+// instrumentCommand 统计命令的调用次数和错误次数
+func instrumentCommand(command Command, handler tele.HandlerFunc) tele.HandlerFunc {
+	name := string(command)
+	return func(c tele.Context) error {
+		telegramCommands.WithLabelValues(name).Inc()
+		err := handler(c)
+		if err != nil {
+			telegramCommandErrors.WithLabelValues(name).Inc()
+		}
+		return err
+	}
+}
+
+// xrayTrafficCollector 用户流量计数器：累计每次收集任务重置前读取的流量，抓取时再加上 Xray 中尚未重置的实时流量
+type xrayTrafficCollector struct {
+	desc *prometheus.Desc
+
+	mu        sync.Mutex
+	collected map[string]*Traffic
+}
+
+func newXrayTrafficCollector() *xrayTrafficCollector {
+	return &xrayTrafficCollector{
+		desc: prometheus.NewDesc("xray_user_traffic_bytes_total",
+			"用户流量，direction 为 up 或 down，包含 Xray 中尚未收集的实时流量", []string{"user", "direction"}, nil),
+		collected: map[string]*Traffic{},
+	}
+}
+
+// Reset 读取并重置 Xray 中的流量，累加到已收集的流量后返回。
+// 重置和累加在同一把锁内完成，抓取时不会读到已重置但尚未累加的计数
+func (x *xrayTrafficCollector) Reset() ([]*Traffic, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	traffics, err := GetTraffic(true)
+	if err != nil {
+		return nil, err
+	}
+	x.add(traffics)
+	return traffics, nil
+}
+
+// add 累加重置前读取的流量，调用方需要持有 mu
+func (x *xrayTrafficCollector) add(traffics []*Traffic) {
+	for _, traffic := range traffics {
+		total, ok := x.collected[traffic.User]
+		if !ok {
+			total = &Traffic{User: traffic.User}
+			x.collected[traffic.User] = total
+		}
+		total.Up += traffic.Up
+		total.Down += traffic.Down
+	}
+}
+
+func (x *xrayTrafficCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- x.desc
+}
+
+func (x *xrayTrafficCollector) Collect(ch chan<- prometheus.Metric) {
+	totals := map[string]Traffic{}
+	// 持有锁读取实时流量，避免与收集任务的重置交错
+	x.mu.Lock()
+	for user, traffic := range x.collected {
+		totals[user] = *traffic
+	}
+	if xrayApi.Load() != nil {
+		live, err := GetTraffic(false)
+		if err != nil {
+			log.Warn("获取 Xray 实时流量失败: ", err)
+		}
+		for _, traffic := range live {
+			total := totals[traffic.User]
+			total.Up += traffic.Up
+			total.Down += traffic.Down
+			totals[traffic.User] = total
+		}
+	}
+	x.mu.Unlock()
+
+	for user, traffic := range totals {
+		ch <- prometheus.MustNewConstMetric(x.desc, prometheus.CounterValue, float64(traffic.Up), user, "up")
+		ch <- prometheus.MustNewConstMetric(x.desc, prometheus.CounterValue, float64(traffic.Down), user, "down")
+	}
+}
+
+// observeSince 记录从 start 开始的耗时
+func observeSince(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
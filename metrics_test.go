@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	tele "gopkg.in/telebot.v3"
+	"testing"
+)
+
+func TestInstrumentCommand(t *testing.T) {
+	handler := instrumentCommand("/metrics_test", func(c tele.Context) error {
+		return errors.New("failed")
+	})
+	_ = handler(nil)
+	_ = handler(nil)
+
+	if count := testutil.ToFloat64(telegramCommands.WithLabelValues("/metrics_test")); count != 2 {
+		t.Errorf("命令调用次数错误: %v", count)
+	}
+	if count := testutil.ToFloat64(telegramCommandErrors.WithLabelValues("/metrics_test")); count != 2 {
+		t.Errorf("命令错误次数错误: %v", count)
+	}
+}
+
+func TestXrayTrafficCollectorAdd(t *testing.T) {
+	collector := newXrayTrafficCollector()
+	collector.add([]*Traffic{{User: "a", Up: 1, Down: 2}})
+	collector.add([]*Traffic{{User: "a", Up: 3, Down: 4}, {User: "b", Up: 5}})
+
+	if a := collector.collected["a"]; a.Up != 4 || a.Down != 6 {
+		t.Errorf("累计流量错误: %+v", a)
+	}
+	if b := collector.collected["b"]; b.Up != 5 || b.Down != 0 {
+		t.Errorf("累计流量错误: %+v", b)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	tele "gopkg.in/telebot.v3"
+	"maps"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RateLimitClassDefault = "default"
+	RateLimitClassBwg     = "bwg"
+	RateLimitClassXray    = "xray"
+)
+
+// 会请求 KiwiVM API 或 Xray 的命令、按钮和对话单独限流，其余命令和文本消息使用 default
+var rateLimitClasses = map[string]string{
+	BwgInfo:         RateLimitClassBwg,
+	BwgStatus:       RateLimitClassBwg,
+	BwgUsage:        RateLimitClassBwg,
+	BwgAudit:        RateLimitClassBwg,
+	BwgTrend:        RateLimitClassBwg,
+	BwgStart:        RateLimitClassBwg,
+	BwgStop:         RateLimitClassBwg,
+	BwgRestart:      RateLimitClassBwg,
+	BwgPowerUnique:  RateLimitClassBwg,
+	QueryXrayStats:  RateLimitClassXray,
+	XrayStatsUnique: RateLimitClassXray,
+	XrayExport:      RateLimitClassXray,
+	// 绑定对话中输入 API KEY 时会请求 KiwiVM API 验证
+	BwgBindConversation: RateLimitClassBwg,
+}
+
+// errRateLimited 请求被限流，已经回复过用户
+var errRateLimited = errors.New("请求过于频繁")
+
+// 清理令牌已经恢复满的桶和禁言已结束的记录的间隔，在 Allow 中顺带执行
+const rateLimitPruneInterval = 10 * time.Minute
+
+var rateLimiter atomic.Pointer[RateLimiter]
+
+// tokenBucket 令牌桶，每 Interval 恢复一个令牌，最多 Burst 个
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// offender 被限流的次数和禁言截止时间
+type offender struct {
+	strikes     int
+	firstStrike time.Time
+	mutedUntil  time.Time
+	// 本次禁言已经告知过用户，从数据库恢复的禁言在用户下次请求时告知
+	notified bool
+}
+
+type rateLimitKey struct {
+	userId int64
+	class  string
+}
+
+// RateLimitResult Allowed 为 false 时，Muted 表示处于禁言中，否则 RetryAfter 后可以重试
+type RateLimitResult struct {
+	Allowed    bool
+	RetryAfter time.Duration
+	Muted      bool
+	MutedUntil time.Time
+	// 本次请求触发了禁言
+	NewlyMuted bool
+	// 需要告知用户已被禁言，每次禁言只告知一次
+	Notify bool
+}
+
+// RateLimiter 按用户和命令类别限流，频繁被限流的用户会被暂时禁言
+type RateLimiter struct {
+	config RateLimitConfig
+
+	mu        sync.Mutex
+	buckets   map[rateLimitKey]*tokenBucket
+	offenders map[int64]*offender
+	pruned    time.Time
+}
+
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		config:    config,
+		buckets:   map[rateLimitKey]*tokenBucket{},
+		offenders: map[int64]*offender{},
+	}
+}
+
+// InitRateLimiter 创建新的限流器，重新加载配置时保留已有的禁言，开启持久化时从数据库恢复
+func InitRateLimiter(config RateLimitConfig) {
+	limiter := NewRateLimiter(config)
+	if previous := rateLimiter.Load(); previous != nil {
+		previous.mu.Lock()
+		maps.Copy(limiter.offenders, previous.offenders)
+		previous.mu.Unlock()
+	}
+	if config.Persist {
+		mutes, err := store.RateLimitMutes.SelectActive(time.Now())
+		if err != nil {
+			log.Warn("读取禁言记录失败: ", err)
+		} else {
+			for _, mute := range *mutes {
+				limiter.offenders[mute.UserId] = &offender{mutedUntil: mute.MutedUntil}
+			}
+		}
+	}
+	rateLimiter.Store(limiter)
+}
+
+func (l *RateLimiter) rule(class string) RateLimitRule {
+	switch class {
+	case RateLimitClassBwg:
+		return l.config.Bwg
+	case RateLimitClassXray:
+		return l.config.Xray
+	default:
+		return l.config.Default
+	}
+}
+
+func (l *RateLimiter) Allow(userId int64, class string, now time.Time) RateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.pruned) >= rateLimitPruneInterval {
+		l.prune(now)
+	}
+
+	record := l.offenders[userId]
+	if record != nil && now.Before(record.mutedUntil) {
+		notify := !record.notified
+		record.notified = true
+		return RateLimitResult{Muted: true, MutedUntil: record.mutedUntil, Notify: notify}
+	}
+
+	rule := l.rule(class)
+	if rule.Burst <= 0 {
+		return RateLimitResult{Allowed: true}
+	}
+	key := rateLimitKey{userId: userId, class: class}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(rule.Burst), updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(rule.Burst), bucket.tokens+float64(now.Sub(bucket.updated))/float64(rule.Interval))
+	bucket.updated = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return RateLimitResult{Allowed: true}
+	}
+	retryAfter := time.Duration((1 - bucket.tokens) * float64(rule.Interval))
+
+	if l.config.MuteAfter <= 0 {
+		return RateLimitResult{RetryAfter: retryAfter}
+	}
+	if record == nil {
+		record = &offender{}
+		l.offenders[userId] = record
+	}
+	if record.strikes == 0 || now.Sub(record.firstStrike) > l.config.MuteWindow {
+		record.strikes = 0
+		record.firstStrike = now
+	}
+	record.strikes++
+	if record.strikes < l.config.MuteAfter {
+		return RateLimitResult{RetryAfter: retryAfter}
+	}
+	record.strikes = 0
+	record.mutedUntil = now.Add(l.config.MuteDuration)
+	record.notified = true
+	return RateLimitResult{Muted: true, MutedUntil: record.mutedUntil, NewlyMuted: true, Notify: true}
+}
+
+// prune 删除令牌已经恢复满的桶，以及禁言结束且不在统计窗口内的记录，这些记录删除后与不存在时的行为一致
+func (l *RateLimiter) prune(now time.Time) {
+	l.pruned = now
+	for key, bucket := range l.buckets {
+		rule := l.rule(key.class)
+		if rule.Burst <= 0 || bucket.tokens+float64(now.Sub(bucket.updated))/float64(rule.Interval) >= float64(rule.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	for userId, record := range l.offenders {
+		if !now.Before(record.mutedUntil) && (record.strikes == 0 || now.Sub(record.firstStrike) > l.config.MuteWindow) {
+			delete(l.offenders, userId)
+		}
+	}
+}
+
+func rateLimitClass(name string) string {
+	if class, ok := rateLimitClasses[name]; ok {
+		return class
+	}
+	return RateLimitClassDefault
+}
+
+// rateLimitCommand 按命令类别限流
+func rateLimitCommand(name string, handler tele.HandlerFunc) tele.HandlerFunc {
+	class := rateLimitClass(name)
+	return func(c tele.Context) error {
+		return rateLimit(c, class, handler)
+	}
+}
+
+// rateLimitText 对话中的输入按对话的类别限流，未知命令等其余文本消息按 default 限流
+func rateLimitText(handler tele.HandlerFunc) tele.HandlerFunc {
+	return func(c tele.Context) error {
+		class := RateLimitClassDefault
+		if conversation, ok := conversations.Current(c); ok && !IsCommand(c.Message()) {
+			class = rateLimitClass(conversation.Name)
+		}
+		return rateLimit(c, class, handler)
+	}
+}
+
+// rateLimit 按 class 限流，所有者不受限制，被限流时回复用户并返回 errRateLimited
+func rateLimit(c tele.Context, class string, handler tele.HandlerFunc) error {
+	limiter := rateLimiter.Load()
+	sender := c.Sender()
+	if limiter == nil || sender == nil || IsOwner(sender.ID) {
+		return handler(c)
+	}
+
+	result := limiter.Allow(sender.ID, class, time.Now())
+	if result.Allowed {
+		return handler(c)
+	}
+	telegramRateLimited.WithLabelValues(class).Inc()
+
+	if result.NewlyMuted {
+		log.Warnf("用户 %d 频繁请求，禁言至 %s", sender.ID, result.MutedUntil.Format(DateTimeFormat))
+		if limiter.config.Persist {
+			_ = store.RateLimitMutes.Save(&RateLimitMute{UserId: sender.ID, MutedUntil: result.MutedUntil, UpdateTime: time.Now()})
+		}
+	}
+
+	var message string
+	switch {
+	case result.Notify:
+		message = fmt.Sprintf("请求过于频繁，已被暂时禁言，请在 %s 后重试", result.MutedUntil.Format(DateTimeFormat))
+	case result.Muted:
+		// 已经告知过禁言，之后不再回复消息，只结束按钮的加载状态
+		if c.Callback() != nil {
+			_ = c.Respond()
+		}
+		return errRateLimited
+	default:
+		message = fmt.Sprintf("请求过于频繁，请在 %d 秒后重试", int(math.Ceil(result.RetryAfter.Seconds())))
+	}
+
+	if c.Callback() != nil {
+		_ = c.Respond(&tele.CallbackResponse{Text: message, ShowAlert: true})
+	} else {
+		_ = c.Send(ReplaceForMarkdownV2(message))
+	}
+	return errRateLimited
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{
+		Default: RateLimitRule{Burst: 2, Interval: 10 * time.Second},
+		Bwg:     RateLimitRule{Burst: 1, Interval: 20 * time.Second},
+	})
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.Local)
+
+	for i := 0; i < 2; i++ {
+		if !limiter.Allow(1, RateLimitClassDefault, now).Allowed {
+			t.Fatalf("第 %d 次请求应当允许", i+1)
+		}
+	}
+	result := limiter.Allow(1, RateLimitClassDefault, now)
+	if result.Allowed || result.RetryAfter != 10*time.Second {
+		t.Fatalf("令牌用完后 = %+v", result)
+	}
+	if result := limiter.Allow(1, RateLimitClassDefault, now.Add(4*time.Second)); result.Allowed || result.RetryAfter != 6*time.Second {
+		t.Fatalf("部分恢复后 = %+v", result)
+	}
+	if !limiter.Allow(1, RateLimitClassDefault, now.Add(10*time.Second)).Allowed {
+		t.Fatal("恢复一个令牌后应当允许")
+	}
+
+	// 不同类别和不同用户分别计算
+	if !limiter.Allow(1, RateLimitClassBwg, now).Allowed || limiter.Allow(1, RateLimitClassBwg, now).Allowed {
+		t.Fatal("bwg 类别应当只允许 1 次")
+	}
+	if !limiter.Allow(2, RateLimitClassDefault, now).Allowed {
+		t.Fatal("其他用户不受影响")
+	}
+
+	// 未配置的类别不限制
+	for i := 0; i < 10; i++ {
+		if !limiter.Allow(1, RateLimitClassXray, now).Allowed {
+			t.Fatal("burst 为 0 时不限制")
+		}
+	}
+}
+
+func TestRateLimiterMute(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{
+		Default:      RateLimitRule{Burst: 1, Interval: time.Minute},
+		MuteAfter:    3,
+		MuteWindow:   time.Minute,
+		MuteDuration: 10 * time.Minute,
+	})
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.Local)
+	limiter.Allow(1, RateLimitClassDefault, now)
+
+	for i := 1; i < 3; i++ {
+		if result := limiter.Allow(1, RateLimitClassDefault, now.Add(time.Duration(i)*time.Second)); result.Muted {
+			t.Fatalf("第 %d 次被限流不应禁言", i)
+		}
+	}
+	result := limiter.Allow(1, RateLimitClassDefault, now.Add(3*time.Second))
+	if !result.NewlyMuted || !result.Notify || !result.MutedUntil.Equal(now.Add(3*time.Second+10*time.Minute)) {
+		t.Fatalf("第 3 次被限流应当禁言: %+v", result)
+	}
+
+	// 禁言期间所有类别都拒绝，且不再重复通知
+	if result := limiter.Allow(1, RateLimitClassBwg, now.Add(5*time.Minute)); result.Allowed || !result.Muted || result.NewlyMuted || result.Notify {
+		t.Fatalf("禁言期间 = %+v", result)
+	}
+	if !limiter.Allow(1, RateLimitClassDefault, now.Add(11*time.Minute)).Allowed {
+		t.Fatal("禁言结束后应当允许")
+	}
+}
+
+func TestRateLimiterRestoredMuteNotify(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{Default: RateLimitRule{Burst: 1, Interval: time.Minute}, MuteAfter: 3})
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.Local)
+	// 从数据库恢复的禁言没有告知过用户，第一次请求时告知
+	limiter.offenders[1] = &offender{mutedUntil: now.Add(time.Hour)}
+	if result := limiter.Allow(1, RateLimitClassDefault, now); !result.Muted || result.NewlyMuted || !result.Notify {
+		t.Fatalf("恢复的禁言第一次请求 = %+v", result)
+	}
+	if result := limiter.Allow(1, RateLimitClassDefault, now); !result.Muted || result.Notify {
+		t.Fatalf("恢复的禁言再次请求 = %+v", result)
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{
+		Default:      RateLimitRule{Burst: 2, Interval: 10 * time.Second},
+		MuteAfter:    1,
+		MuteWindow:   time.Minute,
+		MuteDuration: 30 * time.Minute,
+	})
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.Local)
+	limiter.Allow(1, RateLimitClassDefault, now)
+	for range 3 {
+		limiter.Allow(2, RateLimitClassDefault, now)
+	}
+	limiter.Allow(3, RateLimitClassDefault, now.Add(rateLimitPruneInterval-time.Second))
+	if len(limiter.buckets) != 3 || len(limiter.offenders) != 1 {
+		t.Fatalf("清理前 %d 个令牌桶，%d 条禁言记录", len(limiter.buckets), len(limiter.offenders))
+	}
+
+	// 令牌已经恢复满的桶被删除，仍在禁言中的记录保留
+	limiter.Allow(4, RateLimitClassDefault, now.Add(rateLimitPruneInterval))
+	if len(limiter.buckets) != 2 || limiter.buckets[rateLimitKey{userId: 3, class: RateLimitClassDefault}] == nil {
+		t.Fatalf("清理后的令牌桶 = %v", limiter.buckets)
+	}
+	if limiter.offenders[2] == nil {
+		t.Fatal("禁言中的记录不应被清理")
+	}
+	if result := limiter.Allow(2, RateLimitClassDefault, now.Add(rateLimitPruneInterval)); !result.Muted {
+		t.Fatalf("清理后仍然应当禁言: %+v", result)
+	}
+
+	limiter.Allow(4, RateLimitClassDefault, now.Add(3*rateLimitPruneInterval))
+	if len(limiter.offenders) != 0 || len(limiter.buckets) != 1 {
+		t.Fatalf("禁言结束后 %d 个令牌桶，%d 条禁言记录", len(limiter.buckets), len(limiter.offenders))
+	}
+}
+
+func TestRateLimitCommandMuteNotice(t *testing.T) {
+	previous := rateLimiter.Load()
+	t.Cleanup(func() { rateLimiter.Store(previous) })
+	rateLimiter.Store(NewRateLimiter(RateLimitConfig{
+		Default:      RateLimitRule{Burst: 1, Interval: time.Minute},
+		MuteAfter:    2,
+		MuteWindow:   time.Minute,
+		MuteDuration: time.Hour,
+	}))
+	handler := rateLimitCommand(Info, func(c tele.Context) error { return c.Send("ok") })
+
+	replies := make([]string, 0)
+	for range 5 {
+		c := newFakeContext(1, 10, "/info")
+		_ = handler(c)
+		replies = append(replies, c.lastSent())
+	}
+	// 第二次请求被限流，第三次触发禁言并告知，之后不再回复
+	if replies[0] != "ok" || !strings.Contains(replies[1], "秒后重试") || !strings.Contains(replies[2], "已被暂时禁言") || replies[3] != "" || replies[4] != "" {
+		t.Fatalf("回复 = %q", replies)
+	}
+}
+
+func TestRateLimitTextInConversation(t *testing.T) {
+	server := newFakeKiwiVM(t)
+	defer server.Close()
+	baseUrl := bwgApiBaseUrl
+	bwgApiBaseUrl = server.URL + "/v1"
+	t.Cleanup(func() { bwgApiBaseUrl = baseUrl })
+
+	previous := rateLimiter.Load()
+	t.Cleanup(func() { rateLimiter.Store(previous) })
+	rateLimiter.Store(NewRateLimiter(RateLimitConfig{
+		Default: RateLimitRule{Burst: 1, Interval: time.Minute},
+		Bwg:     RateLimitRule{Burst: 2, Interval: time.Minute},
+	}))
+	handler := rateLimitText(TextHandler)
+	send := func(userId int64, text string) string {
+		c := newFakeContext(1, userId, text)
+		_ = handler(c)
+		return c.lastSent()
+	}
+
+	// 绑定对话中的输入按 bwg 类别限流，被限流的 API KEY 不会请求 KiwiVM
+	_ = BwgBindHandler(newFakeContext(1, 10, "/bwg_bind main"))
+	t.Cleanup(func() { _ = CancelHandler(newFakeContext(1, 10, "/cancel")) })
+	if reply := send(10, "123456"); !strings.Contains(reply, "请输入 API KEY") {
+		t.Fatalf("输入 VEID 后的回复 = %q", reply)
+	}
+	if reply := send(10, "wrong"); !strings.Contains(reply, "验证失败") {
+		t.Fatalf("API KEY 错误的回复 = %q", reply)
+	}
+	if reply := send(10, "wrong again"); !strings.Contains(reply, "请求过于频繁") {
+		t.Fatalf("频繁输入 API KEY 的回复 = %q", reply)
+	}
+	// 对话之外的消息按 default 类别限流，不占用 bwg 的令牌
+	if reply := send(11, "hello"); !strings.Contains(reply, "只支持输入命令") {
+		t.Fatalf("第一条消息的回复 = %q", reply)
+	}
+	if reply := send(11, "hello"); !strings.Contains(reply, "请求过于频繁") {
+		t.Fatalf("频繁发送消息的回复 = %q", reply)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	tele "gopkg.in/telebot.v3"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// 当前生效的配置和来源文件
+var (
+	currentConfig atomic.Pointer[Config]
+	configFile    string
+)
+
+// 全局定时任务实例，重新加载配置时整体替换
+var (
+	schedulerMu sync.Mutex
+	scheduler   *cron.Cron
+	// 重新加载时被替换的调度器，退出时同样需要等待其中的任务完成
+	stoppingScheduler context.Context
+	// 已经开始退出，重新加载时不再启动新的调度器
+	schedulerClosed bool
+)
+
+// 保证同一时间只有一次重新加载
+var reloadMu sync.Mutex
+
+// configField 描述一项配置能否在运行时重新加载，keep 不为空时需要重启才能生效，
+// 重新加载时用 keep 将其恢复为正在使用的值，下次重新加载仍然与正在使用的值比较
+type configField struct {
+	name  string
+	value func(config *Config) any
+	keep  func(next *Config, running *Config)
+}
+
+var configFields = []configField{
+	{"telegram.token", func(c *Config) any { return c.Telegram.Token }, func(next *Config, running *Config) { next.Telegram.Token = running.Telegram.Token }},
+	{"telegram.webhook", func(c *Config) any { return c.Telegram.Webhook }, func(next *Config, running *Config) { next.Telegram.Webhook = running.Telegram.Webhook }},
+	{"telegram.owner", func(c *Config) any { return c.Telegram.Owner }, nil},
+	{"key", func(c *Config) any { return c.Key }, func(next *Config, running *Config) { next.Key = running.Key }},
+	{"database", func(c *Config) any { return c.Database }, func(next *Config, running *Config) { next.Database = running.Database }},
+	{"xray.api", func(c *Config) any { return c.Xray.Api }, nil},
+	{"xray.stats_cron", func(c *Config) any { return c.Xray.StatsCron }, nil},
+	{"xray.admins", func(c *Config) any { return c.Xray.Admins }, nil},
+	{"xray.digest", func(c *Config) any { return c.Xray.Digest }, nil},
+	{"xray.anomaly", func(c *Config) any { return c.Xray.Anomaly }, nil},
+	{"xray.log.path", func(c *Config) any { return c.Xray.Log.Path }, func(next *Config, running *Config) { next.Xray.Log.Path = running.Xray.Log.Path }},
+	{"xray.log.server_name", func(c *Config) any { return c.Xray.Log.ServerName }, func(next *Config, running *Config) { next.Xray.Log.ServerName = running.Xray.Log.ServerName }},
+	{"xray.log.ignore_ips", func(c *Config) any { return c.Xray.Log.IgnoreIps }, nil},
+	{"xray.log.ignore_users", func(c *Config) any { return c.Xray.Log.IgnoreUsers }, nil},
+	{"bwg", func(c *Config) any { return c.Bwg }, nil},
+	{"cloudflare_d1", func(c *Config) any { return c.CloudflareD1 }, func(next *Config, running *Config) { next.CloudflareD1 = running.CloudflareD1 }},
+	{"http", func(c *Config) any { return c.Http }, func(next *Config, running *Config) { next.Http = running.Http }},
+	{"alert.chat", func(c *Config) any { return c.Alert.Chat }, nil},
+	{"alert.window", func(c *Config) any { return c.Alert.Window }, func(next *Config, running *Config) { next.Alert.Window = running.Alert.Window }},
+	{"alert.interval", func(c *Config) any { return c.Alert.Interval }, func(next *Config, running *Config) { next.Alert.Interval = running.Alert.Interval }},
+	{"rate_limit", func(c *Config) any { return c.RateLimit }, nil},
+	{"backup", func(c *Config) any { return c.Backup }, nil},
+}
+
+// ReloadResult 重新加载的结果，Restart 中的配置需要重启后才能生效
+type ReloadResult struct {
+	Applied []string
+	Restart []string
+}
+
+// InitScheduler 按配置创建并启动所有定时任务
+func InitScheduler(config *Config) {
+	next, err := NewScheduler(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	schedulerMu.Lock()
+	defer schedulerMu.Unlock()
+	scheduler = next
+	stoppingScheduler = nil
+	schedulerClosed = false
+	scheduler.Start()
+}
+
+// NewScheduler 按配置创建包含所有定时任务的调度器，不会启动
+func NewScheduler(config *Config) (*cron.Cron, error) {
+	next := cron.New()
+	if err := AddStatsJob(next, config.Xray.StatsCron); err != nil {
+		return nil, err
+	}
+	if err := AddDigestJobs(next, config.Xray.Digest); err != nil {
+		return nil, err
+	}
+	if err := AddBwgMonitorJob(next, config.Bwg.MonitorCron); err != nil {
+		return nil, err
+	}
+	if err := AddBackupJob(next, config.Backup); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// StopScheduler 停止调度新的任务，并等待正在执行的任务完成，包括重新加载时被替换的调度器中的任务
+func StopScheduler(ctx context.Context) error {
+	schedulerMu.Lock()
+	schedulerClosed = true
+	current, stopping := scheduler, stoppingScheduler
+	schedulerMu.Unlock()
+
+	if stopping != nil {
+		if err := waitDone(ctx, stopping.Done()); err != nil {
+			return err
+		}
+	}
+	return waitDone(ctx, current.Stop().Done())
+}
+
+// InitConfigReload 记录当前配置，并在收到 SIGHUP 时重新加载
+func InitConfigReload(path string, config *Config) {
+	configFile = path
+	currentConfig.Store(config)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			log.Info("收到 SIGHUP，重新加载配置")
+			result, err := ReloadConfig()
+			notifyOwner(buildReloadMessage(result, err))
+		}
+	}()
+}
+
+// ReloadConfig 重新读取配置文件并应用，校验失败时保留原配置
+func ReloadConfig() (*ReloadResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	next, err := LoadConfig(configFile)
+	if err != nil {
+		log.WithField("component", "config").Error("重新加载配置失败，继续使用原配置: ", err)
+		return nil, err
+	}
+	nextScheduler, err := NewScheduler(next)
+	if err != nil {
+		log.WithField("component", "config").Error("重新加载配置失败，继续使用原配置: ", err)
+		return nil, err
+	}
+
+	previous := currentConfig.Load()
+	result := &ReloadResult{Applied: make([]string, 0), Restart: make([]string, 0)}
+	for _, field := range configFields {
+		if reflect.DeepEqual(field.value(previous), field.value(next)) {
+			continue
+		}
+		if field.keep == nil {
+			result.Applied = append(result.Applied, field.name)
+		} else {
+			result.Restart = append(result.Restart, field.name)
+			field.keep(next, previous)
+		}
+	}
+
+	InitXrayStats(next.Xray)
+	InitBwgMonitor(next.Bwg)
+	InitRateLimiter(next.RateLimit)
+	SetAlertChat(next.Alert, next.Telegram.Owner)
+
+	// 旧调度器中的任务完成后再启动新的调度器，避免同一任务并发执行
+	schedulerMu.Lock()
+	stopping := scheduler.Stop()
+	stoppingScheduler = stopping
+	schedulerMu.Unlock()
+	<-stopping.Done()
+	schedulerMu.Lock()
+	if !schedulerClosed {
+		scheduler = nextScheduler
+		scheduler.Start()
+	}
+	schedulerMu.Unlock()
+
+	currentConfig.Store(next)
+	log.Infof("配置已重新加载，已生效: %v，需重启: %v", result.Applied, result.Restart)
+	return result, nil
+}
+
+func IsOwner(userId int64) bool {
+	config := currentConfig.Load()
+	return config != nil && config.Telegram.Owner != 0 && config.Telegram.Owner == userId
+}
+
+func notifyOwner(message string) {
+	config := currentConfig.Load()
+	if config == nil || config.Telegram.Owner == 0 {
+		return
+	}
+	if _, err := bot.Send(&tele.User{ID: config.Telegram.Owner}, message); err != nil {
+		log.Warn("发送消息给所有者失败: ", err)
+	}
+}
+
+func buildReloadMessage(result *ReloadResult, err error) string {
+	if err != nil {
+		return fmt.Sprintf("*重新加载配置失败*，继续使用原配置\n```\n%s\n```", strings.ReplaceAll(strings.ReplaceAll(err.Error(), "\\", "\\\\"), "`", "\\`"))
+	}
+
+	msgSlice := []string{"*配置已重新加载*"}
+	if len(result.Applied) == 0 && len(result.Restart) == 0 {
+		msgSlice = append(msgSlice, "配置没有变化")
+	}
+	if len(result.Applied) > 0 {
+		msgSlice = append(msgSlice, fmt.Sprintf("已生效：%s", ReplaceForMarkdownV2(strings.Join(result.Applied, ", "))))
+	}
+	if len(result.Restart) > 0 {
+		msgSlice = append(msgSlice, fmt.Sprintf("需重启后生效：%s", ReplaceForMarkdownV2(strings.Join(result.Restart, ", "))))
+	}
+	return strings.Join(msgSlice, "\n")
+}
+
+func ReloadHandler(c tele.Context) error {
+	if !IsOwner(c.Sender().ID) {
+		return replyFailure(c, "无操作权限")
+	}
+	result, err := ReloadConfig()
+	if err != nil {
+		markAuditFailure(c, err.Error())
+	}
+	return c.Send(buildReloadMessage(result, err))
+}
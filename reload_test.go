@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"github.com/robfig/cron/v3"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+telegram:
+  token: "123:abc"
+key:
+  passphrase: "a passphrase long enough"
+xray:
+  admins: [1]
+`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile = path
+	currentConfig.Store(config)
+	initTestStore(t)
+	InitXrayStats(config.Xray)
+	InitBwgMonitor(config.Bwg)
+	InitScheduler(config)
+	defer scheduler.Stop()
+	infoCache := bwgInfoCache.Load()
+
+	err = os.WriteFile(path, []byte(`
+telegram:
+  token: "456:def"
+key:
+  passphrase: "a passphrase long enough"
+xray:
+  admins: [1, 2]
+  stats_cron: "*/10 * * * *"
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ReloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(result.Applied, []string{"xray.stats_cron", "xray.admins"}) || !slices.Equal(result.Restart, []string{"telegram.token"}) {
+		t.Errorf("重新加载结果错误: %+v", result)
+	}
+	if !IsXrayStatsAdmin(2) {
+		t.Error("管理员列表应当已更新")
+	}
+	if bwgInfoCache.Load() != infoCache {
+		t.Error("缓存时间未改变时应当保留服务器信息缓存")
+	}
+	// 需要重启的配置保留正在使用的值，再次重新加载时仍然提示需要重启
+	if token := currentConfig.Load().Telegram.Token; token != "123:abc" {
+		t.Errorf("需要重启的配置不应被替换: %s", token)
+	}
+	if result, err := ReloadConfig(); err != nil || len(result.Applied) != 0 || !slices.Equal(result.Restart, []string{"telegram.token"}) {
+		t.Errorf("再次重新加载结果错误: %+v %v", result, err)
+	}
+
+	_ = os.WriteFile(path, []byte(`
+telegram:
+  token: "456:def"
+key:
+  passphrase: "a passphrase long enough"
+xray:
+  admins: [1, 2]
+  stats_cron: "*/10 * * * *"
+bwg:
+  info_cache_ttl: "5m"
+`), 0600)
+	if result, err := ReloadConfig(); err != nil || !slices.Equal(result.Applied, []string{"bwg"}) {
+		t.Errorf("修改缓存时间的重新加载结果错误: %+v %v", result, err)
+	}
+	if cache := bwgInfoCache.Load(); cache == infoCache || cache.ttl != 5*time.Minute {
+		t.Error("缓存时间改变时应当重建服务器信息缓存")
+	}
+
+	_ = os.WriteFile(path, []byte("xray:\n  stats_cron: \"invalid\"\n"), 0600)
+	if _, err := ReloadConfig(); err == nil {
+		t.Fatal("无效配置应当重新加载失败")
+	}
+	if currentConfig.Load().Xray.StatsCron != "*/10 * * * *" || !IsXrayStatsAdmin(2) {
+		t.Error("重新加载失败时应当保留原配置")
+	}
+}
+
+func TestReloadAlertChatAndLogFilter(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+telegram:
+  token: "123:abc"
+  owner: 1
+key:
+  passphrase: "a passphrase long enough"
+`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile = path
+	currentConfig.Store(config)
+	initTestStore(t)
+	InitXrayStats(config.Xray)
+	InitBwgMonitor(config.Bwg)
+	InitScheduler(config)
+	defer scheduler.Stop()
+	SetAlertChat(config.Alert, config.Telegram.Owner)
+
+	line := "2024/05/01 10:00:00.123456 from 1.2.3.4:50000 accepted tcp:example.com:443 [in >> out] email: alice-1"
+	if _, ok := parseXrayLogEntry(line); !ok {
+		t.Fatal("默认配置应当保存该日志")
+	}
+	if _, ok := parseXrayLogEntry(strings.Replace(line, "1.2.3.4", "127.0.0.1", 1)); ok {
+		t.Fatal("默认配置应当丢弃本机发起的请求")
+	}
+
+	err = os.WriteFile(path, []byte(`
+telegram:
+  token: "123:abc"
+  owner: 2
+key:
+  passphrase: "a passphrase long enough"
+xray:
+  log:
+    ignore_ips: ["1.2.3.4"]
+    ignore_users: ["bob"]
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ReloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(result.Applied, []string{"telegram.owner", "xray.log.ignore_ips", "xray.log.ignore_users"}) || len(result.Restart) != 0 {
+		t.Errorf("重新加载结果错误: %+v", result)
+	}
+	// 未设置 alert.chat 时告警跟随所有者
+	if chat := alertChat.Load(); chat != 2 {
+		t.Errorf("告警会话 = %d，期望 2", chat)
+	}
+	if _, ok := parseXrayLogEntry(line); ok {
+		t.Error("新的过滤规则应当立即生效")
+	}
+	if _, ok := parseXrayLogEntry(strings.Replace(line, "1.2.3.4", "127.0.0.1", 1)); !ok {
+		t.Error("覆盖 ignore_ips 后不再丢弃本机发起的请求")
+	}
+	if _, ok := parseXrayLogEntry(strings.NewReplacer("1.2.3.4", "5.6.7.8", "alice", "bob").Replace(line)); ok {
+		t.Error("ignore_users 中的用户应当被丢弃")
+	}
+}
+
+func TestReloadWaitsForRunningJobs(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+telegram:
+  token: "123:abc"
+key:
+  passphrase: "a passphrase long enough"
+`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile = path
+	currentConfig.Store(config)
+	initTestStore(t)
+	InitXrayStats(config.Xray)
+	InitBwgMonitor(config.Bwg)
+
+	// 旧调度器中有一个正在执行的任务
+	previous := cron.New(cron.WithSeconds())
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	_, _ = previous.AddFunc("* * * * * *", func() {
+		once.Do(func() {
+			close(started)
+			<-release
+		})
+	})
+	schedulerMu.Lock()
+	scheduler = previous
+	schedulerClosed = false
+	schedulerMu.Unlock()
+	previous.Start()
+	<-started
+
+	reloaded := make(chan struct{})
+	go func() {
+		_, _ = ReloadConfig()
+		close(reloaded)
+	}()
+	select {
+	case <-reloaded:
+		t.Fatal("旧调度器中的任务完成前不应启动新的调度器")
+	case <-time.After(200 * time.Millisecond):
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := StopScheduler(ctx); err == nil {
+		t.Fatal("退出时应当等待旧调度器中的任务")
+	}
+
+	close(release)
+	<-reloaded
+	schedulerMu.Lock()
+	defer schedulerMu.Unlock()
+	if scheduler != previous {
+		t.Error("已经开始退出时不应启动新的调度器")
+	}
+}
@@ -0,0 +1,220 @@
+// Package secret 负责数据库中敏感信息的加密，支持密钥轮换和绑定用户的关联数据
+package secret
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// 密文格式为 <version>:<keyId>:<base64(nonce|ciphertext)>，密钥由口令和每个部署随机生成的盐派生，
+// 关联数据（如用户 ID）参与认证。没有前缀的旧版本密文使用 32 字节的原始口令直接加密，仅用于兼容解密，执行 rekey 后升级
+const versionV1 = "v1"
+
+// SaltSize 每个部署随机生成的盐的长度
+const SaltSize = 16
+
+// Argon2id 参数，口令只在启动时派生一次
+const (
+	argon2Time    = 1
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	keySize       = chacha20poly1305.KeySize
+)
+
+var (
+	// ErrMalformed 密文格式或长度错误
+	ErrMalformed = errors.New("密文格式错误")
+	// ErrUnknownKey 找不到密文对应的密钥
+	ErrUnknownKey = errors.New("找不到密文对应的密钥")
+	// ErrAuthentication 密文被篡改，或关联数据不匹配
+	ErrAuthentication = errors.New("密文校验失败")
+)
+
+type key struct {
+	id     string
+	master []byte
+	aead   cipher.AEAD
+}
+
+// Keyring 管理当前加密密钥和可用于解密的历史密钥
+type Keyring struct {
+	salt    []byte
+	current *key
+	keys    map[string]*key
+	// 没有前缀的旧版本密文使用 32 字节的原始口令直接加密
+	legacy []cipher.AEAD
+}
+
+// GenerateSalt 生成新部署使用的随机盐，需要和数据一起长期保存，丢失后无法解密
+func GenerateSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// NewKeyring 使用部署的盐从口令派生当前密钥，previous 中的旧口令仅用于解密
+func NewKeyring(salt []byte, passphrase string, previous ...string) (*Keyring, error) {
+	if len(salt) != SaltSize {
+		return nil, fmt.Errorf("盐的长度应为 %d 字节", SaltSize)
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("加密口令不可以为空")
+	}
+
+	k := &Keyring{salt: salt, keys: map[string]*key{}, legacy: make([]cipher.AEAD, 0)}
+	for i, p := range append([]string{passphrase}, previous...) {
+		derived, err := deriveKey(p, salt)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			k.current = derived
+		}
+		k.keys[derived.id] = derived
+
+		if len(p) == keySize {
+			aead, err := chacha20poly1305.New([]byte(p))
+			if err != nil {
+				return nil, err
+			}
+			k.legacy = append(k.legacy, aead)
+		}
+	}
+	return k, nil
+}
+
+func deriveKey(passphrase string, salt []byte) (*key, error) {
+	master := argon2.IDKey([]byte(passphrase), salt, argon2Time, argon2Memory, argon2Threads, keySize)
+
+	encryptionKey, err := expand(master, "encryption")
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// 密钥 ID 由密钥本身计算，不会泄露口令，也不需要额外保存
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte("key-id"))
+	return &key{id: hex.EncodeToString(mac.Sum(nil)[:4]), master: master, aead: aead}, nil
+}
+
+func expand(master []byte, info string) ([]byte, error) {
+	derived := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, nil, []byte(info)), derived); err != nil {
+		return nil, err
+	}
+	return derived, nil
+}
+
+// UserData 返回用户 ID 对应的关联数据，使一个用户的密文无法挪用到另一个用户的记录中
+func UserData(userId int64) []byte {
+	return []byte("user:" + strconv.FormatInt(userId, 10))
+}
+
+// CurrentKeyId 当前加密密钥的 ID
+func (k *Keyring) CurrentKeyId() string {
+	return k.current.id
+}
+
+// DeriveKey 从当前密钥派生其他用途的子密钥
+func (k *Keyring) DeriveKey(info string) ([]byte, error) {
+	return expand(k.current.master, info)
+}
+
+// Encrypt 使用当前密钥加密，associatedData 在解密时必须一致
+func (k *Keyring) Encrypt(plaintext string, associatedData []byte) (string, error) {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	ciphertext := k.current.aead.Seal(nonce, nonce, []byte(plaintext), associatedData)
+	return fmt.Sprintf("%s:%s:%s", versionV1, k.current.id, base64.StdEncoding.EncodeToString(ciphertext)), nil
+}
+
+// Decrypt 解密当前格式和没有前缀的旧版本密文，associatedData 对旧版本密文不生效
+func (k *Keyring) Decrypt(envelope string, associatedData []byte) (string, error) {
+	version, keyId, payload := parse(envelope)
+	ciphertextWithNonce, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", ErrMalformed
+	}
+	if len(ciphertextWithNonce) < chacha20poly1305.NonceSize+chacha20poly1305.Overhead {
+		return "", ErrMalformed
+	}
+	nonce := ciphertextWithNonce[:chacha20poly1305.NonceSize]
+	ciphertext := ciphertextWithNonce[chacha20poly1305.NonceSize:]
+
+	switch version {
+	case versionV1:
+		derived, ok := k.keys[keyId]
+		if !ok {
+			return "", ErrUnknownKey
+		}
+		plaintext, err := derived.aead.Open(nil, nonce, ciphertext, associatedData)
+		if err != nil {
+			return "", ErrAuthentication
+		}
+		return string(plaintext), nil
+	default:
+		if len(k.legacy) == 0 {
+			return "", ErrUnknownKey
+		}
+		for _, aead := range k.legacy {
+			if plaintext, err := aead.Open(nil, nonce, ciphertext, nil); err == nil {
+				return string(plaintext), nil
+			}
+		}
+		return "", ErrAuthentication
+	}
+}
+
+// NeedsRekey 判断密文是否需要使用当前密钥重新加密
+func (k *Keyring) NeedsRekey(envelope string) bool {
+	version, keyId, _ := parse(envelope)
+	return version != versionV1 || keyId != k.current.id
+}
+
+// Rekey 使用当前密钥和关联数据重新加密，已经是最新格式的密文原样返回
+func (k *Keyring) Rekey(envelope string, associatedData []byte) (string, bool, error) {
+	if !k.NeedsRekey(envelope) {
+		// 仍然校验一次，避免被挪用的密文在重新加密时被认可
+		if _, err := k.Decrypt(envelope, associatedData); err != nil {
+			return "", false, err
+		}
+		return envelope, false, nil
+	}
+	plaintext, err := k.Decrypt(envelope, associatedData)
+	if err != nil {
+		return "", false, err
+	}
+	rekeyed, err := k.Encrypt(plaintext, associatedData)
+	if err != nil {
+		return "", false, err
+	}
+	return rekeyed, true, nil
+}
+
+func parse(envelope string) (version string, keyId string, payload string) {
+	parts := strings.SplitN(envelope, ":", 3)
+	if len(parts) != 3 || parts[0] != versionV1 {
+		return "", "", envelope
+	}
+	return parts[0], parts[1], parts[2]
+}
@@ -0,0 +1,156 @@
+package secret
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"strings"
+	"testing"
+)
+
+// 每次派生都会执行 Argon2，测试中复用同一组密钥
+var (
+	testSalt      = []byte("0123456789abcdef")
+	oldKeyring, _ = NewKeyring(testSalt, "old passphrase")
+	newKeyring, _ = NewKeyring(testSalt, "a much longer new passphrase of any length", "old passphrase")
+)
+
+func TestNewKeyringInvalid(t *testing.T) {
+	if _, err := NewKeyring(testSalt, ""); err == nil {
+		t.Fatal("空口令应当返回错误")
+	}
+	if _, err := NewKeyring(testSalt[:SaltSize-1], "old passphrase"); err == nil {
+		t.Fatal("过短的盐应当返回错误")
+	}
+}
+
+func TestKeyringSalt(t *testing.T) {
+	salt, err := GenerateSalt()
+	if err != nil || len(salt) != SaltSize {
+		t.Fatalf("生成盐失败: %v", err)
+	}
+	other, _ := NewKeyring(salt, "old passphrase")
+	if other.CurrentKeyId() == oldKeyring.CurrentKeyId() {
+		t.Fatal("相同口令在不同部署中应当派生出不同的密钥")
+	}
+	ciphertext, _ := oldKeyring.Encrypt("123456", UserData(1))
+	if _, err := other.Decrypt(ciphertext, UserData(1)); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("其他部署的密文不应能解密: %v", err)
+	}
+	first, _ := oldKeyring.DeriveKey("telegram-callback")
+	second, _ := other.DeriveKey("telegram-callback")
+	if string(first) == string(second) {
+		t.Fatal("不同部署派生的子密钥应当不同")
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	ciphertext, err := newKeyring.Encrypt("123456", UserData(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(ciphertext, "v1:"+newKeyring.CurrentKeyId()+":") {
+		t.Fatalf("密文缺少版本前缀: %s", ciphertext)
+	}
+	if plaintext, err := newKeyring.Decrypt(ciphertext, UserData(1)); err != nil || plaintext != "123456" {
+		t.Fatalf("解密结果错误: %q %v", plaintext, err)
+	}
+
+	another, _ := newKeyring.Encrypt("123456", UserData(1))
+	if another == ciphertext {
+		t.Fatal("相同明文每次加密的结果应当不同")
+	}
+}
+
+func TestDecryptWrongUser(t *testing.T) {
+	ciphertext, _ := newKeyring.Encrypt("123456", UserData(1))
+	if _, err := newKeyring.Decrypt(ciphertext, UserData(2)); !errors.Is(err, ErrAuthentication) {
+		t.Fatalf("其他用户的关联数据应当校验失败: %v", err)
+	}
+	if _, _, err := newKeyring.Rekey(ciphertext, UserData(2)); !errors.Is(err, ErrAuthentication) {
+		t.Fatalf("重新加密时也应当校验关联数据: %v", err)
+	}
+}
+
+func TestDecryptMalformed(t *testing.T) {
+	cases := map[string]string{
+		"空字符串":     "",
+		"非 base64": "v1:" + newKeyring.CurrentKeyId() + ":!!!",
+		"长度不足":     "v1:" + newKeyring.CurrentKeyId() + ":" + base64.StdEncoding.EncodeToString([]byte("short")),
+		"旧版本长度不足":  base64.StdEncoding.EncodeToString(make([]byte, chacha20poly1305.NonceSize)),
+	}
+	for name, ciphertext := range cases {
+		if _, err := newKeyring.Decrypt(ciphertext, UserData(1)); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: 应当返回 ErrMalformed，实际为 %v", name, err)
+		}
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	ciphertext, _ := newKeyring.Encrypt("123456", UserData(1))
+	parts := strings.SplitN(ciphertext, ":", 3)
+	raw, _ := base64.StdEncoding.DecodeString(parts[2])
+	raw[len(raw)-1] ^= 1
+	tampered := parts[0] + ":" + parts[1] + ":" + base64.StdEncoding.EncodeToString(raw)
+	if _, err := newKeyring.Decrypt(tampered, UserData(1)); !errors.Is(err, ErrAuthentication) {
+		t.Fatalf("被篡改的密文应当校验失败: %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	ciphertext, _ := oldKeyring.Encrypt("123456", UserData(1))
+	if !newKeyring.NeedsRekey(ciphertext) {
+		t.Fatal("旧密钥的密文应当需要重新加密")
+	}
+	rekeyed, changed, err := newKeyring.Rekey(ciphertext, UserData(1))
+	if err != nil || !changed {
+		t.Fatalf("重新加密失败: %v", err)
+	}
+	if newKeyring.NeedsRekey(rekeyed) {
+		t.Fatal("重新加密后不应再需要重新加密")
+	}
+	if unchanged, changed, err := newKeyring.Rekey(rekeyed, UserData(1)); err != nil || changed || unchanged != rekeyed {
+		t.Fatalf("最新密文不应重新加密: %v", err)
+	}
+	if plaintext, err := newKeyring.Decrypt(rekeyed, UserData(1)); err != nil || plaintext != "123456" {
+		t.Fatalf("解密结果错误: %q %v", plaintext, err)
+	}
+	if _, err := oldKeyring.Decrypt(rekeyed, UserData(1)); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("旧密钥不应能解密新密文: %v", err)
+	}
+}
+
+func TestDecryptLegacy(t *testing.T) {
+	rawKey := "0123456789abcdef0123456789abcdef"
+	aead, _ := chacha20poly1305.New([]byte(rawKey))
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	_, _ = rand.Read(nonce)
+	legacy := base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte("secret"), nil))
+
+	k, err := NewKeyring(testSalt, "new passphrase", rawKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := k.Decrypt(legacy, UserData(1)); err != nil || plaintext != "secret" {
+		t.Fatalf("旧版本密文解密错误: %q %v", plaintext, err)
+	}
+	if !k.NeedsRekey(legacy) {
+		t.Fatal("旧版本密文应当需要重新加密")
+	}
+	if _, err := newKeyring.Decrypt(legacy, UserData(1)); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("没有 32 字节旧口令时应当返回 ErrUnknownKey: %v", err)
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	first, _ := newKeyring.DeriveKey("telegram-callback")
+	second, _ := newKeyring.DeriveKey("telegram-callback")
+	other, _ := newKeyring.DeriveKey("other")
+	if string(first) != string(second) {
+		t.Fatal("相同用途派生的子密钥应当一致")
+	}
+	if string(first) == string(other) {
+		t.Fatal("不同用途派生的子密钥应当不同")
+	}
+}
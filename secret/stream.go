@@ -0,0 +1,154 @@
+package secret
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+)
+
+// 加密文件格式：magic | keyId（8 个十六进制字符）| 盐（16 字节）| nonce 前缀（16 字节），之后是若干数据块。
+// 每个数据块为 last 标记（1 字节）| 密文长度（4 字节）| 密文，nonce 为前缀 | 块序号（7 字节）| last 标记，
+// 文件头作为关联数据，数据块被删除、重排或截断时都无法通过校验。文件头中带有盐，恢复备份时只需要口令
+const (
+	streamMagic      = "MTBENC01"
+	streamKeyIdSize  = 8
+	streamPrefixSize = 16
+	streamHeaderSize = len(streamMagic) + streamKeyIdSize + SaltSize + streamPrefixSize
+	streamChunkSize  = 64 * 1024
+)
+
+// ErrTruncated 加密文件不完整
+var ErrTruncated = errors.New("加密文件不完整")
+
+// IsEncryptedStream 判断文件开头是否为 EncryptStream 输出的格式
+func IsEncryptedStream(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(streamMagic))
+}
+
+// StreamSalt 返回加密文件头中的盐，用于在没有数据库时创建可以解密该文件的 Keyring
+func StreamSalt(header []byte) ([]byte, error) {
+	if !bytes.HasPrefix(header, []byte(streamMagic)) || len(header) < len(streamMagic)+streamKeyIdSize+SaltSize {
+		return nil, ErrMalformed
+	}
+	offset := len(streamMagic) + streamKeyIdSize
+	return bytes.Clone(header[offset : offset+SaltSize]), nil
+}
+
+// EncryptStream 使用当前密钥按块加密 r 的内容，适合数据库备份等较大的文件，info 区分不同用途的子密钥
+func (k *Keyring) EncryptStream(w io.Writer, r io.Reader, info string) error {
+	aead, err := k.streamAead(k.current, info)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 0, streamHeaderSize)
+	header = append(header, streamMagic...)
+	header = append(header, k.current.id...)
+	header = append(header, k.salt...)
+	prefix := make([]byte, streamPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	header = append(header, prefix...)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	plaintext := make([]byte, streamChunkSize)
+	frame := make([]byte, 5, 5+streamChunkSize+aead.Overhead())
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(r, plaintext)
+		last := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !last {
+			return err
+		}
+
+		frame = frame[:5]
+		if last {
+			frame[0] = 1
+		} else {
+			frame[0] = 0
+		}
+		binary.BigEndian.PutUint32(frame[1:5], uint32(n+aead.Overhead()))
+		frame = aead.Seal(frame, streamNonce(prefix, counter, last), plaintext[:n], header)
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// DecryptStream 解密 EncryptStream 的输出，可以使用历史密钥。文件使用其他部署的盐时返回 ErrUnknownKey
+func (k *Keyring) DecryptStream(w io.Writer, r io.Reader, info string) error {
+	header := make([]byte, streamHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil || !IsEncryptedStream(header) {
+		return ErrMalformed
+	}
+	keyId := string(header[len(streamMagic) : len(streamMagic)+streamKeyIdSize])
+	salt := header[len(streamMagic)+streamKeyIdSize : len(streamMagic)+streamKeyIdSize+SaltSize]
+	prefix := header[len(streamMagic)+streamKeyIdSize+SaltSize:]
+	if !bytes.Equal(salt, k.salt) {
+		return ErrUnknownKey
+	}
+	key, ok := k.keys[keyId]
+	if !ok {
+		return ErrUnknownKey
+	}
+	aead, err := k.streamAead(key, info)
+	if err != nil {
+		return err
+	}
+
+	frameHeader := make([]byte, 5)
+	ciphertext := make([]byte, streamChunkSize+aead.Overhead())
+	for counter := uint64(0); ; counter++ {
+		if _, err := io.ReadFull(r, frameHeader); err != nil {
+			return ErrTruncated
+		}
+		last := frameHeader[0] == 1
+		size := int(binary.BigEndian.Uint32(frameHeader[1:5]))
+		if frameHeader[0] > 1 || size < aead.Overhead() || size > len(ciphertext) {
+			return ErrMalformed
+		}
+		if _, err := io.ReadFull(r, ciphertext[:size]); err != nil {
+			return ErrTruncated
+		}
+		plaintext, err := aead.Open(ciphertext[:0], streamNonce(prefix, counter, last), ciphertext[:size], header)
+		if err != nil {
+			return ErrAuthentication
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func (k *Keyring) streamAead(key *key, info string) (cipher.AEAD, error) {
+	derived, err := expand(key.master, "stream:"+info)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(derived)
+}
+
+func streamNonce(prefix []byte, counter uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, prefix)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], counter)
+	// 块序号只使用低 7 字节，最后一个字节为 last 标记
+	copy(nonce[streamPrefixSize:], buf[1:])
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
@@ -0,0 +1,79 @@
+package secret
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestEncryptDecryptStream(t *testing.T) {
+	for _, size := range []int{0, 100, streamChunkSize, streamChunkSize*2 + 7} {
+		plaintext := make([]byte, size)
+		_, _ = rand.Read(plaintext)
+
+		var encrypted bytes.Buffer
+		if err := oldKeyring.EncryptStream(&encrypted, bytes.NewReader(plaintext), "backup"); err != nil {
+			t.Fatal(err)
+		}
+		if !IsEncryptedStream(encrypted.Bytes()) {
+			t.Fatal("加密结果缺少文件头")
+		}
+
+		// 轮换密钥后仍然可以使用历史密钥解密
+		var decrypted bytes.Buffer
+		if err := newKeyring.DecryptStream(&decrypted, bytes.NewReader(encrypted.Bytes()), "backup"); err != nil {
+			t.Fatalf("%d 字节解密失败: %v", size, err)
+		}
+		if !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Fatalf("%d 字节解密结果不一致", size)
+		}
+	}
+}
+
+func TestDecryptStreamSalt(t *testing.T) {
+	var encrypted bytes.Buffer
+	_ = oldKeyring.EncryptStream(&encrypted, bytes.NewReader([]byte("backup")), "backup")
+	salt, err := StreamSalt(encrypted.Bytes())
+	if err != nil || !bytes.Equal(salt, testSalt) {
+		t.Fatalf("文件头中的盐 = %x %v", salt, err)
+	}
+
+	other, _ := NewKeyring([]byte("fedcba9876543210"), "old passphrase")
+	if err := other.DecryptStream(&bytes.Buffer{}, bytes.NewReader(encrypted.Bytes()), "backup"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("其他部署的盐应当返回 ErrUnknownKey: %v", err)
+	}
+	// 只有口令时使用文件头中的盐重新派生
+	restored, _ := NewKeyring(salt, "old passphrase")
+	var decrypted bytes.Buffer
+	if err := restored.DecryptStream(&decrypted, bytes.NewReader(encrypted.Bytes()), "backup"); err != nil || decrypted.String() != "backup" {
+		t.Fatalf("使用文件头中的盐解密失败: %q %v", decrypted.String(), err)
+	}
+}
+
+func TestDecryptStreamTampered(t *testing.T) {
+	plaintext := make([]byte, streamChunkSize*2)
+	var encrypted bytes.Buffer
+	_ = newKeyring.EncryptStream(&encrypted, bytes.NewReader(plaintext), "backup")
+	data := encrypted.Bytes()
+
+	if err := newKeyring.DecryptStream(&bytes.Buffer{}, bytes.NewReader(data), "other"); !errors.Is(err, ErrAuthentication) {
+		t.Fatalf("不同用途的子密钥应当校验失败: %v", err)
+	}
+	if err := oldKeyring.DecryptStream(&bytes.Buffer{}, bytes.NewReader(data), "backup"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("没有对应密钥时应当返回 ErrUnknownKey: %v", err)
+	}
+
+	modified := bytes.Clone(data)
+	modified[len(modified)-1] ^= 1
+	if err := newKeyring.DecryptStream(&bytes.Buffer{}, bytes.NewReader(modified), "backup"); !errors.Is(err, ErrAuthentication) {
+		t.Fatalf("修改后的密文应当校验失败: %v", err)
+	}
+
+	// 去掉最后一块后即使块边界完整也不能通过校验
+	frameSize := 5 + streamChunkSize + 16
+	truncated := data[:streamHeaderSize+frameSize*2]
+	if err := newKeyring.DecryptStream(&bytes.Buffer{}, bytes.NewReader(truncated), "backup"); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("截断的文件应当返回 ErrTruncated: %v", err)
+	}
+}
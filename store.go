@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	DatabaseDriverSqlite   = "sqlite"
+	DatabaseDriverPostgres = "postgres"
+)
+
+// errBackupUnsupported 当前数据库不支持在线备份
+var errBackupUnsupported = errors.New("只有 SQLite 支持在线备份，PostgreSQL 请使用 pg_dump")
+
+var store *Store
+
+type BwgKeyRepository interface {
+	SelectByUserId(userId int64) (*[]BwgApiKey, error)
+	SelectAll() (*[]BwgApiKey, error)
+	SelectByUserIdAndAlias(userId int64, alias string) (*BwgApiKey, error)
+	SelectByPid(pid int64) (*BwgApiKey, error)
+	Insert(bwgApiKey *BwgApiKey) error
+	UpdateByUserIdAndAlias(bwgApiKey *BwgApiKey) error
+	DeleteByUserIdAndAlias(userId int64, alias string) (int64, error)
+	// RekeySecrets 在同一个事务中重新加密服务器密钥和电源操作记录中的密文，返回两者更新的条数
+	RekeySecrets(rekey func(userId int64, ciphertext string) (string, bool, error)) (int, int, error)
+}
+
+// BwgStateRepository 电源操作记录、流量告警状态和流量快照
+type BwgStateRepository interface {
+	InsertPowerAction(bwgPowerAction *BwgPowerAction) error
+	// SelectAlertStateByKeyPid 没有记录时返回 nil, nil
+	SelectAlertStateByKeyPid(bwgApiKeyPid int64) (*BwgAlertState, error)
+	SaveAlertState(bwgAlertState *BwgAlertState) error
+	DeleteAlertStateByKeyPid(bwgApiKeyPid int64) error
+	InsertUsageSnapshot(bwgUsageSnapshot *BwgUsageSnapshot) error
+	SelectUsageSnapshotsByKeyPidSince(bwgApiKeyPid int64, since time.Time) (*[]BwgUsageSnapshot, error)
+	DeleteUsageSnapshotsBefore(before time.Time) error
+}
+
+// XrayStatsRepository 每小时的用户流量和流量摘要订阅
+type XrayStatsRepository interface {
+	SelectByDate(date string) (*[]XrayUserStats, error)
+	SelectByDateRange(from string, to string) (*[]XrayUserStats, error)
+	SelectByUserAndDateRange(user string, from string, to string) (*[]XrayUserStats, error)
+	SelectByTimeAndDateRange(time string, from string, to string) (*[]XrayUserStats, error)
+	// SelectByUserAndDateTime 没有记录时返回 nil, nil
+	SelectByUserAndDateTime(user string, date string, time string) (*XrayUserStats, error)
+	Insert(xrayUserStats *XrayUserStats) error
+	Update(xrayUserStats *XrayUserStats) error
+	// EachByDateRange 逐行读取日期范围内的流量记录，导出大量数据时不需要全部加载到内存
+	EachByDateRange(from string, to string, fn func(xrayUserStats *XrayUserStats) error) error
+	// EachDailyByDateRange 逐行读取按天和用户汇总的流量，Time 为空
+	EachDailyByDateRange(from string, to string, fn func(xrayUserStats *XrayUserStats) error) error
+	// SelectUserTotalsByDateRange 按用户汇总日期范围内的流量，按总流量倒序
+	SelectUserTotalsByDateRange(from string, to string) (*[]Traffic, error)
+	SelectDigestSubscriptionsByUserId(userId int64) (*[]XrayDigestSubscription, error)
+	SaveDigestSubscription(subscription *XrayDigestSubscription) error
+}
+
+type XrayLogRepository interface {
+	Insert(xrayLog *XrayLog) error
+	// EachByTimeRange 逐行读取 [from, to) 内的访问日志
+	EachByTimeRange(from time.Time, to time.Time, fn func(xrayLog *XrayLogRecord) error) error
+}
+
+// AuditRepository 审计事件和命令记录
+type AuditRepository interface {
+	InsertEvent(auditEvent *AuditEvent) error
+	InsertCommand(commandAudit *CommandAudit) error
+	// SelectCommands 按时间倒序查询 since 之后的命令记录，userId 为 0 时查询所有用户
+	SelectCommands(userId int64, since time.Time, limit int) (*[]CommandAudit, error)
+}
+
+type RateLimitMuteRepository interface {
+	Save(rateLimitMute *RateLimitMute) error
+	// SelectActive 查询 now 时仍在禁言中的用户
+	SelectActive(now time.Time) (*[]RateLimitMute, error)
+}
+
+// KeyringRepository 派生加密密钥使用的盐，每个部署一条记录
+type KeyringRepository interface {
+	// LoadOrCreateSalt 返回已保存的盐，没有记录时保存 generated 并返回
+	LoadOrCreateSalt(generated []byte) ([]byte, error)
+}
+
+// Store 按业务划分的数据访问接口。SQLite 和 PostgreSQL 共用 db.go 中的查询，
+// 占位符由 sqlx 按驱动转换，建表、迁移和备份等差异由各自的 sqlDialect 处理
+type Store struct {
+	BwgKeys        BwgKeyRepository
+	BwgStates      BwgStateRepository
+	XrayStats      XrayStatsRepository
+	XrayLogs       XrayLogRepository
+	Audits         AuditRepository
+	RateLimitMutes RateLimitMuteRepository
+	Keyring        KeyringRepository
+
+	db      *sqlx.DB
+	dialect *sqlDialect
+}
+
+// sqlDialect 不同数据库之间的差异
+type sqlDialect struct {
+	name       string
+	migrations []migration
+	// backup 在线备份到 path，为 nil 时不支持
+	backup func(db *sqlx.DB, path string) error
+}
+
+// migration 数据库结构的一次变更，按 version 顺序执行，执行过的版本记录在 schema_migrations 中
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sqlx.Tx) error
+}
+
+const schemaMigrationsSchema = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer NOT NULL PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamp NOT NULL);
+`
+
+// execMigration 执行一组 SQL 语句的迁移
+func execMigration(statements string) func(tx *sqlx.Tx) error {
+	return func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(statements)
+		return err
+	}
+}
+
+// InitStore 按配置连接数据库并执行迁移，失败时退出
+func InitStore(config DatabaseConfig) {
+	var err error
+	store, err = OpenStore(config)
+	if err != nil {
+		log.Fatal("初始化数据库失败: ", err)
+	}
+}
+
+// OpenStore 连接数据库并执行未执行过的迁移
+func OpenStore(config DatabaseConfig) (*Store, error) {
+	var dialect *sqlDialect
+	var dataSource string
+	switch config.Driver {
+	case DatabaseDriverPostgres:
+		dialect, dataSource = postgresDialect, config.Dsn
+	case DatabaseDriverSqlite, "":
+		dialect, dataSource = sqliteDialect, config.Path
+	default:
+		return nil, fmt.Errorf("不支持的数据库: %s", config.Driver)
+	}
+
+	db, err := sqlx.Open(dialect.name, dataSource)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db, dialect.migrations); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return newStore(db, dialect), nil
+}
+
+func newStore(db *sqlx.DB, dialect *sqlDialect) *Store {
+	return &Store{
+		BwgKeys:        &sqlBwgKeyRepository{db: db},
+		BwgStates:      &sqlBwgStateRepository{db: db},
+		XrayStats:      &sqlXrayStatsRepository{db: db},
+		XrayLogs:       &sqlXrayLogRepository{db: db},
+		Audits:         &sqlAuditRepository{db: db},
+		RateLimitMutes: &sqlRateLimitMuteRepository{db: db},
+		Keyring:        &sqlKeyringRepository{db: db},
+		db:             db,
+		dialect:        dialect,
+	}
+}
+
+// migrate 依次执行未执行过的迁移，每个迁移在单独的事务中执行
+func migrate(db *sqlx.DB, migrations []migration) error {
+	if _, err := db.Exec(schemaMigrationsSchema); err != nil {
+		return fmt.Errorf("创建 schema_migrations 失败: %w", err)
+	}
+	applied := make([]int, 0)
+	if err := db.Select(&applied, "SELECT version FROM schema_migrations"); err != nil {
+		return err
+	}
+	done := make(map[int]bool, len(applied))
+	for _, version := range applied {
+		done[version] = true
+	}
+
+	for _, m := range migrations {
+		if done[m.version] {
+			continue
+		}
+		log.Infof("执行数据库迁移 %d: %s", m.version, m.name)
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+		if err := m.up(tx); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("数据库迁移 %d %s 失败: %w", m.version, m.name, err)
+		}
+		if _, err := tx.Exec(tx.Rebind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"), m.version, m.name, time.Now()); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) Driver() string {
+	return s.dialect.name
+}
+
+func (s *Store) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Backup 在线备份到 path，path 不能已经存在
+func (s *Store) Backup(path string) error {
+	if s.dialect.backup == nil {
+		return errBackupUnsupported
+	}
+	return s.dialect.backup(s.db, path)
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func CloseStore(ctx context.Context) error {
+	return store.Close()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	_ "github.com/lib/pq"
+)
+
+// user、date、time 和 timestamp 在 PostgreSQL 中是关键字，查询中统一加引号
+const postgresSchema = `
+	CREATE TABLE bwg_api_key (
+		pid bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		user_id bigint NOT NULL,
+		veid text NOT NULL,
+		api_key text NOT NULL,
+		alias varchar(50) NOT NULL DEFAULT 'default');
+	CREATE UNIQUE INDEX uniq_user_id_alias ON bwg_api_key (user_id, alias);
+
+	CREATE TABLE xray_user_stats (
+		pid bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		"user" varchar(64) NOT NULL,
+		"date" varchar(30) NOT NULL,
+		"time" varchar(10) NOT NULL,
+		down bigint NOT NULL,
+		up bigint NOT NULL);
+	CREATE INDEX idx_xray_user_stats_date ON xray_user_stats ("date", "time");
+
+	CREATE TABLE xray_log (
+		pid bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		"user" text NOT NULL,
+		ip text NOT NULL,
+		target text NOT NULL,
+		inbound text NOT NULL,
+		outbound text NOT NULL,
+		"timestamp" timestamptz NOT NULL);
+	CREATE INDEX idx_xray_log_timestamp ON xray_log ("timestamp");
+
+	CREATE TABLE xray_digest_subscription (
+		pid bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		user_id bigint NOT NULL,
+		digest varchar(20) NOT NULL,
+		enabled boolean NOT NULL,
+		update_time timestamptz NOT NULL);
+	CREATE UNIQUE INDEX uniq_user_id_digest ON xray_digest_subscription (user_id, digest);
+
+	CREATE TABLE bwg_power_action (
+		pid bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		user_id bigint NOT NULL,
+		username text NOT NULL,
+		bwg_api_key_pid bigint NOT NULL,
+		alias varchar(50) NOT NULL,
+		veid text NOT NULL,
+		action varchar(20) NOT NULL,
+		result text NOT NULL,
+		create_time timestamptz NOT NULL);
+
+	CREATE TABLE bwg_alert_state (
+		pid bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		bwg_api_key_pid bigint NOT NULL,
+		data_next_reset bigint NOT NULL,
+		notified_percent integer NOT NULL,
+		reset_reminded boolean NOT NULL,
+		update_time timestamptz NOT NULL);
+	CREATE UNIQUE INDEX uniq_bwg_api_key_pid ON bwg_alert_state (bwg_api_key_pid);
+
+	CREATE TABLE bwg_usage_snapshot (
+		pid bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		bwg_api_key_pid bigint NOT NULL,
+		data_counter bigint NOT NULL,
+		plan_monthly_data bigint NOT NULL,
+		data_next_reset bigint NOT NULL,
+		create_time timestamptz NOT NULL);
+	CREATE INDEX idx_bwg_api_key_pid_create_time ON bwg_usage_snapshot (bwg_api_key_pid, create_time);
+
+	CREATE TABLE audit_event (
+		pid bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		user_id bigint NOT NULL,
+		event varchar(50) NOT NULL,
+		detail text NOT NULL,
+		create_time timestamptz NOT NULL);
+	CREATE INDEX idx_audit_event_create_time ON audit_event (create_time);
+
+	CREATE TABLE command_audit (
+		pid bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		user_id bigint NOT NULL,
+		username varchar(64) NOT NULL,
+		chat_id bigint NOT NULL,
+		command varchar(64) NOT NULL,
+		args text NOT NULL,
+		outcome varchar(20) NOT NULL,
+		error text NOT NULL,
+		latency_ms bigint NOT NULL,
+		create_time timestamptz NOT NULL);
+	CREATE INDEX idx_command_audit_create_time ON command_audit (create_time);
+	CREATE INDEX idx_command_audit_user_id_create_time ON command_audit (user_id, create_time);
+
+	CREATE TABLE rate_limit_mute (
+		pid bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		user_id bigint NOT NULL,
+		muted_until timestamptz NOT NULL,
+		update_time timestamptz NOT NULL);
+	CREATE UNIQUE INDEX uniq_rate_limit_mute_user_id ON rate_limit_mute (user_id);
+
+	CREATE TABLE keyring_salt (
+		pid bigint PRIMARY KEY,
+		salt text NOT NULL,
+		create_time timestamptz NOT NULL);
+`
+
+var postgresDialect = &sqlDialect{
+	name: DatabaseDriverPostgres,
+	migrations: []migration{
+		{version: 1, name: "初始化数据表", up: execMigration(postgresSchema)},
+	},
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+	_ "modernc.org/sqlite"
+)
+
+// 之前的版本按表是否存在建表，这里的语句都可以在已有的数据库上重复执行
+const sqliteSchema = `
+	CREATE TABLE IF NOT EXISTS bwg_api_key (
+		pid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		user_id integer NOT NULL,
+		veid text(200) NOT NULL,
+		api_key text(200) NOT NULL,
+		alias text(50) NOT NULL DEFAULT 'default');
+
+	CREATE TABLE IF NOT EXISTS xray_user_stats (
+		pid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		user text(20) NOT NULL,
+		date text(30) NOT NULL,
+		time text(10) NOT NULL,
+		down integer NOT NULL,
+		up integer NOT NULL);
+
+	CREATE TABLE IF NOT EXISTS xray_log (
+		pid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		user text NOT NULL,
+		ip text NOT NULL,
+		target text NOT NULL,
+		inbound text NOT NULL,
+		outbound text NOT NULL,
+		timestamp DATETIME NOT NULL);
+
+	CREATE TABLE IF NOT EXISTS xray_digest_subscription (
+		pid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		user_id integer NOT NULL,
+		digest text(20) NOT NULL,
+		enabled integer NOT NULL,
+		update_time DATETIME NOT NULL);
+	CREATE UNIQUE INDEX IF NOT EXISTS uniq_user_id_digest ON xray_digest_subscription (user_id ASC, digest ASC);
+
+	CREATE TABLE IF NOT EXISTS bwg_power_action (
+		pid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		user_id integer NOT NULL,
+		username text NOT NULL,
+		veid text(200) NOT NULL,
+		action text(20) NOT NULL,
+		result text NOT NULL,
+		create_time DATETIME NOT NULL);
+
+	CREATE TABLE IF NOT EXISTS bwg_alert_state (
+		pid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		bwg_api_key_pid integer NOT NULL,
+		data_next_reset integer NOT NULL,
+		notified_percent integer NOT NULL,
+		reset_reminded integer NOT NULL,
+		update_time DATETIME NOT NULL);
+	CREATE UNIQUE INDEX IF NOT EXISTS uniq_bwg_api_key_pid ON bwg_alert_state (bwg_api_key_pid ASC);
+
+	CREATE TABLE IF NOT EXISTS bwg_usage_snapshot (
+		pid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		bwg_api_key_pid integer NOT NULL,
+		data_counter integer NOT NULL,
+		plan_monthly_data integer NOT NULL,
+		data_next_reset integer NOT NULL,
+		create_time DATETIME NOT NULL);
+	CREATE INDEX IF NOT EXISTS idx_bwg_api_key_pid_create_time ON bwg_usage_snapshot (bwg_api_key_pid ASC, create_time ASC);
+
+	CREATE TABLE IF NOT EXISTS audit_event (
+		pid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		user_id integer NOT NULL,
+		event text(50) NOT NULL,
+		detail text NOT NULL,
+		create_time DATETIME NOT NULL);
+	CREATE INDEX IF NOT EXISTS idx_audit_event_create_time ON audit_event (create_time ASC);
+
+	CREATE TABLE IF NOT EXISTS command_audit (
+		pid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		user_id integer NOT NULL,
+		username text(64) NOT NULL,
+		chat_id integer NOT NULL,
+		command text(64) NOT NULL,
+		args text NOT NULL,
+		outcome text(20) NOT NULL,
+		error text NOT NULL,
+		latency_ms integer NOT NULL,
+		create_time DATETIME NOT NULL);
+	CREATE INDEX IF NOT EXISTS idx_command_audit_create_time ON command_audit (create_time ASC);
+	CREATE INDEX IF NOT EXISTS idx_command_audit_user_id_create_time ON command_audit (user_id ASC, create_time ASC);
+
+	CREATE TABLE IF NOT EXISTS rate_limit_mute (
+		pid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		user_id integer NOT NULL,
+		muted_until DATETIME NOT NULL,
+		update_time DATETIME NOT NULL);
+	CREATE UNIQUE INDEX IF NOT EXISTS uniq_rate_limit_mute_user_id ON rate_limit_mute (user_id ASC);
+`
+
+var sqliteDialect = &sqlDialect{
+	name: DatabaseDriverSqlite,
+	migrations: []migration{
+		{version: 1, name: "初始化数据表", up: execMigration(sqliteSchema)},
+		{version: 2, name: "bwg_api_key 按别名区分多台服务器", up: migrateSqliteBwgApiKeyAlias},
+		{version: 3, name: "保存每个部署的加密盐", up: execMigration(`
+			CREATE TABLE IF NOT EXISTS keyring_salt (
+				pid integer NOT NULL PRIMARY KEY,
+				salt text NOT NULL,
+				create_time DATETIME NOT NULL);
+		`)},
+		{version: 4, name: "bwg_power_action 记录操作的服务器", up: execMigration(`
+			ALTER TABLE bwg_power_action ADD COLUMN bwg_api_key_pid integer NOT NULL DEFAULT 0;
+			ALTER TABLE bwg_power_action ADD COLUMN alias text(50) NOT NULL DEFAULT '';
+		`)},
+	},
+	backup: func(db *sqlx.DB, path string) error {
+		_, err := db.Exec("VACUUM INTO ?", path)
+		return err
+	},
+}
+
+// migrateSqliteBwgApiKeyAlias 旧版本每个用户只能绑定一台服务器，没有 alias 列
+func migrateSqliteBwgApiKeyAlias(tx *sqlx.Tx) error {
+	var aliasColumns int
+	if err := tx.Get(&aliasColumns, "SELECT count(*) FROM pragma_table_info('bwg_api_key') WHERE name = 'alias'"); err != nil {
+		return err
+	}
+	if aliasColumns == 0 {
+		_, err := tx.Exec(`
+			ALTER TABLE bwg_api_key ADD COLUMN alias text(50) NOT NULL DEFAULT 'default';
+			DROP INDEX IF EXISTS uniq_user_id;
+		`)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS uniq_user_id_alias ON bwg_api_key (user_id ASC, alias ASC)")
+	return err
+}
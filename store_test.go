@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 超过 32 位整数范围的 Telegram 用户 ID
+const testLargeUserId int64 = 5_000_000_001
+
+// initTestStore 使用临时的 SQLite 数据库作为全局 store
+func initTestStore(t *testing.T) {
+	InitStore(DatabaseConfig{Driver: DatabaseDriverSqlite, Path: filepath.Join(t.TempDir(), "telegram.db")})
+	t.Cleanup(func() { _ = store.Close() })
+}
+
+func TestSqliteStore(t *testing.T) {
+	testStoreContract(t, func(t *testing.T) DatabaseConfig {
+		return DatabaseConfig{Driver: DatabaseDriverSqlite, Path: filepath.Join(t.TempDir(), "telegram.db")}
+	})
+}
+
+// TestPostgresStore 设置 TEST_POSTGRES_DSN 时运行，每个用例使用单独的 schema，结束后删除
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if len(dsn) == 0 {
+		t.Skip("未设置 TEST_POSTGRES_DSN")
+	}
+	admin, err := sqlx.Open(DatabaseDriverPostgres, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = admin.Close() })
+
+	testStoreContract(t, func(t *testing.T) DatabaseConfig {
+		suffix := make([]byte, 6)
+		_, _ = rand.Read(suffix)
+		schema := "test_" + hex.EncodeToString(suffix)
+		if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _, _ = admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+		// lib/pq 将无法识别的参数作为会话参数发送
+		switch {
+		case !strings.Contains(dsn, "://"):
+			return DatabaseConfig{Driver: DatabaseDriverPostgres, Dsn: dsn + " search_path=" + schema}
+		case strings.Contains(dsn, "?"):
+			return DatabaseConfig{Driver: DatabaseDriverPostgres, Dsn: dsn + "&search_path=" + schema}
+		default:
+			return DatabaseConfig{Driver: DatabaseDriverPostgres, Dsn: dsn + "?search_path=" + schema}
+		}
+	})
+}
+
+// testStoreContract 所有数据库实现都需要通过的用例，newDatabase 每次返回一个空数据库的配置
+func testStoreContract(t *testing.T, newDatabase func(t *testing.T) DatabaseConfig) {
+	open := func(t *testing.T) *Store {
+		s, err := OpenStore(newDatabase(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = s.Close() })
+		return s
+	}
+	// 数据库中的时间精度不同，只比较到秒
+	now := time.Now().Truncate(time.Second)
+
+	t.Run("migrate", func(t *testing.T) {
+		config := newDatabase(t)
+		for i := 0; i < 2; i++ {
+			s, err := OpenStore(config)
+			if err != nil {
+				t.Fatalf("第 %d 次打开数据库失败: %v", i+1, err)
+			}
+			var count int
+			if err := s.db.Get(&count, "SELECT count(*) FROM schema_migrations"); err != nil {
+				t.Fatal(err)
+			}
+			if count != len(s.dialect.migrations) {
+				t.Errorf("已执行 %d 个迁移，期望 %d 个", count, len(s.dialect.migrations))
+			}
+			_ = s.Close()
+		}
+	})
+
+	t.Run("bwg_keys", func(t *testing.T) {
+		s := open(t)
+		for _, alias := range []string{"main", "backup"} {
+			if err := s.BwgKeys.Insert(&BwgApiKey{UserId: testLargeUserId, Veid: "veid-" + alias, ApiKey: "key-" + alias, Alias: alias}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.BwgKeys.Insert(&BwgApiKey{UserId: testLargeUserId, Veid: "veid", ApiKey: "key", Alias: "main"}); err == nil {
+			t.Error("同一用户的别名不能重复")
+		}
+		_ = s.BwgKeys.Insert(&BwgApiKey{UserId: 2, Veid: "veid-other", ApiKey: "key-other", Alias: "main"})
+
+		keys, err := s.BwgKeys.SelectByUserId(testLargeUserId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*keys) != 2 || (*keys)[0].Alias != "main" || (*keys)[1].Alias != "backup" {
+			t.Fatalf("按用户查询 = %+v", *keys)
+		}
+		if all, _ := s.BwgKeys.SelectAll(); len(*all) != 3 {
+			t.Errorf("全部服务器 = %+v", *all)
+		}
+		key, err := s.BwgKeys.SelectByPid((*keys)[1].Pid)
+		if err != nil || key.Veid != "veid-backup" {
+			t.Errorf("按 pid 查询 = %+v %v", key, err)
+		}
+
+		_ = s.BwgKeys.UpdateByUserIdAndAlias(&BwgApiKey{UserId: testLargeUserId, Alias: "main", Veid: "new-veid", ApiKey: "new-key"})
+		key, err = s.BwgKeys.SelectByUserIdAndAlias(testLargeUserId, "main")
+		if err != nil || key.Veid != "new-veid" || key.ApiKey != "new-key" {
+			t.Errorf("更新后 = %+v %v", key, err)
+		}
+		if _, err := s.BwgKeys.SelectByUserIdAndAlias(testLargeUserId, "missing"); err == nil {
+			t.Error("不存在的别名应当返回错误")
+		}
+
+		_ = s.BwgStates.InsertPowerAction(&BwgPowerAction{UserId: testLargeUserId, Username: "alice", BwgApiKeyPid: key.Pid, Alias: key.Alias, Veid: "veid-main", Action: "restart", Result: "ok", CreateTime: now})
+		keyCount, actionCount, err := s.BwgKeys.RekeySecrets(func(userId int64, ciphertext string) (string, bool, error) {
+			if userId != testLargeUserId {
+				return ciphertext, false, nil
+			}
+			return "rekeyed:" + ciphertext, true, nil
+		})
+		if err != nil || keyCount != 2 || actionCount != 1 {
+			t.Errorf("重新加密 = %d %d %v", keyCount, actionCount, err)
+		}
+		key, _ = s.BwgKeys.SelectByUserIdAndAlias(testLargeUserId, "backup")
+		if key.Veid != "rekeyed:veid-backup" || key.ApiKey != "rekeyed:key-backup" {
+			t.Errorf("重新加密后 = %+v", key)
+		}
+
+		if deleted, err := s.BwgKeys.DeleteByUserIdAndAlias(testLargeUserId, "main"); err != nil || deleted != 1 {
+			t.Errorf("删除 = %d %v", deleted, err)
+		}
+		if deleted, _ := s.BwgKeys.DeleteByUserIdAndAlias(testLargeUserId, "main"); deleted != 0 {
+			t.Errorf("重复删除 = %d", deleted)
+		}
+	})
+
+	t.Run("bwg_states", func(t *testing.T) {
+		s := open(t)
+		if state, err := s.BwgStates.SelectAlertStateByKeyPid(1); state != nil || err != nil {
+			t.Fatalf("没有记录时应当返回 nil, nil: %+v %v", state, err)
+		}
+		_ = s.BwgStates.SaveAlertState(&BwgAlertState{BwgApiKeyPid: 1, DataNextReset: 100, NotifiedPercent: 50, UpdateTime: now})
+		_ = s.BwgStates.SaveAlertState(&BwgAlertState{BwgApiKeyPid: 1, DataNextReset: 100, NotifiedPercent: 80, ResetReminded: true, UpdateTime: now})
+		state, err := s.BwgStates.SelectAlertStateByKeyPid(1)
+		if err != nil || state.NotifiedPercent != 80 || !state.ResetReminded || !state.UpdateTime.Equal(now) {
+			t.Errorf("告警状态 = %+v %v", state, err)
+		}
+		_ = s.BwgStates.DeleteAlertStateByKeyPid(1)
+		if state, _ := s.BwgStates.SelectAlertStateByKeyPid(1); state != nil {
+			t.Errorf("删除后 = %+v", state)
+		}
+
+		for i := 0; i < 3; i++ {
+			_ = s.BwgStates.InsertUsageSnapshot(&BwgUsageSnapshot{BwgApiKeyPid: 1, DataCounter: int64(i) << 32, CreateTime: now.Add(time.Duration(i-2) * time.Hour)})
+		}
+		snapshots, err := s.BwgStates.SelectUsageSnapshotsByKeyPidSince(1, now.Add(-time.Hour))
+		if err != nil || len(*snapshots) != 2 || (*snapshots)[1].DataCounter != 2<<32 {
+			t.Errorf("流量快照 = %+v %v", snapshots, err)
+		}
+		_ = s.BwgStates.DeleteUsageSnapshotsBefore(now)
+		if snapshots, _ := s.BwgStates.SelectUsageSnapshotsByKeyPidSince(1, now.Add(-24*time.Hour)); len(*snapshots) != 1 {
+			t.Errorf("清理后的流量快照 = %+v", *snapshots)
+		}
+	})
+
+	t.Run("xray_stats", func(t *testing.T) {
+		s := open(t)
+		for _, stats := range []XrayUserStats{
+			{User: "alice", Date: "2024-05-01", Time: "10:00", Down: 100, Up: 10},
+			{User: "alice", Date: "2024-05-01", Time: "11:00", Down: 200, Up: 20},
+			{User: "bob", Date: "2024-05-02", Time: "10:00", Down: 1000, Up: 100},
+		} {
+			if err := s.XrayStats.Insert(&stats); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if stats, err := s.XrayStats.SelectByUserAndDateTime("bob", "2024-05-01", "10:00"); stats != nil || err != nil {
+			t.Errorf("没有记录时应当返回 nil, nil: %+v %v", stats, err)
+		}
+		_ = s.XrayStats.Update(&XrayUserStats{User: "bob", Date: "2024-05-02", Time: "10:00", Down: 1 << 40, Up: 100})
+		stats, err := s.XrayStats.SelectByUserAndDateTime("bob", "2024-05-02", "10:00")
+		if err != nil || stats.Down != 1<<40 {
+			t.Errorf("更新后 = %+v %v", stats, err)
+		}
+
+		if list, _ := s.XrayStats.SelectByDate("2024-05-01"); len(*list) != 2 {
+			t.Errorf("按日期查询 = %+v", *list)
+		}
+		if list, _ := s.XrayStats.SelectByDateRange("2024-05-01", "2024-05-02"); len(*list) != 3 || (*list)[2].User != "bob" {
+			t.Errorf("按日期范围查询 = %+v", *list)
+		}
+		if list, _ := s.XrayStats.SelectByUserAndDateRange("alice", "2024-05-01", "2024-05-31"); len(*list) != 2 || (*list)[1].Time != "11:00" {
+			t.Errorf("按用户查询 = %+v", *list)
+		}
+		if list, _ := s.XrayStats.SelectByTimeAndDateRange("10:00", "2024-05-01", "2024-05-31"); len(*list) != 2 {
+			t.Errorf("按时间查询 = %+v", *list)
+		}
+
+		daily := make([]XrayUserStats, 0)
+		err = s.XrayStats.EachDailyByDateRange("2024-05-01", "2024-05-31", func(stats *XrayUserStats) error {
+			daily = append(daily, *stats)
+			return nil
+		})
+		if err != nil || len(daily) != 2 || daily[0] != (XrayUserStats{User: "alice", Date: "2024-05-01", Down: 300, Up: 30}) {
+			t.Errorf("每日汇总 = %+v %v", daily, err)
+		}
+		count := 0
+		_ = s.XrayStats.EachByDateRange("2024-05-01", "2024-05-01", func(stats *XrayUserStats) error {
+			count++
+			return nil
+		})
+		if count != 2 {
+			t.Errorf("逐行读取 %d 条，期望 2 条", count)
+		}
+		totals, err := s.XrayStats.SelectUserTotalsByDateRange("2024-05-01", "2024-05-31")
+		if err != nil || len(*totals) != 2 || (*totals)[0] != (Traffic{User: "bob", Down: 1 << 40, Up: 100}) {
+			t.Errorf("用户汇总 = %+v %v", totals, err)
+		}
+
+		_ = s.XrayStats.SaveDigestSubscription(&XrayDigestSubscription{UserId: testLargeUserId, Digest: "daily", Enabled: true, UpdateTime: now})
+		_ = s.XrayStats.SaveDigestSubscription(&XrayDigestSubscription{UserId: testLargeUserId, Digest: "daily", Enabled: false, UpdateTime: now})
+		subscriptions, err := s.XrayStats.SelectDigestSubscriptionsByUserId(testLargeUserId)
+		if err != nil || len(*subscriptions) != 1 || (*subscriptions)[0].Enabled {
+			t.Errorf("流量摘要订阅 = %+v %v", subscriptions, err)
+		}
+	})
+
+	t.Run("xray_logs", func(t *testing.T) {
+		s := open(t)
+		for i := 0; i < 3; i++ {
+			xrayLog := &XrayLog{User: "alice", IP: "192.0.2.1", Target: "example.com:443", Inbound: "in", Outbound: "out", RequestTime: RequestTime{now.Add(time.Duration(i) * time.Minute)}}
+			if err := s.XrayLogs.Insert(xrayLog); err != nil {
+				t.Fatal(err)
+			}
+		}
+		records := make([]XrayLogRecord, 0)
+		err := s.XrayLogs.EachByTimeRange(now, now.Add(2*time.Minute), func(record *XrayLogRecord) error {
+			records = append(records, *record)
+			return nil
+		})
+		if err != nil || len(records) != 2 || !records[1].Timestamp.Equal(now.Add(time.Minute)) || records[0].Target != "example.com:443" {
+			t.Errorf("访问日志 = %+v %v", records, err)
+		}
+	})
+
+	t.Run("xray_logs_local_time", func(t *testing.T) {
+		// Xray 日志中是服务器的本地时间，导出时按本地日期查询
+		previous := time.Local
+		time.Local = time.FixedZone("CST", 8*60*60)
+		t.Cleanup(func() { time.Local = previous })
+
+		s := open(t)
+		for _, line := range []string{
+			"2024/05/01 23:30:00.000000 from 192.0.2.1:50000 accepted tcp:example.com:443 [in -> out] email: alice-1",
+			"2024/05/02 00:30:00.000000 from 192.0.2.1:50000 accepted tcp:example.com:443 [in -> out] email: alice-1",
+		} {
+			xrayLog, ok := parseXrayLogEntry(line)
+			if !ok {
+				t.Fatalf("解析日志失败: %s", line)
+			}
+			if err := s.XrayLogs.Insert(&xrayLog); err != nil {
+				t.Fatal(err)
+			}
+		}
+		from, _ := time.ParseInLocation(DateFormat, "2024-05-01", time.Local)
+		records := make([]XrayLogRecord, 0)
+		err := s.XrayLogs.EachByTimeRange(from, from.AddDate(0, 0, 1), func(record *XrayLogRecord) error {
+			records = append(records, *record)
+			return nil
+		})
+		if err != nil || len(records) != 1 || !records[0].Timestamp.Equal(time.Date(2024, 5, 1, 23, 30, 0, 0, time.Local)) {
+			t.Errorf("本地日期的访问日志 = %+v %v", records, err)
+		}
+	})
+
+	t.Run("audits", func(t *testing.T) {
+		s := open(t)
+		if err := s.Audits.InsertEvent(&AuditEvent{UserId: testLargeUserId, Event: AuditEventDecryptFailed, Detail: "detail", CreateTime: now}); err != nil {
+			t.Fatal(err)
+		}
+		for i, userId := range []int64{testLargeUserId, 2, testLargeUserId} {
+			_ = s.Audits.InsertCommand(&CommandAudit{UserId: userId, Command: "/start", Outcome: AuditOutcomeOk, LatencyMs: 5, CreateTime: now.Add(time.Duration(i) * time.Minute)})
+		}
+		commandAudits, err := s.Audits.SelectCommands(testLargeUserId, now, 10)
+		if err != nil || len(*commandAudits) != 2 || !(*commandAudits)[0].CreateTime.Equal(now.Add(2*time.Minute)) {
+			t.Errorf("按用户查询命令记录 = %+v %v", commandAudits, err)
+		}
+		if commandAudits, _ := s.Audits.SelectCommands(0, now, 2); len(*commandAudits) != 2 {
+			t.Errorf("limit 未生效: %+v", *commandAudits)
+		}
+	})
+
+	t.Run("rate_limit_mutes", func(t *testing.T) {
+		s := open(t)
+		_ = s.RateLimitMutes.Save(&RateLimitMute{UserId: testLargeUserId, MutedUntil: now.Add(-time.Minute), UpdateTime: now})
+		_ = s.RateLimitMutes.Save(&RateLimitMute{UserId: 2, MutedUntil: now.Add(-time.Minute), UpdateTime: now})
+		_ = s.RateLimitMutes.Save(&RateLimitMute{UserId: testLargeUserId, MutedUntil: now.Add(10 * time.Minute), UpdateTime: now})
+		mutes, err := s.RateLimitMutes.SelectActive(now)
+		if err != nil || len(*mutes) != 1 || (*mutes)[0].UserId != testLargeUserId || !(*mutes)[0].MutedUntil.Equal(now.Add(10*time.Minute)) {
+			t.Errorf("禁言记录 = %+v %v", mutes, err)
+		}
+	})
+}
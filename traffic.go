@@ -8,71 +8,102 @@ import (
 	log "github.com/sirupsen/logrus"
 	statsService "github.com/xtls/xray-core/app/stats/command"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
 	"google.golang.org/grpc/credentials/insecure"
-	"os"
 	"regexp"
-	"strconv"
+	"slices"
+	"sync/atomic"
 	"time"
 )
 
+// XrayApi 与 Xray 共用一个长连接，断开后由 gRPC 自动重连
 type XrayApi struct {
 	Host string
 	Port int
+
+	conn   *grpc.ClientConn
+	client statsService.StatsServiceClient
+	err    error
+	// 不重置计数的查询结果，流量收集任务重置计数后清空
+	cache *TtlCache[string, []*Traffic]
 }
 
+const xrayTrafficCacheKey = "traffic"
+
 type Traffic struct {
 	User string `json:"user"`
 	Up   int64  `json:"up"`
 	Down int64  `json:"down"`
 }
 
-var xrayApi *XrayApi
+// 重新加载配置时整体替换
+var xrayApi atomic.Pointer[XrayApi]
 
-func InitXrayStats() {
-	InitXrayApi()
-	InitStatsJob()
+// InitXrayStats 应用 Xray 相关配置，重新加载配置时也会调用
+func InitXrayStats(config XrayConfig) {
+	InitXrayApi(config.Api)
+	admins := slices.Clone(config.Admins)
+	xrayStatsAdmins.Store(&admins)
+	InitAnomalyDetector(config.Anomaly)
+	InitXrayLogFilter(config.Log)
 }
 
-func InitXrayApi() {
-	xrayApiHost := os.Getenv("XRAY_API_HOST")
-	xrayApiPort := os.Getenv("XRAY_API_PORT")
-	if len(xrayApiHost) == 0 {
-		xrayApiHost = "127.0.0.1"
+// InitXrayApi 地址不变时沿用已有的连接，地址变化时建立新连接并关闭旧连接
+func InitXrayApi(config XrayApiConfig) {
+	api := &XrayApi{Host: config.Host, Port: config.Port, cache: NewTtlCache[string, []*Traffic]("xray_traffic", config.CacheTtl)}
+	previous := xrayApi.Load()
+	if previous != nil && previous.Host == api.Host && previous.Port == api.Port {
+		api.conn, api.client, api.err = previous.conn, previous.client, previous.err
+	} else {
+		api.conn, api.err = grpc.NewClient(fmt.Sprintf("%s:%d", api.Host, api.Port),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithConnectParams(grpc.ConnectParams{
+				Backoff:           backoff.Config{BaseDelay: time.Second, Multiplier: 1.6, Jitter: 0.2, MaxDelay: 30 * time.Second},
+				MinConnectTimeout: 5 * time.Second,
+			}))
+		if api.err != nil {
+			log.WithField("component", "xray_stats").Error("创建 Xray API 连接失败: ", api.err)
+		} else {
+			api.client = statsService.NewStatsServiceClient(api.conn)
+		}
 	}
-	if len(xrayApiPort) == 0 {
-		xrayApiPort = "8080"
+	xrayApi.Store(api)
+
+	if previous != nil && previous.conn != nil && previous.conn != api.conn {
+		_ = previous.conn.Close()
 	}
-	xrayApiPortInt, _ := strconv.Atoi(xrayApiPort)
-	xrayApi = &XrayApi{Host: xrayApiHost, Port: xrayApiPortInt}
 }
 
-func InitStatsJob() {
-	c := cron.New()
-	cronStr := os.Getenv("XRAY_STATS_CRON")
-	if len(cronStr) == 0 {
-		cronStr = "*/5 * * * *"
+// CloseXrayApi 退出时关闭 Xray API 连接
+func CloseXrayApi(ctx context.Context) error {
+	api := xrayApi.Load()
+	if api == nil || api.conn == nil {
+		return nil
 	}
+	return api.conn.Close()
+}
 
-	_, err := c.AddFunc(cronStr, func() {
+func AddStatsJob(scheduler *cron.Cron, cronStr string) error {
+	_, err := scheduler.AddFunc(cronStr, func() {
 		CheckAndUpdateXrayTraffic()
 	})
 	if err != nil {
-		fmt.Println("添加定时任务失败:", err)
-		return
+		return fmt.Errorf("添加流量收集定时任务失败: %w", err)
 	}
-
-	c.Start()
+	return nil
 }
 
 func CheckAndUpdateXrayTraffic() {
-	traffics, err := GetTraffic(true)
+	defer observeSince(xrayStatsJobDuration, time.Now())
+
+	traffics, err := xrayTraffic.Reset()
 	if err != nil {
-		log.Error("获取 Xray 流量异常", err)
+		log.WithField("component", "xray_stats").Error("获取 Xray 流量异常", err)
 		return
 	}
 
 	if traffics == nil {
-		log.Error("获取 Xray 流量为空")
+		log.WithField("component", "xray_stats").Error("获取 Xray 流量为空")
 		return
 	}
 
@@ -87,7 +118,7 @@ func CheckAndUpdateXrayTraffic() {
 		if traffic.Up == 0 && traffic.Down == 0 {
 			continue
 		}
-		data, err := SelectXrayUserStatsByUserAndDateTime(traffic.User, formattedDate, formattedTime)
+		data, err := store.XrayStats.SelectByUserAndDateTime(traffic.User, formattedDate, formattedTime)
 		if err != nil {
 			continue
 		}
@@ -100,9 +131,9 @@ func CheckAndUpdateXrayTraffic() {
 				Down: traffic.Down,
 				Up:   traffic.Up,
 			}
-			err := InsertXrayUserStats(xrayUserStats)
+			err := store.XrayStats.Insert(xrayUserStats)
 			if err != nil {
-				log.Error("保存 Xray 流量异常", err)
+				log.WithField("component", "xray_stats").Error("保存 Xray 流量异常", err)
 			}
 		} else {
 			// 更新
@@ -113,28 +144,42 @@ func CheckAndUpdateXrayTraffic() {
 				Down: traffic.Down + data.Down,
 				Up:   traffic.Up + data.Up,
 			}
-			err := UpdateXrayUserStats(xrayUserStats)
+			err := store.XrayStats.Update(xrayUserStats)
 			if err != nil {
-				log.Error("保存 Xray 流量异常", err)
+				log.WithField("component", "xray_stats").Error("保存 Xray 流量异常", err)
 			}
 		}
 	}
+
+	xrayStatsJobLastSuccess.SetToCurrentTime()
+	// 当前小时的流量还不完整，检测上一个小时
+	finishedHour := thisHour.Add(-time.Hour)
+	CheckXrayTrafficAnomaly(finishedHour.Format(DateFormat), finishedHour.Format(TimeFormat))
 }
 
 var trafficRegex = regexp.MustCompile("user>>>([^>]+)>>>traffic>>>(downlink|uplink)")
 
+// GetTraffic 查询各用户的流量，reset 为 false 时短时间内的结果会被缓存并共享，调用方不可修改
 func GetTraffic(reset bool) ([]*Traffic, error) {
-	conn, err := grpc.NewClient(fmt.Sprintf("%s:%d", xrayApi.Host, xrayApi.Port), grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return nil, err
+	api := xrayApi.Load()
+	if api.err != nil {
+		return nil, api.err
+	}
+	if reset {
+		traffics, err := api.queryTraffic(true)
+		api.cache.Invalidate(xrayTrafficCacheKey)
+		return traffics, err
 	}
-	defer conn.Close()
+	return api.cache.Get(xrayTrafficCacheKey, func() ([]*Traffic, error) {
+		return api.queryTraffic(false)
+	})
+}
 
+func (api *XrayApi) queryTraffic(reset bool) ([]*Traffic, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 
-	client := statsService.NewStatsServiceClient(conn)
-	response, err := client.QueryStats(ctx, &statsService.QueryStatsRequest{Reset_: reset})
+	response, err := api.client.QueryStats(ctx, &statsService.QueryStatsRequest{Reset_: reset})
 	if err != nil {
 		return nil, err
 	}
@@ -142,6 +187,10 @@ func GetTraffic(reset bool) ([]*Traffic, error) {
 	traffics := make([]*Traffic, 0)
 	for _, stat := range response.GetStat() {
 		matches := trafficRegex.FindStringSubmatch(stat.GetName())
+		if matches == nil {
+			// 入站、出站等非用户流量
+			continue
+		}
 		user := matches[1]
 		isDown := matches[2] == "downlink"
 		traffic, ok := userTrafficMap[user]
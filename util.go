@@ -1,15 +1,16 @@
 package main
 
 import (
-	"crypto/cipher"
-	"crypto/rand"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"github.com/shopspring/decimal"
-	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/text/width"
 	tele "gopkg.in/telebot.v3"
-	"os"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -56,63 +57,31 @@ func GetDuration(date time.Time) string {
 	}
 }
 
-// 全局加密实例
-var chachaCipher cipher.AEAD
+// 回调数据签名密钥
+var callbackKey []byte
 
-func InitChacha20() {
-	encryptionKey := os.Getenv("KEY")
-	if len(encryptionKey) == 0 {
-		panic("加密密钥不可以为空")
-	}
-
-	keyBytes := []byte(encryptionKey)
+func InitCallbackSigner() {
+	// 与加密密钥区分开，避免同一密钥用于不同用途
 	var err error
-	chachaCipher, err = chacha20poly1305.New(keyBytes)
+	callbackKey, err = keyring.DeriveKey("telegram-callback")
 	if err != nil {
-		panic("初始化加密实例失败：" + err.Error())
+		panic("初始化回调签名密钥失败：" + err.Error())
 	}
 }
 
-func encryptString(plaintext string) (string, error) {
-	// 将输入字符串转换为字节切片
-	plaintextBytes := []byte(plaintext)
-
-	// 随机生成 12 字节的 nonce
-	nonce := make([]byte, chacha20poly1305.NonceSize)
-	if _, err := rand.Read(nonce); err != nil {
-		return "", err
-	}
-
-	// 使用全局加密实例进行加密
-	ciphertext := chachaCipher.Seal(nil, nonce, plaintextBytes, nil)
-
-	// 将 nonce 和加密后的数据合并
-	ciphertextWithNonce := append(nonce, ciphertext...)
-
-	// 将加密后的字节切片转换为 base64 编码的字符串
-	ciphertextBase64 := base64.StdEncoding.EncodeToString(ciphertextWithNonce)
-
-	return ciphertextBase64, nil
+// signCallbackData 计算回调数据的签名，签名绑定所在的会话，防止按钮数据被篡改或挪用
+func signCallbackData(chatId int64, data string) string {
+	mac := hmac.New(sha256.New, callbackKey)
+	mac.Write([]byte(strconv.FormatInt(chatId, 10)))
+	mac.Write([]byte{0})
+	mac.Write([]byte(data))
+	// Telegram 限制回调数据最多 64 字节，截取前 8 字节即可
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:8])
 }
 
-func decryptString(ciphertextBase64 string) (string, error) {
-	// 将输入字符串转换为字节切片
-	ciphertextWithNonce, err := base64.StdEncoding.DecodeString(ciphertextBase64)
-	if err != nil {
-		return "", err
-	}
-
-	// 提取 nonce
-	nonce := ciphertextWithNonce[:chacha20poly1305.NonceSize]
-	ciphertext := ciphertextWithNonce[chacha20poly1305.NonceSize:]
-
-	// 使用全局加密实例进行解密
-	decryptedText, err := chachaCipher.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return "", err
-	}
-
-	return string(decryptedText), nil
+func verifyCallbackData(chatId int64, data string, signature string) bool {
+	expected := signCallbackData(chatId, data)
+	return hmac.Equal([]byte(expected), []byte(signature))
 }
 
 func calculateTraffic(byteSize int64) string {
@@ -133,3 +102,36 @@ func calculateTraffic(byteSize int64) string {
 		return fmt.Sprintf("%d Bytes", byteSize)
 	}
 }
+
+// truncateRunes 按字符截断过长的文本
+func truncateRunes(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max]) + "…"
+}
+
+// displayWidth 文本在等宽字体中占用的列数，中文等全角字符占 2 列
+func displayWidth(s string) int {
+	columns := 0
+	for _, r := range s {
+		switch width.LookupRune(r).Kind() {
+		case width.EastAsianWide, width.EastAsianFullwidth:
+			columns += 2
+		default:
+			columns++
+		}
+	}
+	return columns
+}
+
+// padRight 在右侧补空格到 columns 列，用于代码块中左对齐的表格列
+func padRight(s string, columns int) string {
+	return s + strings.Repeat(" ", max(0, columns-displayWidth(s)))
+}
+
+// padLeft 在左侧补空格到 columns 列，用于代码块中右对齐的表格列
+func padLeft(s string, columns int) string {
+	return strings.Repeat(" ", max(0, columns-displayWidth(s))) + s
+}
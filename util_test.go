@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestPadDisplayWidth(t *testing.T) {
+	cases := []struct {
+		s            string
+		columns      int
+		right, left  string
+		displayWidth int
+	}{
+		{"main", 6, "main  ", "  main", 4},
+		{"别名", 6, "别名  ", "  别名", 4},
+		{"ｆｕｌｌ", 6, "ｆｕｌｌ", "ｆｕｌｌ", 8},
+		{"已用G", 6, "已用G ", " 已用G", 5},
+	}
+	for _, c := range cases {
+		if width := displayWidth(c.s); width != c.displayWidth {
+			t.Errorf("%q 的显示宽度 = %d，期望 %d", c.s, width, c.displayWidth)
+		}
+		if padded := padRight(c.s, c.columns); padded != c.right {
+			t.Errorf("padRight(%q) = %q，期望 %q", c.s, padded, c.right)
+		}
+		if padded := padLeft(c.s, c.columns); padded != c.left {
+			t.Errorf("padLeft(%q) = %q，期望 %q", c.s, padded, c.left)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	tele "gopkg.in/telebot.v3"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// 设置 Webhook 失败后的重试间隔
+const webhookRetryInterval = 30 * time.Second
+
+// webhookPoller 通过内置 HTTP 服务接收 Telegram 推送，启动时设置 Webhook，停止时删除
+type webhookPoller struct {
+	config WebhookConfig
+	// 只在 Poll 运行期间有值，其余时间收到的推送返回 503，由 Telegram 稍后重试
+	dest atomic.Pointer[chan tele.Update]
+}
+
+func newWebhookPoller(config WebhookConfig) *webhookPoller {
+	return &webhookPoller{config: config}
+}
+
+func (p *webhookPoller) Poll(b *tele.Bot, dest chan tele.Update, stop chan struct{}) {
+	webhook := &tele.Webhook{
+		SecretToken: p.config.SecretToken,
+		Endpoint:    &tele.WebhookEndpoint{PublicURL: p.config.PublicUrl, Cert: p.config.Cert},
+	}
+	for {
+		err := b.SetWebhook(webhook)
+		if err == nil {
+			break
+		}
+		log.WithField("component", "telegram_webhook").Errorf("设置 Webhook 失败，%s 后重试: %v", webhookRetryInterval, err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(webhookRetryInterval):
+		}
+	}
+	log.Info("Webhook 已设置: ", p.config.PublicUrl)
+
+	p.dest.Store(&dest)
+	<-stop
+	p.dest.Store(nil)
+
+	if err := b.RemoveWebhook(); err != nil {
+		log.WithField("component", "telegram_webhook").Error("删除 Webhook 失败: ", err)
+		return
+	}
+	log.Info("Webhook 已删除")
+}
+
+func (p *webhookPoller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	secret := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(p.config.SecretToken)) != 1 {
+		log.Warn("Webhook 请求的 secret token 错误，来源: ", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	dest := p.dest.Load()
+	if dest == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	var update tele.Update
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		log.Warn("Webhook 请求内容无法解析: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case *dest <- update:
+	case <-r.Context().Done():
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+// checkWebhook 检查 Telegram 记录的 Webhook 地址和最近的推送错误
+func checkWebhook(config WebhookConfig) error {
+	info, err := bot.Webhook()
+	if err != nil {
+		return err
+	}
+	if info.Listen != config.PublicUrl {
+		return fmt.Errorf("Webhook 地址不一致: %q", info.Listen)
+	}
+	if info.ErrorUnixtime > 0 && time.Since(time.Unix(info.ErrorUnixtime, 0)) < 10*time.Minute {
+		return fmt.Errorf("最近推送失败: %s，待推送 %d 条", info.ErrorMessage, info.PendingUpdates)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+func TestWebhookPollerServeHTTP(t *testing.T) {
+	poller := newWebhookPoller(WebhookConfig{SecretToken: "secret"})
+	serve := func(method string, secret string, body string) int {
+		r := httptest.NewRequest(method, "/telegram/webhook", strings.NewReader(body))
+		if len(secret) > 0 {
+			r.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+		}
+		w := httptest.NewRecorder()
+		poller.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := serve(http.MethodGet, "secret", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET 返回 %d", code)
+	}
+	if code := serve(http.MethodPost, "wrong", `{"update_id":1}`); code != http.StatusUnauthorized {
+		t.Errorf("错误的 secret 返回 %d", code)
+	}
+	if code := serve(http.MethodPost, "", `{"update_id":1}`); code != http.StatusUnauthorized {
+		t.Errorf("缺少 secret 返回 %d", code)
+	}
+	if code := serve(http.MethodPost, "secret", `{"update_id":1}`); code != http.StatusServiceUnavailable {
+		t.Errorf("未开始接收时返回 %d", code)
+	}
+
+	dest := make(chan tele.Update, 1)
+	poller.dest.Store(&dest)
+	if code := serve(http.MethodPost, "secret", "{"); code != http.StatusBadRequest {
+		t.Errorf("内容无法解析时返回 %d", code)
+	}
+	if code := serve(http.MethodPost, "secret", `{"update_id":42}`); code != http.StatusOK {
+		t.Fatalf("正常推送返回 %d", code)
+	}
+	if update := <-dest; update.ID != 42 {
+		t.Errorf("收到的 update_id = %d", update.ID)
+	}
+}
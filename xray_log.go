@@ -2,19 +2,63 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"database/sql/driver"
 	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net/http"
 	"os"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var XrayServerName string
 
+// 最后一次读取到日志的时间，用于健康检查
+var xrayLogLastRead atomic.Int64
+
+// 最近一次 CF D1 请求的错误，成功后清空
+var cfD1LastError atomic.Pointer[string]
+
+// xrayLogFilter 按来源 IP 和用户丢弃日志，重新加载配置时整体替换
+type xrayLogFilter struct {
+	ips   map[string]struct{}
+	users map[string]struct{}
+}
+
+var currentXrayLogFilter atomic.Pointer[xrayLogFilter]
+
+func InitXrayLogFilter(config XrayLogConfig) {
+	filter := &xrayLogFilter{ips: map[string]struct{}{}, users: map[string]struct{}{}}
+	for _, ip := range config.IgnoreIps {
+		filter.ips[ip] = struct{}{}
+	}
+	for _, user := range config.IgnoreUsers {
+		filter.users[user] = struct{}{}
+	}
+	currentXrayLogFilter.Store(filter)
+}
+
+func (f *xrayLogFilter) ignore(entry XrayLog) bool {
+	if f == nil {
+		return false
+	}
+	_, ignoreIp := f.ips[entry.IP]
+	_, ignoreUser := f.users[entry.User]
+	return ignoreIp || ignoreUser
+}
+
+// 打开日志文件失败后的重试间隔
+const xrayLogOpenRetryInterval = 30 * time.Second
+
+// CF D1 共用的 HTTP 客户端，插入日志不是幂等的，超时后服务端可能已经写入，不自动重试
+var cfD1HttpClient = NewHttpClient("CF D1", 10*time.Second)
+
 type RequestTime struct {
 	time.Time
 }
@@ -25,6 +69,11 @@ func (ct RequestTime) MarshalJSON() ([]byte, error) {
 	return json.Marshal(formatted)
 }
 
+// Value 写入数据库时使用内嵌的 time.Time
+func (ct RequestTime) Value() (driver.Value, error) {
+	return ct.Time, nil
+}
+
 type XrayLog struct {
 	Pid         int64       `db:"pid" json:"-"`
 	User        string      `db:"user" json:"user"`
@@ -36,102 +85,169 @@ type XrayLog struct {
 	Server      string      `db:"server" json:"server"`
 }
 
-func init() {
+// StartXrayLogWatcher 启动日志监听和保存，退出时停止读取新日志，保存 logChannel 中剩余的日志并发送最后一批到 CF D1
+func StartXrayLogWatcher(lifecycle *Lifecycle, config XrayLogConfig, d1Config CloudflareD1Config) {
 	logChannel := make(chan XrayLog, 300)
-	logFilePath := os.Getenv("XRAY_LOG_PATH")
-	if len(logFilePath) == 0 {
+	if len(config.Path) == 0 {
 		log.Info("未设置 Xray 日志文件路径")
 		return
 	}
 
-	XrayServerName = os.Getenv("XRAY_SERVER_NAME")
+	metricsRegistry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "xray_log_channel_depth",
+		Help: "等待保存的 Xray 日志数量",
+	}, func() float64 {
+		return float64(len(logChannel))
+	}))
+
+	healthRegistry.Register(HealthCheck{Name: "xray_log", Check: func(ctx context.Context) error {
+		if idle := time.Since(time.Unix(xrayLogLastRead.Load(), 0)); idle > xrayLogFreshness {
+			return fmt.Errorf("已有 %s 没有读取到新的日志", idle.Round(time.Minute))
+		}
+		return nil
+	}})
+	healthRegistry.Register(HealthCheck{Name: "cf_d1", Check: func(ctx context.Context) error {
+		if depth := len(logChannel); depth >= cap(logChannel)*8/10 {
+			return fmt.Errorf("待保存的日志积压 %d 条", depth)
+		}
+		if failure := cfD1LastError.Load(); failure != nil {
+			return fmt.Errorf("最近一次请求失败: %s", *failure)
+		}
+		return nil
+	}})
+
+	XrayServerName = config.ServerName
+	cfD1HttpClient.Secrets = []string{d1Config.RequestToken}
 
 	// 启动日志文件监听的 goroutine
-	go watchXrayLogFile(logFilePath, logChannel)
+	go watchXrayLogFile(lifecycle.Context(), config.Path, logChannel)
 
 	// 启动日志处理 goroutine
-	go saveXrayLogEntries(logChannel)
+	saved := make(chan struct{})
+	go func() {
+		defer close(saved)
+		saveXrayLogEntries(logChannel, d1Config)
+	}()
+
+	lifecycle.OnStop("Xray 日志保存", func(ctx context.Context) error {
+		return waitDone(ctx, saved)
+	})
 }
 
-func watchXrayLogFile(logFilePath string, logChannel chan XrayLog) {
-	file, err := os.Open(logFilePath)
+// watchXrayLogFile 持续读取新增的日志，ctx 取消后关闭 logChannel
+func watchXrayLogFile(ctx context.Context, logFilePath string, logChannel chan XrayLog) {
+	defer close(logChannel)
+
+	file, err := openXrayLogFile(ctx, logFilePath)
 	if err != nil {
-		log.Fatalf("无法打开日志文件: %v", err)
+		return
 	}
 	defer file.Close()
 
 	// 定位到文件末尾，模拟 `tail -f`
 	_, _ = file.Seek(0, io.SeekEnd)
 	reader := bufio.NewReader(file)
+	xrayLogLastRead.Store(time.Now().Unix())
 
 	for {
 		// 每次读取一行
 		line, err := reader.ReadString('\n')
 		if err != nil {
 			// EOF 时暂停读取一段时间，等待新日志写入
-			time.Sleep(1 * time.Second)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(1 * time.Second):
+			}
 			continue
 		}
 
+		xrayLogLastRead.Store(time.Now().Unix())
+
 		// 解析日志行
 		entry, ok := parseXrayLogEntry(line)
-		if ok {
+		if !ok {
+			xrayLogLines.WithLabelValues("dropped").Inc()
+		} else {
+			xrayLogLines.WithLabelValues("parsed").Inc()
 			// 将解析结果发送到 logChannel
-			logChannel <- entry
+			select {
+			case logChannel <- entry:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// openXrayLogFile 日志文件可能在 Xray 启动后才创建，打开失败时定期重试，直到 ctx 取消
+func openXrayLogFile(ctx context.Context, logFilePath string) (*os.File, error) {
+	for {
+		file, err := os.Open(logFilePath)
+		if err == nil {
+			return file, nil
+		}
+		log.WithField("component", "xray_log").Errorf("无法打开日志文件，%s 后重试: %v", xrayLogOpenRetryInterval, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(xrayLogOpenRetryInterval):
 		}
 	}
 }
 
-func saveXrayLogEntries(logChannel chan XrayLog) {
+func saveXrayLogEntries(logChannel chan XrayLog, d1Config CloudflareD1Config) {
 	var entries []XrayLog
 	count := 0
 	for entry := range logChannel {
 		// 数据插入数据库
-		_ = InsertXrayLog(&entry)
+		if err := store.XrayLogs.Insert(&entry); err != nil {
+			xrayLogLines.WithLabelValues("failed").Inc()
+		}
 		entries = append(entries, entry)
 		count++
 		if count == 10 {
 			// 保存到 CF D1 数据库
-			saveToCloudFlareD1(entries)
+			saveToCloudFlareD1(d1Config, entries)
 			entries = []XrayLog{}
 			count = 0
 		}
 	}
+
+	// logChannel 已关闭，发送剩余不足一批的日志
+	if count > 0 {
+		saveToCloudFlareD1(d1Config, entries)
+	}
 }
 
-func saveToCloudFlareD1(entries []XrayLog) {
+func saveToCloudFlareD1(config CloudflareD1Config, entries []XrayLog) {
+	if len(config.InsertUrl) == 0 {
+		return
+	}
 	records := map[string]interface{}{
 		"records": entries,
 	}
 	jsonData, err := json.Marshal(records)
 	if err != nil {
-		log.Error("JSON 序列化错误:", err)
-		return
-	}
-
-	url := os.Getenv("CF_D1_INSERT_URL")
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Error("创建 CF D1 请求错误:", err)
+		log.WithField("component", "cf_d1").Error("JSON 序列化错误:", err)
 		return
 	}
 
-	token := os.Getenv("CF_D1_REQUEST_TOKEN")
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+config.RequestToken)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	start := time.Now()
+	_, err = cfD1HttpClient.PostJson(config.InsertUrl, header, jsonData)
+	observeSince(cfD1RequestDuration, start)
 	if err != nil {
-		log.Error("发送 CF D1 请求错误:", err)
+		cfD1Requests.WithLabelValues("failure").Inc()
+		message := err.Error()
+		cfD1LastError.Store(&message)
+		log.WithField("component", "cf_d1").Error("CF D1 请求失败: ", err)
 		return
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Errorf("CF D1 请求失败，状态码: %d，返回内容: %s", resp.StatusCode, string(body))
-	}
+	cfD1Requests.WithLabelValues("success").Inc()
+	cfD1LastError.Store(nil)
 }
 
 func parseXrayLogEntry(line string) (XrayLog, bool) {
@@ -148,11 +264,9 @@ func parseXrayLogEntry(line string) (XrayLog, bool) {
 	}
 
 	ip := match[2]
-	if ip == "127.0.0.1" || ip == "1.1.1.1" || ip == "8.8.8.8" {
-		return XrayLog{}, false
-	}
 
-	requestTime, err := time.Parse("2006/01/02 15:04:05", match[1])
+	// Xray 日志中是服务器的本地时间
+	requestTime, err := time.ParseInLocation("2006/01/02 15:04:05", match[1], time.Local)
 	if err != nil {
 		log.Println("时间解析错误:", err)
 		return XrayLog{}, false
@@ -169,6 +283,9 @@ func parseXrayLogEntry(line string) (XrayLog, bool) {
 		RequestTime: RequestTime{requestTime},
 		Server:      XrayServerName,
 	}
+	if currentXrayLogFilter.Load().ignore(entry) {
+		return XrayLog{}, false
+	}
 
 	return entry, true
 }
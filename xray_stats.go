@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	tele "gopkg.in/telebot.v3"
+	"sort"
+	"strings"
+	"time"
+)
+
+type XrayStatsScope = string
+
+const (
+	XrayStatsDay   XrayStatsScope = "d"
+	XrayStatsWeek  XrayStatsScope = "w"
+	XrayStatsMonth XrayStatsScope = "m"
+)
+
+// XrayStatsUnique 流量报告按钮的回调标识
+const XrayStatsUnique = "xs"
+
+const callbackDateFormat = "20060102"
+
+// XrayStatsQuery 流量报告的查询条件，User 为空时展示全部用户的汇总
+type XrayStatsQuery struct {
+	Scope XrayStatsScope
+	Date  time.Time
+	User  string
+}
+
+// Range 返回查询覆盖的起止日期（包含两端）
+func (q XrayStatsQuery) Range() (time.Time, time.Time) {
+	date := time.Date(q.Date.Year(), q.Date.Month(), q.Date.Day(), 0, 0, 0, 0, time.Local)
+	switch q.Scope {
+	case XrayStatsWeek:
+		// 以周一作为一周的开始
+		from := date.AddDate(0, 0, -((int(date.Weekday()) + 6) % 7))
+		return from, from.AddDate(0, 0, 6)
+	case XrayStatsMonth:
+		from := date.AddDate(0, 0, 1-date.Day())
+		return from, from.AddDate(0, 1, -1)
+	default:
+		return date, date
+	}
+}
+
+func (q XrayStatsQuery) rangeStart() time.Time {
+	from, _ := q.Range()
+	return from
+}
+
+// Shift 按当前粒度前后移动 n 个周期
+func (q XrayStatsQuery) Shift(n int) XrayStatsQuery {
+	switch q.Scope {
+	case XrayStatsWeek:
+		q.Date = q.Date.AddDate(0, 0, 7*n)
+	case XrayStatsMonth:
+		from, _ := q.Range()
+		q.Date = from.AddDate(0, n, 0)
+	default:
+		q.Date = q.Date.AddDate(0, 0, n)
+	}
+	return q
+}
+
+func (q XrayStatsQuery) Title() string {
+	from, to := q.Range()
+	var period string
+	switch q.Scope {
+	case XrayStatsWeek:
+		period = fmt.Sprintf("%s ~ %s", from.Format(DateFormat), to.Format(DateFormat))
+	case XrayStatsMonth:
+		period = from.Format("2006-01")
+	default:
+		period = from.Format(DateFormat)
+	}
+	if len(q.User) > 0 {
+		return fmt.Sprintf("%s %s", q.User, period)
+	}
+	return period
+}
+
+// bucketKey 汇总维度：全部用户时按用户，单个用户按小时（日报）或按天（周报、月报）
+func (q XrayStatsQuery) bucketKey(user string, date string, hour string) string {
+	switch {
+	case len(q.User) == 0:
+		return user
+	case q.Scope == XrayStatsDay:
+		return hour
+	default:
+		return date
+	}
+}
+
+// trafficAccumulator 按 Key 累加流量，并保留首次出现的顺序
+type trafficAccumulator struct {
+	list []*Traffic
+	m    map[string]*Traffic
+}
+
+func newTrafficAccumulator() *trafficAccumulator {
+	return &trafficAccumulator{list: make([]*Traffic, 0), m: map[string]*Traffic{}}
+}
+
+func (a *trafficAccumulator) Add(key string, down int64, up int64) {
+	traffic, ok := a.m[key]
+	if !ok {
+		traffic = &Traffic{User: key}
+		a.m[key] = traffic
+		a.list = append(a.list, traffic)
+	}
+	traffic.Down = traffic.Down + down
+	traffic.Up = traffic.Up + up
+}
+
+func queryXrayStats(q XrayStatsQuery) ([]*Traffic, error) {
+	from, to := q.Range()
+	fromDate, toDate := from.Format(DateFormat), to.Format(DateFormat)
+
+	var xrayUserStatsList *[]XrayUserStats
+	var err error
+	if len(q.User) == 0 {
+		xrayUserStatsList, err = store.XrayStats.SelectByDateRange(fromDate, toDate)
+	} else {
+		xrayUserStatsList, err = store.XrayStats.SelectByUserAndDateRange(q.User, fromDate, toDate)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	acc := newTrafficAccumulator()
+	for _, xrayUserStats := range *xrayUserStatsList {
+		acc.Add(q.bucketKey(xrayUserStats.User, xrayUserStats.Date, xrayUserStats.Time), xrayUserStats.Down, xrayUserStats.Up)
+	}
+
+	// 包含当天时 统计还未落库的数据
+	thisHour := time.Now().Add(-time.Minute).Truncate(time.Hour)
+	today := thisHour.Format(DateFormat)
+	if fromDate <= today && today <= toDate {
+		trafficList, _ := GetTraffic(false)
+		for _, traffic := range trafficList {
+			if len(q.User) > 0 && traffic.User != q.User {
+				continue
+			}
+			acc.Add(q.bucketKey(traffic.User, today, thisHour.Format(TimeFormat)), traffic.Down, traffic.Up)
+		}
+	}
+
+	if len(q.User) == 0 {
+		// 按总流量排序
+		sort.SliceStable(acc.list, func(i, j int) bool {
+			return acc.list[i].Down+acc.list[i].Up > acc.list[j].Down+acc.list[j].Up
+		})
+	} else {
+		// 按时间排序
+		sort.SliceStable(acc.list, func(i, j int) bool {
+			return acc.list[i].User < acc.list[j].User
+		})
+	}
+	return acc.list, nil
+}
+
+// renderXrayStats 生成流量报告及其导航按钮
+func renderXrayStats(chatId int64, q XrayStatsQuery) (string, *tele.ReplyMarkup, error) {
+	trafficList, err := queryXrayStats(q)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var total int64 = 0
+	users := make([]string, 0)
+	msgSlice := make([]string, 0)
+	msgSlice = append(msgSlice, fmt.Sprintf("*%s 流量使用情况*", ReplaceForMarkdownV2(q.Title())))
+	for _, traffic := range trafficList {
+		userTotal := traffic.Up + traffic.Down
+		total = total + userTotal
+		if userTotal == 0 {
+			continue
+		}
+		trafficInfo := fmt.Sprintf("*%s*：%s", ReplaceForMarkdownV2(traffic.User), ReplaceForMarkdownV2(calculateTraffic(userTotal)))
+		msgSlice = append(msgSlice, trafficInfo)
+		if len(q.User) == 0 {
+			users = append(users, traffic.User)
+		}
+	}
+
+	markup := buildXrayStatsMarkup(chatId, q, users)
+	if total == 0 {
+		return ReplaceForMarkdownV2(fmt.Sprintf("%s 流量信息为空", q.Title())), markup, nil
+	}
+
+	msgSlice = append(msgSlice, fmt.Sprintf("*总流量*：%s", ReplaceForMarkdownV2(calculateTraffic(total))))
+	return strings.Join(msgSlice, "\n"), markup, nil
+}
+
+func buildXrayStatsMarkup(chatId int64, q XrayStatsQuery, users []string) *tele.ReplyMarkup {
+	markup := &tele.ReplyMarkup{}
+	rows := make([]tele.Row, 0)
+
+	var prevText, nextText string
+	switch q.Scope {
+	case XrayStatsWeek:
+		prevText, nextText = "« 上一周", "下一周 »"
+	case XrayStatsMonth:
+		prevText, nextText = "« 上个月", "下个月 »"
+	default:
+		prevText, nextText = "« 前一天", "后一天 »"
+	}
+	navigation := make([]tele.Btn, 0, 2)
+	if btn, ok := xrayStatsButton(markup, chatId, prevText, q.Shift(-1)); ok {
+		navigation = append(navigation, btn)
+	}
+	if next := q.Shift(1); !next.rangeStart().After(time.Now()) {
+		if btn, ok := xrayStatsButton(markup, chatId, nextText, next); ok {
+			navigation = append(navigation, btn)
+		}
+	}
+	rows = append(rows, markup.Row(navigation...))
+
+	scopes := make([]tele.Btn, 0, 2)
+	for _, scope := range []struct {
+		scope XrayStatsScope
+		text  string
+	}{{XrayStatsDay, "按日"}, {XrayStatsWeek, "按周"}, {XrayStatsMonth, "按月"}} {
+		if scope.scope == q.Scope {
+			continue
+		}
+		if btn, ok := xrayStatsButton(markup, chatId, scope.text, XrayStatsQuery{Scope: scope.scope, Date: q.Date, User: q.User}); ok {
+			scopes = append(scopes, btn)
+		}
+	}
+	rows = append(rows, markup.Row(scopes...))
+
+	if len(q.User) > 0 {
+		if btn, ok := xrayStatsButton(markup, chatId, "« 返回全部用户", XrayStatsQuery{Scope: q.Scope, Date: q.Date}); ok {
+			rows = append(rows, markup.Row(btn))
+		}
+	} else {
+		userButtons := make([]tele.Btn, 0, len(users))
+		for _, user := range users {
+			if btn, ok := xrayStatsButton(markup, chatId, user, XrayStatsQuery{Scope: q.Scope, Date: q.Date, User: user}); ok {
+				userButtons = append(userButtons, btn)
+			}
+		}
+		rows = append(rows, markup.Split(2, userButtons)...)
+	}
+
+	markup.Inline(rows...)
+	return markup
+}
+
+// xrayStatsButton 生成带签名的按钮，数据格式为 scope|date|user|signature
+func xrayStatsButton(markup *tele.ReplyMarkup, chatId int64, text string, q XrayStatsQuery) (tele.Btn, bool) {
+	if strings.Contains(q.User, "|") {
+		return tele.Btn{}, false
+	}
+	date := q.Date.Format(callbackDateFormat)
+	signature := signCallbackData(chatId, strings.Join([]string{q.Scope, date, q.User}, "|"))
+	btn := markup.Data(text, XrayStatsUnique, q.Scope, date, q.User, signature)
+	// 回调数据为 "\f" + unique + "|" + data，Telegram 限制最多 64 字节
+	if len(btn.Data)+len(XrayStatsUnique)+2 > 64 {
+		return tele.Btn{}, false
+	}
+	return btn, true
+}
+
+func parseXrayStatsCallback(chatId int64, data string) (XrayStatsQuery, error) {
+	parts := strings.Split(data, "|")
+	if len(parts) != 4 {
+		return XrayStatsQuery{}, errors.New("回调数据格式错误")
+	}
+	if !verifyCallbackData(chatId, strings.Join(parts[:3], "|"), parts[3]) {
+		return XrayStatsQuery{}, errors.New("回调数据签名校验失败")
+	}
+	switch parts[0] {
+	case XrayStatsDay, XrayStatsWeek, XrayStatsMonth:
+	default:
+		return XrayStatsQuery{}, errors.New("未知的统计粒度")
+	}
+	date, err := time.ParseInLocation(callbackDateFormat, parts[1], time.Local)
+	if err != nil {
+		return XrayStatsQuery{}, err
+	}
+	return XrayStatsQuery{Scope: parts[0], Date: date, User: parts[2]}, nil
+}
+
+func XrayStatsCallbackHandler(c tele.Context) error {
+	// 按钮可能被转发或由其他人点击，需重新判断查询权限
+	if !IsXrayStatsAdmin(c.Sender().ID) {
+		return respondFailure(c, "无查询权限")
+	}
+
+	query, err := parseXrayStatsCallback(c.Chat().ID, c.Callback().Data)
+	if err != nil {
+		log.Warn("流量报告回调数据无效: ", err)
+		return respondFailure(c, "按钮已失效")
+	}
+
+	reply, markup, err := renderXrayStats(c.Chat().ID, query)
+	if err != nil {
+		log.Error("获取流量情况失败", err)
+		return respondFailure(c, "获取流量情况失败")
+	}
+
+	if err := c.Edit(reply, markup); err != nil && !errors.Is(err, tele.ErrSameMessageContent) && !errors.Is(err, tele.ErrMessageNotModified) {
+		log.Error("更新流量报告失败", err)
+	}
+	return c.Respond()
+}
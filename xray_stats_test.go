@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+func initTestCallbackSigner(t *testing.T) {
+	t.Helper()
+	initTestStore(t)
+	InitKeyring(KeyConfig{Passphrase: "callback test passphrase"})
+	InitCallbackSigner()
+}
+
+func TestXrayStatsCallbackRoundTrip(t *testing.T) {
+	initTestCallbackSigner(t)
+
+	query := XrayStatsQuery{Scope: XrayStatsWeek, Date: time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local), User: "alice"}
+	btn, ok := xrayStatsButton(&tele.ReplyMarkup{}, 100, "alice", query)
+	if !ok {
+		t.Fatal("按钮应当生成成功")
+	}
+	parsed, err := parseXrayStatsCallback(100, btn.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Scope != query.Scope || !parsed.Date.Equal(query.Date) || parsed.User != query.User {
+		t.Errorf("解析结果 = %+v，期望 %+v", parsed, query)
+	}
+}
+
+func TestXrayStatsCallbackRejectsTampering(t *testing.T) {
+	initTestCallbackSigner(t)
+
+	query := XrayStatsQuery{Scope: XrayStatsDay, Date: time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local), User: "alice"}
+	btn, _ := xrayStatsButton(&tele.ReplyMarkup{}, 100, "alice", query)
+	parts := strings.Split(btn.Data, "|")
+	tamper := func(index int, value string) string {
+		tampered := append([]string(nil), parts...)
+		tampered[index] = value
+		return strings.Join(tampered, "|")
+	}
+
+	cases := map[string]struct {
+		chatId int64
+		data   string
+	}{
+		"篡改粒度":   {100, tamper(0, XrayStatsMonth)},
+		"篡改日期":   {100, tamper(1, "20240502")},
+		"篡改用户":   {100, tamper(2, "bob")},
+		"去掉用户":   {100, tamper(2, "")},
+		"错误的签名":  {100, tamper(3, signCallbackData(100, "d|20240501|bob"))},
+		"空签名":    {100, tamper(3, "")},
+		"其他会话":   {200, btn.Data},
+		"字段数量错误": {100, strings.Join(parts[:3], "|")},
+		"多出的字段":  {100, btn.Data + "|extra"},
+	}
+	for name, c := range cases {
+		if _, err := parseXrayStatsCallback(c.chatId, c.data); err == nil {
+			t.Errorf("%s：%q 应当校验失败", name, c.data)
+		}
+	}
+
+	// 签名正确但内容无效时同样拒绝
+	for _, data := range []string{"x|20240501|", "d|2024-05-01|"} {
+		fields := strings.Split(data, "|")
+		signed := data + "|" + signCallbackData(100, strings.Join(fields[:3], "|"))
+		if _, err := parseXrayStatsCallback(100, signed); err == nil {
+			t.Errorf("%q 应当解析失败", signed)
+		}
+	}
+}
+
+func TestXrayStatsButtonLimit(t *testing.T) {
+	initTestCallbackSigner(t)
+
+	date := time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)
+	// "\f" + "xs|" + "d|20240501|" + 用户 + "|" + 11 字节签名，用户名最多 37 字节
+	btn, ok := xrayStatsButton(&tele.ReplyMarkup{}, 100, "", XrayStatsQuery{Scope: XrayStatsDay, Date: date, User: strings.Repeat("u", 37)})
+	if size := len("\f" + XrayStatsUnique + "|" + btn.Data); !ok || size != 64 {
+		t.Fatalf("恰好 64 字节的按钮应当生成: %q，%d 字节", btn.Data, size)
+	}
+	// 超过 Telegram 64 字节限制的按钮和包含分隔符的用户名不生成
+	for _, user := range []string{strings.Repeat("u", 38), "a|b"} {
+		if _, ok := xrayStatsButton(&tele.ReplyMarkup{}, 100, "", XrayStatsQuery{Scope: XrayStatsDay, Date: date, User: user}); ok {
+			t.Errorf("用户 %q 不应生成按钮", user)
+		}
+	}
+}
+
+func TestXrayStatsQueryRange(t *testing.T) {
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, time.Local)
+	}
+	cases := []struct {
+		query    XrayStatsQuery
+		from, to time.Time
+	}{
+		{XrayStatsQuery{Scope: XrayStatsDay, Date: time.Date(2024, 5, 1, 23, 59, 0, 0, time.Local)}, day(2024, 5, 1), day(2024, 5, 1)},
+		// 2024-12-31 为周二，所在的周跨年
+		{XrayStatsQuery{Scope: XrayStatsWeek, Date: day(2024, 12, 31)}, day(2024, 12, 30), day(2025, 1, 5)},
+		// 周日属于前一个周一开始的周
+		{XrayStatsQuery{Scope: XrayStatsWeek, Date: day(2024, 6, 2)}, day(2024, 5, 27), day(2024, 6, 2)},
+		{XrayStatsQuery{Scope: XrayStatsMonth, Date: day(2024, 2, 15)}, day(2024, 2, 1), day(2024, 2, 29)},
+		{XrayStatsQuery{Scope: XrayStatsMonth, Date: day(2023, 12, 31)}, day(2023, 12, 1), day(2023, 12, 31)},
+	}
+	for _, c := range cases {
+		if from, to := c.query.Range(); !from.Equal(c.from) || !to.Equal(c.to) {
+			t.Errorf("%+v 的范围 = %s ~ %s，期望 %s ~ %s", c.query, from, to, c.from, c.to)
+		}
+	}
+}
+
+func TestXrayStatsQueryShift(t *testing.T) {
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, time.Local)
+	}
+	cases := []struct {
+		query XrayStatsQuery
+		n     int
+		from  time.Time
+	}{
+		{XrayStatsQuery{Scope: XrayStatsDay, Date: day(2024, 12, 31)}, 1, day(2025, 1, 1)},
+		{XrayStatsQuery{Scope: XrayStatsDay, Date: day(2024, 3, 1)}, -1, day(2024, 2, 29)},
+		{XrayStatsQuery{Scope: XrayStatsWeek, Date: day(2024, 12, 28)}, 1, day(2024, 12, 30)},
+		{XrayStatsQuery{Scope: XrayStatsWeek, Date: day(2025, 1, 1)}, -1, day(2024, 12, 23)},
+		// 1 月 31 日的下个月是 2 月，而不是 AddDate 溢出后的 3 月
+		{XrayStatsQuery{Scope: XrayStatsMonth, Date: day(2024, 1, 31)}, 1, day(2024, 2, 1)},
+		{XrayStatsQuery{Scope: XrayStatsMonth, Date: day(2024, 3, 31)}, -1, day(2024, 2, 1)},
+		{XrayStatsQuery{Scope: XrayStatsMonth, Date: day(2024, 12, 15)}, 1, day(2025, 1, 1)},
+		{XrayStatsQuery{Scope: XrayStatsMonth, Date: day(2025, 1, 15)}, -13, day(2023, 12, 1)},
+	}
+	for _, c := range cases {
+		if from := c.query.Shift(c.n).rangeStart(); !from.Equal(c.from) {
+			t.Errorf("%+v 移动 %d 后从 %s 开始，期望 %s", c.query, c.n, from, c.from)
+		}
+	}
+}